@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	// Embed the time zone database, the Lambda runtime may not provide one
+	_ "time/tzdata"
+)
+
+const (
+	shiftURL      = "https://m.shiftboard.com/onlocationexp/schedules/shifts/"
+	icsProdID     = "-//shiftboard-bot//Shift Calendar//EN"
+	icsUIDDomain  = "shiftboard-bot"
+	icsCalName    = "ShiftBoard shifts"
+	icsRefresh    = "PT1H"
+	icsDateLayout = "2006-01-02T15:04:05"
+	icsTimeLayout = "20060102T150405"
+	icsUTCLayout  = "20060102T150405Z"
+	icsLineLength = 75
+)
+
+// constructCalendar renders the shifts as an RFC 5545 calendar. Shift times
+// are converted from the time zone to UTC, or left floating in the
+// subscriber's time zone when no time zone is configured. Shifts with
+// unparsable dates are skipped.
+func constructCalendar(ctx context.Context, shifts []Shift, timezone string, now time.Time) (string, error) {
+	loc := time.UTC
+	if timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(timezone); err != nil {
+			return "", fmt.Errorf("invalid time zone '%s': %v", timezone, err)
+		}
+	}
+
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:" + icsProdID,
+		"CALSCALE:GREGORIAN",
+		"METHOD:PUBLISH",
+		"X-WR-CALNAME:" + icsCalName,
+		"REFRESH-INTERVAL;VALUE=DURATION:" + icsRefresh,
+		"X-PUBLISHED-TTL:" + icsRefresh,
+	}
+
+	for _, shift := range shifts {
+		event, err := constructEvent(shift, loc, timezone == "", now)
+		if err != nil {
+			loggerFrom(ctx).Warn("Skipping shift", field("shiftId", shift.ID), errField(err))
+			continue
+		}
+
+		lines = append(lines, event...)
+	}
+
+	lines = append(lines, "END:VCALENDAR")
+
+	var buf bytes.Buffer
+	for _, line := range lines {
+		buf.WriteString(icsFold(line))
+		buf.WriteString("\r\n")
+	}
+
+	return buf.String(), nil
+}
+
+// constructEvent returns the VEVENT lines of a shift. The UID matches the
+// calendar invites sent by the notification function.
+func constructEvent(shift Shift, loc *time.Location, floating bool, now time.Time) ([]string, error) {
+	start, err := time.ParseInLocation(icsDateLayout, shift.StartDate, loc)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing start date: %v", err)
+	}
+
+	end, err := time.ParseInLocation(icsDateLayout, shift.EndDate, loc)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing end date: %v", err)
+	}
+
+	// Shifts ending at or before their start time end on the next day
+	if !end.After(start) {
+		end = end.AddDate(0, 0, 1)
+	}
+
+	sequence := shift.Updated.Unix()
+	if sequence < 0 {
+		sequence = 0
+	}
+
+	event := []string{
+		"BEGIN:VEVENT",
+		"UID:" + shift.ID + "@" + icsUIDDomain,
+		fmt.Sprintf("SEQUENCE:%d", sequence),
+		"DTSTAMP:" + now.UTC().Format(icsUTCLayout),
+		"DTSTART:" + icsTime(start, floating),
+		"DTEND:" + icsTime(end, floating),
+		"SUMMARY:" + icsEscape(shift.Name),
+		"URL:" + shiftURL + shift.ID,
+		"STATUS:CONFIRMED",
+	}
+
+	if !shift.Updated.IsZero() {
+		event = append(event, "LAST-MODIFIED:"+shift.Updated.UTC().Format(icsUTCLayout))
+	}
+
+	return append(event, "END:VEVENT"), nil
+}
+
+func icsTime(t time.Time, floating bool) string {
+	if floating {
+		return t.Format(icsTimeLayout)
+	}
+
+	return t.UTC().Format(icsUTCLayout)
+}
+
+// icsEscape escapes the special characters of iCalendar text values.
+func icsEscape(text string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(text)
+}
+
+// icsFold splits content lines longer than 75 octets without breaking UTF-8
+// sequences. Continuation lines start with a space.
+func icsFold(line string) string {
+	var b strings.Builder
+
+	n := 0
+	for _, r := range line {
+		size := len(string(r))
+		if n+size > icsLineLength {
+			b.WriteString("\r\n ")
+			n = 1
+		}
+		b.WriteRune(r)
+		n += size
+	}
+
+	return b.String()
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/edevenport/shiftboard-sdk-go"
+
+	runtime "github.com/aws/aws-lambda-go/lambda"
+	dbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	dbPageCount    = 100
+	paramPath      = "/shiftboard/calendar"
+	usersParamPath = "/shiftboard/users"
+	defaultTenant  = "default"
+	feedExtension  = ".ics"
+	feedMaxAge     = 15 * time.Minute
+	dbIndexName    = "TenantStartDate"
+)
+
+type handler struct {
+	tableName string
+	dbClient  *dynamodb.Client
+	ssmClient *ssm.Client
+	logger    *Logger
+}
+
+// Shift extends the ShiftBoard shift with the organization it belongs to.
+type Shift struct {
+	shiftboard.Shift
+	OrgID string `json:"org_id"`
+}
+
+// Config holds the calendar feed settings of a user.
+type Config struct {
+	Token    string
+	Timezone string
+}
+
+type DynamoDBNewQueryPaginatorAPI interface {
+	HasMorePages() bool
+	NextPage(context.Context, ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error)
+}
+
+type SSMGetParametersByPathAPI interface {
+	GetParametersByPath(ctx context.Context,
+		params *ssm.GetParametersByPathInput,
+		optFns ...func(*ssm.Options)) (*ssm.GetParametersByPathOutput, error)
+}
+
+func GetParametersByPath(ctx context.Context, api SSMGetParametersByPathAPI, path string, withDecryption bool) (*ssm.GetParametersByPathOutput, error) {
+	return api.GetParametersByPath(ctx, &ssm.GetParametersByPathInput{
+		Path:           aws.String(path),
+		WithDecryption: withDecryption,
+	})
+}
+
+// HandleRequest serves the calendar feed of a user at "/<user>.ics?token=<token>"
+// through a Lambda function URL.
+func (h *handler) HandleRequest(ctx context.Context, req events.LambdaFunctionURLRequest) (events.LambdaFunctionURLResponse, error) {
+	method := req.RequestContext.HTTP.Method
+	if method != http.MethodGet && method != http.MethodHead {
+		return response(http.StatusMethodNotAllowed), nil
+	}
+
+	tenant, ok := parseFeedPath(req.RawPath)
+	if !ok {
+		return response(http.StatusNotFound), nil
+	}
+
+	// Feed requests are not part of a retriever run, they are traced by their
+	// request ID
+	ctx = withRun(withLogger(ctx, h.logger), req.RequestContext.RequestID, field("tenant", tenant))
+	logger := loggerFrom(ctx)
+	start := time.Now()
+
+	// Read calendar parameters from SSM Parameter Store
+	params, err := GetParametersByPath(ctx, h.ssmClient, tenantParamPath(tenant), true)
+	if err != nil {
+		logger.Error("error reading from SSM parameter store", errField(err))
+		return response(http.StatusInternalServerError), nil
+	}
+
+	// Unknown users and invalid tokens are not told apart
+	cfg := parseParameters(params)
+	if !validToken(cfg.Token, req.QueryStringParameters["token"]) {
+		logger.Warn("Rejected calendar feed request")
+		return response(http.StatusForbidden), nil
+	}
+
+	p := dynamodb.NewQueryPaginator(h.dbClient, &dynamodb.QueryInput{
+		TableName:              aws.String(h.tableName),
+		IndexName:              aws.String(dbIndexName),
+		Limit:                  aws.Int32(dbPageCount),
+		KeyConditionExpression: aws.String("Tenant = :tenant AND StartDate > :startDate"),
+		ExpressionAttributeValues: map[string]dbtypes.AttributeValue{
+			":tenant":    &dbtypes.AttributeValueMemberS{Value: tenant},
+			":startDate": &dbtypes.AttributeValueMemberS{Value: time.Now().Format("2006-01-02")},
+		},
+	})
+
+	// Read cached shifts from DynamoDB table, ordered by start date
+	shifts, err := queryPages(ctx, p)
+	if err != nil {
+		logger.Error("error reading data from DynamoDB table", errField(err))
+		return response(http.StatusInternalServerError), nil
+	}
+
+	body, err := constructCalendar(ctx, shifts, cfg.Timezone, time.Now())
+	if err != nil {
+		logger.Error("error constructing calendar", errField(err))
+		return response(http.StatusInternalServerError), nil
+	}
+
+	logger.Info("Serving calendar feed", field("stage", "serve"), field("count", len(shifts)), durationField(start))
+
+	resp := response(http.StatusOK)
+	resp.Headers["Content-Type"] = "text/calendar; charset=utf-8"
+	resp.Headers["Cache-Control"] = fmt.Sprintf("private, max-age=%d", int(feedMaxAge.Seconds()))
+	if method == http.MethodGet {
+		resp.Body = body
+	}
+
+	return resp, nil
+}
+
+func queryPages(ctx context.Context, pager DynamoDBNewQueryPaginatorAPI) ([]Shift, error) {
+	var list []Shift
+
+	for pager.HasMorePages() {
+		output, err := pager.NextPage(ctx)
+		if err != nil {
+			return list, err
+		}
+
+		var pItems []Shift
+		err = attributevalue.UnmarshalListOfMaps(output.Items, &pItems)
+		if err != nil {
+			return list, err
+		}
+
+		list = append(list, pItems...)
+	}
+
+	return list, nil
+}
+
+func parseParameters(output *ssm.GetParametersByPathOutput) *Config {
+	cfg := &Config{}
+
+	for _, item := range output.Parameters {
+		switch path.Base(*item.Name) {
+		case "token":
+			cfg.Token = *item.Value
+		case "timezone":
+			cfg.Timezone = *item.Value
+		}
+	}
+
+	return cfg
+}
+
+// parseFeedPath returns the user of a "/<user>.ics" feed path. User IDs are
+// restricted to the characters allowed in SSM parameter names.
+func parseFeedPath(rawPath string) (string, bool) {
+	name := strings.TrimPrefix(rawPath, "/")
+	if !strings.HasSuffix(name, feedExtension) {
+		return "", false
+	}
+
+	user := strings.TrimSuffix(name, feedExtension)
+	if user == "" {
+		return "", false
+	}
+
+	for _, r := range user {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return "", false
+		}
+	}
+
+	return user, true
+}
+
+// validToken compares the tokens in constant time. Feeds without a configured
+// token are never served.
+func validToken(expected string, token string) bool {
+	if expected == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(token)) == 1
+}
+
+// tenantParamPath returns the calendar parameter path of a tenant. The default
+// tenant uses the single user parameter path.
+func tenantParamPath(tenant string) string {
+	if tenant == defaultTenant {
+		return paramPath
+	}
+
+	return usersParamPath + "/" + tenant + "/calendar"
+}
+
+func response(status int) events.LambdaFunctionURLResponse {
+	resp := events.LambdaFunctionURLResponse{
+		StatusCode: status,
+		Headers:    map[string]string{},
+	}
+
+	if status != http.StatusOK {
+		resp.Headers["Content-Type"] = "text/plain; charset=utf-8"
+		resp.Body = http.StatusText(status) + "\n"
+	}
+
+	return resp
+}
+
+func main() {
+	customResolver := aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
+		if os.Getenv("AWS_SAM_LOCAL") == "true" {
+			return aws.Endpoint{
+				PartitionID:   "aws",
+				URL:           "http://host.docker.internal:4566",
+				SigningRegion: os.Getenv("AWS_REGION"),
+			}, nil
+		}
+		return aws.Endpoint{}, &aws.EndpointNotFoundError{}
+	})
+
+	level, err := parseLevel(os.Getenv("LOG_LEVEL"))
+	logger := newLogger(os.Stdout, level).With(field("function", "calendar"))
+	if err != nil {
+		logger.Warn("error parsing LOG_LEVEL, logging at info level", errField(err))
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithEndpointResolverWithOptions(customResolver))
+	if err != nil {
+		logger.Error("error loading default AWS configuration", errField(err))
+		os.Exit(1)
+	}
+
+	h := handler{
+		tableName: os.Getenv("TABLE_NAME"),
+		dbClient:  dynamodb.NewFromConfig(cfg),
+		ssmClient: ssm.NewFromConfig(cfg),
+		logger:    logger,
+	}
+
+	runtime.Start(h.HandleRequest)
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/edevenport/shiftboard-sdk-go"
+
+	dbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+type mockGetParametersByPathAPI func(ctx context.Context, params *ssm.GetParametersByPathInput, optFns ...func(*ssm.Options)) (*ssm.GetParametersByPathOutput, error)
+
+type mockNewQueryPaginatorAPI struct {
+	PageNum int
+	Pages   []*dynamodb.QueryOutput
+}
+
+func (m mockGetParametersByPathAPI) GetParametersByPath(ctx context.Context, params *ssm.GetParametersByPathInput, optFns ...func(*ssm.Options)) (*ssm.GetParametersByPathOutput, error) {
+	return m(ctx, params, optFns...)
+}
+
+func (m *mockNewQueryPaginatorAPI) HasMorePages() bool {
+	return m.PageNum < len(m.Pages)
+}
+
+func (m *mockNewQueryPaginatorAPI) NextPage(ctx context.Context, f ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	if m.PageNum >= len(m.Pages) {
+		return nil, fmt.Errorf("no more pages")
+	}
+
+	output := m.Pages[m.PageNum]
+	m.PageNum++
+	return output, nil
+}
+
+func TestGetParametersByPath(t *testing.T) {
+	client := mockGetParametersByPathAPI(func(ctx context.Context, params *ssm.GetParametersByPathInput, optFns ...func(*ssm.Options)) (*ssm.GetParametersByPathOutput, error) {
+		if e, a := "/shiftboard/users/alice/calendar", *params.Path; e != a {
+			t.Errorf("expect %v, got %v", e, a)
+		}
+		if !params.WithDecryption {
+			t.Error("expect WithDecryption to be true")
+		}
+
+		return mockParametersOutput(), nil
+	})
+
+	output, err := GetParametersByPath(context.TODO(), client, tenantParamPath("alice"), true)
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+
+	cfg := parseParameters(output)
+	if e, a := "s3cr3t", cfg.Token; e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+	if e, a := "America/Los_Angeles", cfg.Timezone; e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+}
+
+func TestQueryPages(t *testing.T) {
+	pager := &mockNewQueryPaginatorAPI{
+		Pages: []*dynamodb.QueryOutput{
+			{Items: []map[string]dbtypes.AttributeValue{mockAttributeValue(t, "1", "2022-06-15T09:00:00")}},
+			{Items: []map[string]dbtypes.AttributeValue{mockAttributeValue(t, "2", "2022-06-16T09:00:00")}},
+		},
+	}
+
+	shifts, err := queryPages(context.TODO(), pager)
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+
+	ids := []string{}
+	for _, s := range shifts {
+		ids = append(ids, s.ID)
+	}
+	if e, a := "[1 2]", fmt.Sprint(ids); e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+}
+
+func TestParseFeedPath(t *testing.T) {
+	cases := []struct {
+		path   string
+		expect string
+		ok     bool
+	}{
+		{path: "/alice.ics", expect: "alice", ok: true},
+		{path: "/default.ics", expect: "default", ok: true},
+		{path: "/alice", ok: false},
+		{path: "/.ics", ok: false},
+		{path: "/alice/calendar.ics", ok: false},
+		{path: "/alice%2Fcalendar.ics", ok: false},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.path, func(t *testing.T) {
+			user, ok := parseFeedPath(tt.path)
+			if e, a := tt.ok, ok; e != a {
+				t.Fatalf("expect %v, got %v", e, a)
+			}
+			if e, a := tt.expect, user; e != a {
+				t.Errorf("expect %v, got %v", e, a)
+			}
+		})
+	}
+}
+
+func TestValidToken(t *testing.T) {
+	cases := []struct {
+		description string
+		expected    string
+		token       string
+		expect      bool
+	}{
+		{description: "valid", expected: "s3cr3t", token: "s3cr3t", expect: true},
+		{description: "invalid", expected: "s3cr3t", token: "secret", expect: false},
+		{description: "missing", expected: "s3cr3t", token: "", expect: false},
+		{description: "notConfigured", expected: "", token: "", expect: false},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.description, func(t *testing.T) {
+			if e, a := tt.expect, validToken(tt.expected, tt.token); e != a {
+				t.Errorf("expect %v, got %v", e, a)
+			}
+		})
+	}
+}
+
+func TestTenantParamPath(t *testing.T) {
+	if e, a := "/shiftboard/calendar", tenantParamPath("default"); e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+	if e, a := "/shiftboard/users/alice/calendar", tenantParamPath("alice"); e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+}
+
+func TestConstructCalendar(t *testing.T) {
+	now, _ := time.Parse(time.RFC3339, "2022-06-01T12:00:00Z")
+	updated, _ := time.Parse(time.RFC3339, "2022-05-11T12:00:00Z")
+
+	shifts := []Shift{
+		{Shift: shiftboard.Shift{ID: "1", Name: "Setup, teardown", StartDate: "2022-06-15T22:00:00", EndDate: "2022-06-15T06:00:00", Updated: updated}},
+		{Shift: shiftboard.Shift{ID: "2", Name: "Invalid", StartDate: "Wed Jun 15", EndDate: "Wed Jun 15"}},
+	}
+
+	cases := []struct {
+		description string
+		timezone    string
+		expect      []string
+	}{
+		{
+			description: "floating",
+			expect: []string{
+				"METHOD:PUBLISH",
+				"UID:1@shiftboard-bot",
+				fmt.Sprintf("SEQUENCE:%d", updated.Unix()),
+				"DTSTAMP:20220601T120000Z",
+				"DTSTART:20220615T220000",
+				"DTEND:20220616T060000",
+				`SUMMARY:Setup\, teardown`,
+				"LAST-MODIFIED:20220511T120000Z",
+			},
+		},
+		{
+			description: "timezone",
+			timezone:    "America/Los_Angeles",
+			expect: []string{
+				"DTSTART:20220616T050000Z",
+				"DTEND:20220616T130000Z",
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.description, func(t *testing.T) {
+			ics, err := constructCalendar(context.TODO(), shifts, tt.timezone, now)
+			if err != nil {
+				t.Fatalf("expect no error, got %v", err)
+			}
+
+			for _, line := range tt.expect {
+				if !strings.Contains(ics, line+"\r\n") {
+					t.Errorf("expect calendar to contain %q, got %v", line, ics)
+				}
+			}
+
+			if e, a := 1, strings.Count(ics, "BEGIN:VEVENT"); e != a {
+				t.Errorf("expect %v events, got %v", e, a)
+			}
+		})
+	}
+
+	if _, err := constructCalendar(context.TODO(), shifts, "Invalid/Zone", now); err == nil {
+		t.Error("expect error for invalid time zone")
+	}
+}
+
+func TestICSFold(t *testing.T) {
+	line := "SUMMARY:" + strings.Repeat("é", 50)
+
+	folded := icsFold(line)
+	for _, l := range strings.Split(folded, "\r\n") {
+		if len(l) > icsLineLength {
+			t.Errorf("expect line of at most %d octets, got %d", icsLineLength, len(l))
+		}
+		if !utf8.ValidString(l) {
+			t.Errorf("expect valid UTF-8, got %q", l)
+		}
+	}
+
+	if e, a := line, strings.ReplaceAll(folded, "\r\n ", ""); e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+}
+
+func mockParametersOutput() *ssm.GetParametersByPathOutput {
+	return &ssm.GetParametersByPathOutput{
+		Parameters: []types.Parameter{
+			{Name: aws.String("/shiftboard/users/alice/calendar/token"), Value: aws.String("s3cr3t")},
+			{Name: aws.String("/shiftboard/users/alice/calendar/timezone"), Value: aws.String("America/Los_Angeles")},
+		},
+	}
+}
+
+func mockAttributeValue(t *testing.T, id string, startDate string) map[string]dbtypes.AttributeValue {
+	av, err := attributevalue.MarshalMap(struct {
+		Shift
+		Tenant string
+		Key    string
+	}{
+		Shift:  Shift{Shift: shiftboard.Shift{ID: id, Name: "Shift " + id, StartDate: startDate}, OrgID: "1001"},
+		Tenant: "alice",
+		Key:    "alice#1001#" + id,
+	})
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+
+	return av
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := newLogger(&buf, LevelInfo).With(field("function", "test"))
+
+	logger.Debug("not logged")
+	logger.Info("Sent message to jane.doe@example.com",
+		field("password", "password123"),
+		field("accessToken", "eyJhbGciOi"),
+		field("recipients", []string{"john.doe@example.com"}),
+		field("phoneNumber", "+15555550100"),
+		field("webhookURL", "https://hooks.slack.com/services/T000/B000/XXXX"),
+		field("count", 2),
+		errField(errors.New(`Post "https://hooks.slack.com/services/T000/B000/XXXX": error sending to john.doe@example.com`)))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if e, a := 1, len(lines); e != a {
+		t.Fatalf("expect %v lines, got %v: %s", e, a, buf.String())
+	}
+
+	for _, secret := range []string{"password123", "eyJhbGciOi", "jane.doe", "john.doe", "5555550100", "T000", "not logged"} {
+		if strings.Contains(buf.String(), secret) {
+			t.Errorf("expect %q to be redacted, got %s", secret, buf.String())
+		}
+	}
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("expect JSON log entry, got %v", err)
+	}
+
+	expect := map[string]interface{}{
+		"level":       "info",
+		"msg":         "Sent message to j***@example.com",
+		"function":    "test",
+		"password":    redacted,
+		"phoneNumber": "***00",
+		"webhookURL":  "https://hooks.slack.com/" + redacted,
+		"count":       float64(2),
+		"error":       `Post "https://hooks.slack.com/` + redacted + `": error sending to j***@example.com`,
+	}
+	for k, e := range expect {
+		if a := entry[k]; e != a {
+			t.Errorf("expect %s %v, got %v", k, e, a)
+		}
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	cases := []struct {
+		value     string
+		expect    Level
+		expectErr bool
+	}{
+		{value: "", expect: LevelInfo},
+		{value: "DEBUG", expect: LevelDebug},
+		{value: "warn", expect: LevelWarn},
+		{value: "error", expect: LevelError},
+		{value: "verbose", expect: LevelInfo, expectErr: true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.value, func(t *testing.T) {
+			level, err := parseLevel(tt.value)
+			if e, a := tt.expectErr, err != nil; e != a {
+				t.Errorf("expect error %v, got %v", e, err)
+			}
+			if e, a := tt.expect, level; e != a {
+				t.Errorf("expect %v, got %v", e, a)
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+
+	// Embed the time zone database, the Lambda runtime may not provide one
+	_ "time/tzdata"
+)
+
+const (
+	icsProdID     = "-//shiftboard-bot//Shift Notifications//EN"
+	icsUIDDomain  = "shiftboard-bot"
+	icsDateLayout = "2006-01-02T15:04:05"
+	icsLineLength = 75
+)
+
+// Invite is an iCalendar VEVENT of a shift, sent as a calendar invite with the
+// email message.
+type Invite struct {
+	Method    string
+	UID       string
+	Sequence  int64
+	Summary   string
+	URL       string
+	Start     time.Time
+	End       time.Time
+	Floating  bool
+	Organizer string
+	Attendees []string
+}
+
+// newInvite returns the calendar invite of a shift change. Created and updated
+// shifts are sent as requests and removed shifts as cancellations of the same
+// UID. Shift times are converted from the time zone to UTC, or left floating
+// in the recipient's time zone when no time zone is configured.
+func newInvite(item *Diff, sender string, recipients []string, timezone string) (*Invite, error) {
+	loc := time.UTC
+	if timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(timezone); err != nil {
+			return nil, fmt.Errorf("invalid time zone '%s': %v", timezone, err)
+		}
+	}
+
+	start, err := time.ParseInLocation(icsDateLayout, item.Shift.StartDate, loc)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing shift start date: %v", err)
+	}
+
+	end, err := time.ParseInLocation(icsDateLayout, item.Shift.EndDate, loc)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing shift end date: %v", err)
+	}
+
+	// Shifts ending at or before their start time end on the next day
+	if !end.After(start) {
+		end = end.AddDate(0, 0, 1)
+	}
+
+	invite := &Invite{
+		Method:    "REQUEST",
+		UID:       item.Shift.ID + "@" + icsUIDDomain,
+		Summary:   item.Shift.Name,
+		URL:       shiftURL + item.Shift.ID,
+		Start:     start,
+		End:       end,
+		Floating:  timezone == "",
+		Organizer: emailAddress(sender),
+	}
+
+	for _, r := range recipients {
+		invite.Attendees = append(invite.Attendees, emailAddress(r))
+	}
+
+	// Calendar clients only apply changes with a higher sequence number, so it
+	// follows the time the shift was last updated in ShiftBoard.
+	invite.Sequence = item.Shift.Updated.Unix()
+	if invite.Sequence < 0 {
+		invite.Sequence = 0
+	}
+
+	if item.State == "removed" {
+		invite.Method = "CANCEL"
+		invite.Sequence = time.Now().Unix()
+	}
+
+	return invite, nil
+}
+
+// ICS returns the invite as an iCalendar object with CRLF line endings.
+func (i *Invite) ICS() []byte {
+	var buf bytes.Buffer
+
+	status := "CONFIRMED"
+	if i.Method == "CANCEL" {
+		status = "CANCELLED"
+	}
+
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:" + icsProdID,
+		"CALSCALE:GREGORIAN",
+		"METHOD:" + i.Method,
+		"BEGIN:VEVENT",
+		"UID:" + i.UID,
+		fmt.Sprintf("SEQUENCE:%d", i.Sequence),
+		"DTSTAMP:" + icsTime(time.Now(), false),
+		"DTSTART:" + icsTime(i.Start, i.Floating),
+		"DTEND:" + icsTime(i.End, i.Floating),
+		"SUMMARY:" + icsEscape(i.Summary),
+		"URL:" + i.URL,
+		"STATUS:" + status,
+		"ORGANIZER:mailto:" + i.Organizer,
+	}
+
+	for _, a := range i.Attendees {
+		lines = append(lines, "ATTENDEE;ROLE=REQ-PARTICIPANT:mailto:"+a)
+	}
+
+	lines = append(lines, "END:VEVENT", "END:VCALENDAR")
+
+	for _, line := range lines {
+		buf.WriteString(icsFold(line))
+		buf.WriteString("\r\n")
+	}
+
+	return buf.Bytes()
+}
+
+func icsTime(t time.Time, floating bool) string {
+	if floating {
+		return t.Format("20060102T150405")
+	}
+
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// icsEscape escapes the special characters of iCalendar text values.
+func icsEscape(text string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(text)
+}
+
+// icsFold splits content lines longer than 75 octets without breaking UTF-8
+// sequences. Continuation lines start with a space.
+func icsFold(line string) string {
+	var b strings.Builder
+
+	n := 0
+	for _, r := range line {
+		size := len(string(r))
+		if n+size > icsLineLength {
+			b.WriteString("\r\n ")
+			n = 1
+		}
+		b.WriteRune(r)
+		n += size
+	}
+
+	return b.String()
+}
+
+// emailAddress returns the address of a "Name <address>" string.
+func emailAddress(address string) string {
+	if addr, err := mail.ParseAddress(address); err == nil {
+		return addr.Address
+	}
+
+	return strings.TrimSpace(address)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const redacted = "[REDACTED]"
+
+// Level is the severity of a log entry.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return "info"
+}
+
+// parseLevel parses a LOG_LEVEL value, which defaults to info when empty.
+func parseLevel(s string) (Level, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "debug":
+		return LevelDebug, nil
+	case "", "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log level '%s'", s)
+}
+
+// Field is a key-value pair of a log entry.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+func field(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// durationField returns the time elapsed since start in milliseconds.
+func durationField(start time.Time) Field {
+	return Field{Key: "durationMs", Value: time.Since(start).Milliseconds()}
+}
+
+func errField(err error) Field {
+	if err == nil {
+		return Field{Key: "error", Value: nil}
+	}
+	return Field{Key: "error", Value: err.Error()}
+}
+
+// Logger writes log entries as JSON lines. Values are redacted by their key
+// before they are written, so credentials, tokens and contact details of
+// users do not end up in the logs.
+type Logger struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	level  Level
+	fields []Field
+	email  *regexp.Regexp
+	url    *regexp.Regexp
+}
+
+func newLogger(out io.Writer, level Level) *Logger {
+	return &Logger{
+		mu:    &sync.Mutex{},
+		out:   out,
+		level: level,
+		email: regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`),
+		url:   regexp.MustCompile(`https?://[^\s"'<>]+`),
+	}
+}
+
+// With returns a logger which adds the fields to every entry.
+func (l *Logger) With(fields ...Field) *Logger {
+	child := *l
+	child.fields = append(append([]Field{}, l.fields...), fields...)
+	return &child
+}
+
+func (l *Logger) Debug(msg string, fields ...Field) {
+	l.log(LevelDebug, msg, fields)
+}
+
+func (l *Logger) Info(msg string, fields ...Field) {
+	l.log(LevelInfo, msg, fields)
+}
+
+func (l *Logger) Warn(msg string, fields ...Field) {
+	l.log(LevelWarn, msg, fields)
+}
+
+func (l *Logger) Error(msg string, fields ...Field) {
+	l.log(LevelError, msg, fields)
+}
+
+func (l *Logger) log(level Level, msg string, fields []Field) {
+	if level < l.level {
+		return
+	}
+
+	entry := map[string]interface{}{}
+	for _, f := range append(append([]Field{}, l.fields...), fields...) {
+		entry[f.Key] = l.redact(f.Key, f.Value)
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = level.String()
+	entry["msg"] = l.redactString(msg)
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		b, _ = json.Marshal(map[string]string{"level": LevelError.String(), "msg": "error marshalling log entry: " + err.Error()})
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintln(l.out, string(b))
+}
+
+// redact returns the value to log for a field. Secrets are removed, email
+// addresses and phone numbers are masked and URLs are reduced to their host,
+// since webhook URLs embed their credentials.
+func (l *Logger) redact(key string, value interface{}) interface{} {
+	k := strings.ToLower(key)
+
+	switch {
+	case strings.Contains(k, "password"), strings.Contains(k, "secret"),
+		strings.Contains(k, "token"), strings.Contains(k, "authorization"),
+		strings.Contains(k, "cookie"):
+		return redacted
+	case strings.Contains(k, "phone"):
+		return maskPhone(fmt.Sprint(value))
+	case strings.Contains(k, "url"), strings.Contains(k, "webhook"):
+		return maskURL(fmt.Sprint(value))
+	}
+
+	switch v := value.(type) {
+	case string:
+		return l.redactString(v)
+	case []string:
+		masked := make([]string, len(v))
+		for i, s := range v {
+			masked[i] = l.redactString(s)
+		}
+		return masked
+	case fmt.Stringer:
+		return l.redactString(v.String())
+	}
+
+	return value
+}
+
+// redactString masks every URL and email address in free text such as
+// messages and errors, which HTTP clients include request URLs in.
+func (l *Logger) redactString(s string) string {
+	s = l.url.ReplaceAllStringFunc(s, maskURL)
+	return l.email.ReplaceAllStringFunc(s, maskEmail)
+}
+
+// maskEmail keeps the first character of the local part and the domain, e.g.
+// "j***@example.com".
+func maskEmail(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 1 {
+		return redacted
+	}
+	return email[:1] + "***" + email[at:]
+}
+
+// maskPhone keeps the last two digits of a phone number.
+func maskPhone(phone string) string {
+	if len(phone) <= 2 {
+		return redacted
+	}
+	return "***" + phone[len(phone)-2:]
+}
+
+func maskURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return redacted
+	}
+	return u.Scheme + "://" + u.Host + "/" + redacted
+}
+
+type loggerKey struct{}
+
+type runIDKey struct{}
+
+// withLogger returns a context carrying the logger of the invocation.
+func withLogger(ctx context.Context, logger *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// loggerFrom returns the logger of the invocation, or a logger at the info
+// level if the context has none.
+func loggerFrom(ctx context.Context) *Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*Logger); ok && logger != nil {
+		return logger
+	}
+	return newLogger(os.Stdout, LevelInfo)
+}
+
+// withRun returns a context carrying the run ID, whose logger adds the run ID
+// and the fields to every entry. The run ID is generated by the retriever and
+// passed on with the payload and every change, so a run can be traced across
+// the functions.
+func withRun(ctx context.Context, runID string, fields ...Field) context.Context {
+	ctx = context.WithValue(ctx, runIDKey{}, runID)
+	return withLogger(ctx, loggerFrom(ctx).With(append([]Field{field("runId", runID)}, fields...)...))
+}
+
+// runIDFrom returns the run ID of the context, or an empty string if it has
+// none.
+func runIDFrom(ctx context.Context) string {
+	runID, _ := ctx.Value(runIDKey{}).(string)
+	return runID
+}
@@ -2,34 +2,78 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
 	"os"
+	"path"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/ses"
 	"github.com/aws/aws-sdk-go-v2/service/ses/types"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	"github.com/edevenport/shiftboard-sdk-go"
 
+	"github.com/aws/aws-lambda-go/events"
 	runtime "github.com/aws/aws-lambda-go/lambda"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
 )
 
 const (
-	charSet   = "UTF-8"
-	paramPath = "/shiftboard/notifications"
+	charSet        = "UTF-8"
+	httpTimeout    = 5 * time.Second
+	paramPath      = "/shiftboard/notifications"
+	usersParamPath = "/shiftboard/users"
+	defaultTenant  = "default"
+	// Time left to report failed notifications and return before Lambda
+	// times out the function
+	deadlineMargin = time.Second
 )
 
 type handler struct {
-	sesClient *ses.Client
-	ssmClient *ssm.Client
+	templates   *templateCache
+	httpClient  *http.Client
+	sesClient   *ses.Client
+	snsClient   *sns.Client
+	ssmClient   *ssm.Client
+	dbClient    DynamoDBOutboxAPI
+	outboxTable string
+	logger      *Logger
 }
 
 type Diff struct {
-	State string
-	Shift shiftboard.Shift
+	Tenant  string
+	State   string
+	Shift   shiftboard.Shift
+	Changes []Change
+	// RunID identifies the retriever run which found the change
+	RunID string `json:",omitempty"`
+	// OutboxID identifies the worker's outbox entry of the change, if any
+	OutboxID string `json:",omitempty"`
+}
+
+type Change struct {
+	Field string
+	Old   string
+	New   string
+}
+
+// Config holds the notification destinations of a tenant.
+type Config struct {
+	Sender        string
+	Recipient     string
+	Timezone      string
+	SlackWebhooks []string
+	PhoneNumbers  []string
+	Webhooks      []string
+	WebhookSecret string
 }
 
 type Message struct {
@@ -38,10 +82,16 @@ type Message struct {
 	TextBody string `json:"textBody,omitempty"`
 }
 
-type SESSendEmailAPI interface {
-	SendEmail(ctx context.Context,
-		params *ses.SendEmailInput,
-		optFns ...func(*ses.Options)) (*ses.SendEmailOutput, error)
+type SESSendRawEmailAPI interface {
+	SendRawEmail(ctx context.Context,
+		params *ses.SendRawEmailInput,
+		optFns ...func(*ses.Options)) (*ses.SendRawEmailOutput, error)
+}
+
+type SNSPublishAPI interface {
+	Publish(ctx context.Context,
+		params *sns.PublishInput,
+		optFns ...func(*sns.Options)) (*sns.PublishOutput, error)
 }
 
 type SSMGetParametersByPathAPI interface {
@@ -50,29 +100,26 @@ type SSMGetParametersByPathAPI interface {
 		optFns ...func(*ssm.Options)) (*ssm.GetParametersByPathOutput, error)
 }
 
-func SendEmail(ctx context.Context, api SESSendEmailAPI, sender string, recipient string, msg Message) (*ses.SendEmailOutput, error) {
-	return api.SendEmail(ctx, &ses.SendEmailInput{
-		Destination: &types.Destination{
-			CcAddresses: []string{},
-			ToAddresses: strings.Split(recipient, ","),
+func SendRawEmail(ctx context.Context, api SESSendRawEmailAPI, sender string, recipients []string, data []byte) (*ses.SendRawEmailOutput, error) {
+	return api.SendRawEmail(ctx, &ses.SendRawEmailInput{
+		Destinations: recipients,
+		RawMessage: &types.RawMessage{
+			Data: data,
 		},
-		Message: &types.Message{
-			Body: &types.Body{
-				Html: &types.Content{
-					Charset: aws.String(charSet),
-					Data:    aws.String(msg.HtmlBody),
-				},
-				Text: &types.Content{
-					Charset: aws.String(charSet),
-					Data:    aws.String(msg.TextBody),
-				},
-			},
-			Subject: &types.Content{
-				Charset: aws.String(charSet),
-				Data:    aws.String(msg.Subject),
+		Source: aws.String(sender),
+	})
+}
+
+func Publish(ctx context.Context, api SNSPublishAPI, phoneNumber string, message string) (*sns.PublishOutput, error) {
+	return api.Publish(ctx, &sns.PublishInput{
+		Message: aws.String(message),
+		MessageAttributes: map[string]snstypes.MessageAttributeValue{
+			"AWS.SNS.SMS.SMSType": {
+				DataType:    aws.String("String"),
+				StringValue: aws.String("Transactional"),
 			},
 		},
-		Source: aws.String(sender),
+		PhoneNumber: aws.String(phoneNumber),
 	})
 }
 
@@ -83,60 +130,215 @@ func GetParametersByPath(ctx context.Context, api SSMGetParametersByPathAPI, pat
 	})
 }
 
-func (h *handler) HandleRequest(ctx context.Context, payload Diff) (string, error) {
+// HandleRequest notifies the shift changes of a batch of SQS messages. Failed
+// messages are reported so that only they are received again, and moved to
+// the dead-letter queue once they exceed the queue's maximum receive count.
+func (h *handler) HandleRequest(ctx context.Context, event events.SQSEvent) (events.SQSEventResponse, error) {
+	ctx, cancel := withDeadlineMargin(ctx, deadlineMargin)
+	defer cancel()
+	ctx = withLogger(ctx, h.logger)
+
+	response := events.SQSEventResponse{BatchItemFailures: []events.SQSBatchItemFailure{}}
+
+	for _, record := range event.Records {
+		if err := h.handleMessage(ctx, record); err != nil {
+			response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: record.MessageId})
+		}
+	}
+
+	return response, nil
+}
+
+// handleMessage sends the change of a message and logs its failure with the
+// run the change belongs to.
+func (h *handler) handleMessage(ctx context.Context, record events.SQSMessage) error {
+	ctx = withLogger(ctx, loggerFrom(ctx).With(field("messageId", record.MessageId)))
+
+	var payload Diff
+	if err := json.Unmarshal([]byte(record.Body), &payload); err != nil {
+		loggerFrom(ctx).Error("error unmarshalling message", errField(err))
+		return err
+	}
+
+	// Changes sent without a run ID are traced by their message ID
+	runID := payload.RunID
+	if runID == "" {
+		runID = record.MessageId
+	}
+	ctx = withRun(ctx, runID, field("tenant", payload.Tenant), field("shiftId", payload.Shift.ID), field("outboxId", payload.OutboxID))
+
+	if err := h.processDiff(ctx, payload); err != nil {
+		loggerFrom(ctx).Error("error processing message", errField(err))
+		return err
+	}
+
+	return nil
+}
+
+// processDiff sends the shift change to every recipient of the tenant.
+func (h *handler) processDiff(ctx context.Context, payload Diff) error {
 	// Read notification parameters from SSM Parameter Store
-	params, err := GetParametersByPath(context.TODO(), h.ssmClient, paramPath, false)
+	params, err := GetParametersByPath(ctx, h.ssmClient, tenantParamPath(payload.Tenant), true)
 	if err != nil {
-		return "", fmt.Errorf("error reading from SSM parameter store: %v", err)
+		return fmt.Errorf("error reading from SSM parameter store: %v", err)
 	}
 
-	// Extract sender and recipient from parameters
-	sender, recipient, err := parseParameters(params)
+	// Extract sender and recipients from parameters
+	cfg, err := parseParameters(params)
 	if err != nil {
-		return "", fmt.Errorf("error parsing parameters: %v", err)
+		return fmt.Errorf("error parsing parameters: %v", err)
 	}
 
-	// Construct email template
-	msg := constructMessage(&payload)
+	notifiers := h.newNotifiers(cfg, h.templates.Get(ctx))
+	if len(notifiers) == 0 {
+		return errors.New("no notification recipients configured")
+	}
 
-	// Send email to recipients
-	output, err := SendEmail(context.TODO(), h.sesClient, sender, recipient, msg)
-	if err != nil {
-		return "", fmt.Errorf("error sending SES notification: %v", err)
+	// Changes dispatched from the outbox skip the notifiers which already sent
+	// them, so a retried or duplicate invocation does not notify twice
+	var entry *OutboxEntry
+	if payload.OutboxID != "" && h.outboxTable != "" {
+		entry, err = getOutboxEntry(ctx, h.dbClient, h.outboxTable, payload.Tenant, payload.OutboxID)
+		if err != nil {
+			return fmt.Errorf("error reading outbox entry: %v", err)
+		}
+		if entry != nil && entry.Status == outboxSent {
+			loggerFrom(ctx).Info("Skipping already sent change")
+			return nil
+		}
+	}
+
+	if err := h.notify(ctx, &payload, notifiers, entry); err != nil {
+		return err
+	}
+
+	if entry != nil {
+		if err := markSent(ctx, h.dbClient, h.outboxTable, entry.Tenant, entry.ID); err != nil {
+			return fmt.Errorf("error completing outbox entry: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// notify sends the change with every notifier not yet recorded in the outbox
+// entry, which may be nil, and records the notifiers which succeed.
+func (h *handler) notify(ctx context.Context, payload *Diff, notifiers []Notifier, entry *OutboxEntry) error {
+	sent := map[string]bool{}
+	if entry != nil {
+		for _, id := range entry.SentChannels {
+			sent[id] = true
+		}
 	}
 
-	fmt.Println("Message ID:", *output.MessageId)
-	fmt.Println("Email sent to " + recipient)
+	// Notify every recipient even if one of the channels fails
+	logger := loggerFrom(ctx)
+	failed := 0
+	for i, n := range notifiers {
+		// Notifiers not called yet are called when the change is redelivered
+		if ctx.Err() != nil {
+			logger.Warn("Deadline reached before sending every notification", field("remaining", len(notifiers)-i))
+			failed += len(notifiers) - i
+			break
+		}
+
+		id := deliveryID(n)
+		if sent[id] {
+			logger.Info("Skipping notification already sent", field("channel", n.Channel()))
+			continue
+		}
+
+		start := time.Now()
+		if err := n.Notify(ctx, payload); err != nil {
+			logger.Error("error sending notification", field("stage", "notify"), field("channel", n.Channel()), errField(err), durationField(start))
+			failed++
+			continue
+		}
 
-	return "Success", nil
+		logger.Info("Sent notification", field("stage", "notify"), field("channel", n.Channel()), durationField(start))
+
+		if entry != nil {
+			if err := markDelivered(ctx, h.dbClient, h.outboxTable, entry.Tenant, entry.ID, id); err != nil {
+				logger.Error("error recording notification", field("channel", n.Channel()), errField(err))
+				failed++
+			}
+		}
+	}
+
+	if failed != 0 {
+		return fmt.Errorf("error sending %d of %d notifications", failed, len(notifiers))
+	}
+
+	return nil
 }
 
-func parseParameters(output *ssm.GetParametersByPathOutput) (sender string, recipient string, err error) {
+func parseParameters(output *ssm.GetParametersByPathOutput) (*Config, error) {
 	if len(output.Parameters) == 0 {
-		return "", "", errors.New("no parameters returned from SSM parameter store")
+		return nil, errors.New("no parameters returned from SSM parameter store")
 	}
 
+	cfg := &Config{}
 	for _, item := range output.Parameters {
-		switch strings.Split(*item.Name, "/")[3] {
+		switch path.Base(*item.Name) {
 		case "sender":
-			sender = *item.Value
+			cfg.Sender = *item.Value
 		case "recipient":
-			recipient = *item.Value
+			cfg.Recipient = *item.Value
+		case "timezone":
+			cfg.Timezone = *item.Value
+		case "slack_webhook":
+			cfg.SlackWebhooks = splitList(*item.Value)
+		case "phone":
+			cfg.PhoneNumbers = splitList(*item.Value)
+		case "webhook":
+			cfg.Webhooks = splitList(*item.Value)
+		case "webhook_secret":
+			cfg.WebhookSecret = *item.Value
 		}
 	}
 
-	return sender, recipient, nil
+	return cfg, nil
 }
 
-func constructMessage(item *Diff) (msg Message) {
-	shift := item.Shift
-	tmpl := generateTemplate(item.State)
+// splitList splits a comma separated list, ignoring empty entries.
+func splitList(list string) []string {
+	items := []string{}
+
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
 
-	msg.Subject = fmt.Sprintf(tmpl.Subject, shift.Name)
-	msg.TextBody = fmt.Sprintf(tmpl.TextBody, shift.Name, shift.DisplayDate, shift.DisplayTime, shift.ID)
-	msg.HtmlBody = fmt.Sprintf(tmpl.HtmlBody, shift.ID, shift.Name, shift.DisplayDate, shift.DisplayTime)
+// tenantParamPath returns the notification parameter path of a tenant. The
+// default tenant uses the original single user parameter path.
+func tenantParamPath(tenant string) string {
+	if tenant == "" || tenant == defaultTenant {
+		return paramPath
+	}
 
-	return msg
+	return usersParamPath + "/" + tenant + "/notifications"
+}
+
+// withDeadlineMargin returns a context which is done the margin before the
+// deadline of the invocation, so there is time left to return an error.
+func withDeadlineMargin(ctx context.Context, margin time.Duration) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithDeadline(ctx, deadline.Add(-margin))
+}
+
+func getEnv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return fallback
 }
 
 func main() {
@@ -151,16 +353,50 @@ func main() {
 		return aws.Endpoint{}, &aws.EndpointNotFoundError{}
 	})
 
+	level, err := parseLevel(os.Getenv("LOG_LEVEL"))
+	logger := newLogger(os.Stdout, level).With(field("function", "notification"))
+	if err != nil {
+		logger.Warn("error parsing LOG_LEVEL, logging at info level", errField(err))
+	}
+
 	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithEndpointResolverWithOptions(customResolver))
 	if err != nil {
-		fmt.Printf("error loading default AWS configuration: %v\n", err)
+		logger.Error("error loading default AWS configuration", errField(err))
+		os.Exit(1)
+	}
+
+	builtin, err := parseTemplates(builtinTemplates())
+	if err != nil {
+		logger.Error("error parsing message templates", errField(err))
+		os.Exit(1)
+	}
+
+	ttl, err := time.ParseDuration(getEnv("TEMPLATE_CACHE_TTL", defaultTemplateCacheTTL.String()))
+	if err != nil {
+		logger.Error("error parsing TEMPLATE_CACHE_TTL", errField(err))
+		os.Exit(1)
+	}
+
+	ssmClient := ssm.NewFromConfig(cfg)
+	load, err := newTemplateLoader(os.Getenv("TEMPLATE_SOURCE"), s3.NewFromConfig(cfg), ssmClient)
+	if err != nil {
+		logger.Error("error configuring message templates", errField(err))
 		os.Exit(1)
 	}
 
 	h := handler{
-		sesClient: ses.NewFromConfig(cfg),
-		ssmClient: ssm.NewFromConfig(cfg),
+		templates:   newTemplateCache(builtin, load, ttl),
+		httpClient:  &http.Client{Timeout: httpTimeout},
+		sesClient:   ses.NewFromConfig(cfg),
+		snsClient:   sns.NewFromConfig(cfg),
+		ssmClient:   ssmClient,
+		dbClient:    dynamodb.NewFromConfig(cfg),
+		outboxTable: os.Getenv("OUTBOX_TABLE"),
+		logger:      logger,
 	}
 
+	// Load the templates at cold start instead of on the first notification
+	h.templates.Get(withLogger(context.TODO(), logger))
+
 	runtime.Start(h.HandleRequest)
 }
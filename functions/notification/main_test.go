@@ -1,20 +1,38 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"math/rand"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
 	"strconv"
 	"strings"
 	"testing"
 	"time"
+	"unicode/utf8"
 
+	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/ses"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
 	"github.com/aws/smithy-go/middleware"
 	"github.com/edevenport/shiftboard-sdk-go"
+
+	dbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
 const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
@@ -25,16 +43,63 @@ type MockItem struct {
 
 type mockGetParametersByPathAPI func(ctx context.Context, params *ssm.GetParametersByPathInput, optFns ...func(*ssm.Options)) (*ssm.GetParametersByPathOutput, error)
 
-type mockSendEmailAPI func(ctx context.Context, params *ses.SendEmailInput, optFns ...func(*ses.Options)) (*ses.SendEmailOutput, error)
+type mockPublishAPI func(ctx context.Context, params *sns.PublishInput, optFns ...func(*sns.Options)) (*sns.PublishOutput, error)
+
+type mockGetObjectAPI func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+
+type mockOutboxAPI struct {
+	items   map[string]map[string]dbtypes.AttributeValue
+	updates []*dynamodb.UpdateItemInput
+}
+
+type mockNotifier struct {
+	channel     string
+	destination string
+	err         error
+	calls       int
+}
+
+type mockSendRawEmailAPI func(ctx context.Context, params *ses.SendRawEmailInput, optFns ...func(*ses.Options)) (*ses.SendRawEmailOutput, error)
 
 func (m mockGetParametersByPathAPI) GetParametersByPath(ctx context.Context, params *ssm.GetParametersByPathInput, optFns ...func(*ssm.Options)) (*ssm.GetParametersByPathOutput, error) {
 	return m(ctx, params, optFns...)
 }
 
-func (m mockSendEmailAPI) SendEmail(ctx context.Context, params *ses.SendEmailInput, optFns ...func(*ses.Options)) (*ses.SendEmailOutput, error) {
+func (m mockPublishAPI) Publish(ctx context.Context, params *sns.PublishInput, optFns ...func(*sns.Options)) (*sns.PublishOutput, error) {
+	return m(ctx, params, optFns...)
+}
+
+func (m mockGetObjectAPI) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	return m(ctx, params, optFns...)
+}
+
+func (m mockSendRawEmailAPI) SendRawEmail(ctx context.Context, params *ses.SendRawEmailInput, optFns ...func(*ses.Options)) (*ses.SendRawEmailOutput, error) {
 	return m(ctx, params, optFns...)
 }
 
+func (m *mockOutboxAPI) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	id := params.Key["ID"].(*dbtypes.AttributeValueMemberS).Value
+	return &dynamodb.GetItemOutput{Item: m.items[id]}, nil
+}
+
+func (m *mockOutboxAPI) UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	m.updates = append(m.updates, params)
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func (m *mockNotifier) Channel() string {
+	return m.channel
+}
+
+func (m *mockNotifier) Destination() string {
+	return m.destination
+}
+
+func (m *mockNotifier) Notify(ctx context.Context, item *Diff) error {
+	m.calls++
+	return m.err
+}
+
 func TestGetParametersByPath(t *testing.T) {
 	cases := []struct {
 		client         func(t *testing.T) SSMGetParametersByPathAPI
@@ -85,11 +150,46 @@ func TestGetParametersByPath(t *testing.T) {
 	}
 }
 
+func TestTenantParamPath(t *testing.T) {
+	cases := []struct {
+		description string
+		tenant      string
+		expect      string
+	}{
+		{
+			description: "emptyTenant",
+			tenant:      "",
+			expect:      "/shiftboard/notifications",
+		},
+		{
+			description: "defaultTenant",
+			tenant:      "default",
+			expect:      "/shiftboard/notifications",
+		},
+		{
+			description: "userTenant",
+			tenant:      "alice",
+			expect:      "/shiftboard/users/alice/notifications",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.description, func(t *testing.T) {
+			if e, a := tt.expect, tenantParamPath(tt.tenant); e != a {
+				t.Errorf("expect %v, got %v", e, a)
+			}
+		})
+	}
+}
+
 func TestConstructMessage(t *testing.T) {
+	templates := mockTemplates(t)
+
 	cases := []struct {
 		description string
 		item        Diff
 		expect      string
+		expectErr   bool
 	}{
 		{
 			description: "newMessage",
@@ -101,41 +201,324 @@ func TestConstructMessage(t *testing.T) {
 			item:        Diff{State: "updated", Shift: mockShift()},
 			expect:      "Shift updated",
 		},
+		{
+			description: "removeMessage",
+			item:        Diff{State: "removed", Shift: mockShift()},
+			expect:      "Shift removed",
+		},
 		{
 			description: "emptyMessage",
 			item:        Diff{},
 			expect:      "",
+			expectErr:   true,
 		},
 	}
 
 	for _, tt := range cases {
 		t.Run(tt.description, func(t *testing.T) {
-			result := constructMessage(&tt.item)
+			result, err := templates.constructMessage(&tt.item, "user@example.com")
+			if e, a := tt.expectErr, err != nil; e != a {
+				t.Fatalf("expect error %v, got %v", e, err)
+			}
 			if e, a := tt.expect, result; !strings.HasPrefix(a.Subject, e) {
 				t.Errorf("expect prefix %v, got %v", e, a.Subject)
 			}
+			if e, a := tt.item.Shift.ID, result.TextBody; !strings.Contains(a, e) {
+				t.Errorf("expect text body to contain %v, got %v", e, a)
+			}
+		})
+	}
+}
+
+func TestConstructMessageChanges(t *testing.T) {
+	templates := mockTemplates(t)
+
+	cases := []struct {
+		description string
+		changes     []Change
+		expectText  string
+		expectHTML  string
+	}{
+		{
+			description: "labeledChanges",
+			changes: []Change{
+				{Field: "DisplayTime", Old: "9:00am - 1:00pm", New: "10:00am - 2:00pm"},
+				{Field: "StartDate", Old: "2022-06-15T09:00:00", New: "2022-06-15T10:00:00"},
+			},
+			expectText: "- Time: 9:00am - 1:00pm → 10:00am - 2:00pm",
+			expectHTML: "<li>Time: 9:00am - 1:00pm &rarr; 10:00am - 2:00pm</li>",
+		},
+		{
+			description: "escapedChanges",
+			changes:     []Change{{Field: "Name", Old: "Setup", New: "Setup & <b>Teardown</b>"}},
+			expectText:  "- Name: Setup → Setup & <b>Teardown</b>",
+			expectHTML:  "<li>Name: Setup &rarr; Setup &amp; &lt;b&gt;Teardown&lt;/b&gt;</li>",
+		},
+		{
+			description: "noChanges",
+			changes:     nil,
+			expectText:  "",
+			expectHTML:  "",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.description, func(t *testing.T) {
+			item := Diff{State: "updated", Shift: mockShift(), Changes: tt.changes}
+
+			msg, err := templates.constructMessage(&item, "user@example.com")
+			if err != nil {
+				t.Fatalf("expect no error, got %v", err)
+			}
+			if e, a := tt.expectText, msg.TextBody; !strings.Contains(a, e) {
+				t.Errorf("expect %v, got %v", e, a)
+			}
+			if e, a := tt.expectHTML, msg.HtmlBody; !strings.Contains(a, e) {
+				t.Errorf("expect %v, got %v", e, a)
+			}
+			if strings.Contains(msg.TextBody, "Start") {
+				t.Errorf("expect unlabeled fields to be skipped, got %v", msg.TextBody)
+			}
+			if e, a := len(tt.changes) != 0, strings.Contains(msg.TextBody, "What changed"); e != a {
+				t.Errorf("expect changes section %v, got %v", e, msg.TextBody)
+			}
+		})
+	}
+}
+
+func TestConstructMessageEscaping(t *testing.T) {
+	templates := mockTemplates(t)
+
+	shift := mockShift()
+	shift.Name = "<script>alert('x')</script>"
+
+	msg, err := templates.constructMessage(&Diff{State: "created", Shift: shift}, "user@example.com")
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if strings.Contains(msg.HtmlBody, "<script>") {
+		t.Errorf("expect shift name to be escaped, got %v", msg.HtmlBody)
+	}
+	if e, a := shift.Name, msg.TextBody; !strings.Contains(a, e) {
+		t.Errorf("expect text body to contain %v, got %v", e, a)
+	}
+}
+
+func TestParseTemplates(t *testing.T) {
+	cases := []struct {
+		description string
+		sources     map[string]TemplateSource
+		expectErr   bool
+	}{
+		{
+			description: "builtinTemplates",
+			sources:     builtinTemplates(),
+			expectErr:   false,
+		},
+		{
+			description: "syntaxError",
+			sources: map[string]TemplateSource{
+				"created": {Subject: "{{.Shift.Name", Text: "", HTML: ""},
+			},
+			expectErr: true,
+		},
+		{
+			description: "unknownField",
+			sources: map[string]TemplateSource{
+				"created": {Subject: "{{.Shift.Name}}", Text: "{{.Shift.Missing}}", HTML: ""},
+			},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.description, func(t *testing.T) {
+			_, err := parseTemplates(tt.sources)
+			if e, a := tt.expectErr, err != nil; e != a {
+				t.Errorf("expect error %v, got %v", e, err)
+			}
+		})
+	}
+}
+
+func TestLoadS3Templates(t *testing.T) {
+	objects := map[string]string{
+		"templates/created/subject.tmpl": "Shift added: {{.Shift.Name}}",
+		"templates/removed/html.tmpl":    "<p>{{.Shift.Name}} removed</p>",
+	}
+
+	client := mockGetObjectAPI(func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+		if e, a := "bucket", *params.Bucket; e != a {
+			t.Errorf("expect %v, got %v", e, a)
+		}
+
+		body, ok := objects[*params.Key]
+		if !ok {
+			return nil, &s3types.NoSuchKey{}
+		}
+
+		return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(body))}, nil
+	})
+
+	sources, err := loadS3Templates(context.TODO(), client, "bucket", "templates")
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+
+	expect := map[string]TemplateSource{
+		"created": {Subject: "Shift added: {{.Shift.Name}}"},
+		"removed": {HTML: "<p>{{.Shift.Name}} removed</p>"},
+	}
+	if e, a := fmt.Sprint(expect), fmt.Sprint(sources); e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+}
+
+func TestLoadSSMTemplates(t *testing.T) {
+	client := mockGetParametersByPathAPI(func(ctx context.Context, params *ssm.GetParametersByPathInput, optFns ...func(*ssm.Options)) (*ssm.GetParametersByPathOutput, error) {
+		if e, a := "/shiftboard/templates", *params.Path; e != a {
+			t.Errorf("expect %v, got %v", e, a)
+		}
+		if !params.Recursive {
+			t.Error("expect Recursive to be true")
+		}
+
+		return &ssm.GetParametersByPathOutput{
+			Parameters: []types.Parameter{
+				{Name: aws.String("/shiftboard/templates/updated/subject"), Value: aws.String("Changed: {{.Shift.Name}}")},
+				{Name: aws.String("/shiftboard/templates/updated/text"), Value: aws.String("{{.Shift.Name}} changed")},
+				{Name: aws.String("/shiftboard/templates/updated/other"), Value: aws.String("ignored")},
+			},
+		}, nil
+	})
+
+	sources, err := loadSSMTemplates(context.TODO(), client, "/shiftboard/templates")
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+
+	expect := map[string]TemplateSource{
+		"updated": {Subject: "Changed: {{.Shift.Name}}", Text: "{{.Shift.Name}} changed"},
+	}
+	if e, a := fmt.Sprint(expect), fmt.Sprint(sources); e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+}
+
+func TestNewTemplateLoader(t *testing.T) {
+	cases := []struct {
+		source    string
+		expectNil bool
+		expectErr bool
+	}{
+		{source: "", expectNil: true},
+		{source: "s3://bucket/templates"},
+		{source: "ssm:/shiftboard/templates"},
+		{source: "s3:///templates", expectNil: true, expectErr: true},
+		{source: "https://example.com/templates", expectNil: true, expectErr: true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.source, func(t *testing.T) {
+			load, err := newTemplateLoader(tt.source, nil, nil)
+			if e, a := tt.expectErr, err != nil; e != a {
+				t.Errorf("expect error %v, got %v", e, err)
+			}
+			if e, a := tt.expectNil, load == nil; e != a {
+				t.Errorf("expect nil loader %v, got %v", e, a)
+			}
 		})
 	}
 }
 
-func TestSendEmail(t *testing.T) {
+func TestBuildTemplates(t *testing.T) {
+	builtin := mockTemplates(t)
+	item := &Diff{State: "created", Shift: mockShift()}
+
+	templates := buildTemplates(context.TODO(), builtin, map[string]TemplateSource{
+		"created": {Subject: "Shift added: {{.Shift.Name}}"},
+		"removed": {Subject: "{{.Shift.Missing}}"},
+		"unknown": {Subject: "{{.Shift.Name}}"},
+	})
+
+	msg, err := templates.constructMessage(item, "user@example.com")
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if e, a := "Shift added: "+item.Shift.Name, msg.Subject; e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+
+	// Parts that are not overridden keep the built-in templates
+	expect, _ := builtin.constructMessage(item, "user@example.com")
+	if e, a := expect.TextBody, msg.TextBody; e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+
+	// Invalid overrides fall back to the built-in templates
+	if e, a := builtin["removed"], templates["removed"]; e != a {
+		t.Errorf("expect built-in removed templates")
+	}
+
+	if _, ok := templates["unknown"]; ok {
+		t.Error("expect unknown state to be ignored")
+	}
+}
+
+func TestTemplateCache(t *testing.T) {
+	builtin := mockTemplates(t)
+	item := &Diff{State: "created", Shift: mockShift()}
+
+	loads := 0
+	loadErr := error(nil)
+	cache := newTemplateCache(builtin, func(ctx context.Context) (map[string]TemplateSource, error) {
+		loads++
+		return map[string]TemplateSource{"created": {Subject: "Load " + strconv.Itoa(loads)}}, loadErr
+	}, time.Hour)
+
+	subject := func() string {
+		msg, err := cache.Get(context.TODO()).constructMessage(item, "user@example.com")
+		if err != nil {
+			t.Fatalf("expect no error, got %v", err)
+		}
+		return msg.Subject
+	}
+
+	if e, a := "Load 1", subject(); e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+
+	// Cached until the TTL expires
+	if e, a := "Load 1", subject(); e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+
+	// Failed reloads keep the previous templates
+	cache.loadedAt = time.Time{}
+	loadErr = errors.New("access denied")
+	if e, a := "Load 1", subject(); e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+	if e, a := 2, loads; e != a {
+		t.Errorf("expect %v loads, got %v", e, a)
+	}
+}
+
+func TestSendRawEmail(t *testing.T) {
 	messageID := "50632886-158d-4f8b-abf8-d74649e92d7b"
 
 	cases := []struct {
-		client    func(t *testing.T) SESSendEmailAPI
-		sender    string
-		recipient string
-		msg       Message
-		expect    *ses.SendEmailOutput
+		client     func(t *testing.T) SESSendRawEmailAPI
+		sender     string
+		recipients []string
+		data       []byte
+		expect     *ses.SendRawEmailOutput
 	}{
 		{
-			client: func(t *testing.T) SESSendEmailAPI {
-				return mockSendEmailAPI(func(ctx context.Context, params *ses.SendEmailInput, optFns ...func(*ses.Options)) (*ses.SendEmailOutput, error) {
+			client: func(t *testing.T) SESSendRawEmailAPI {
+				return mockSendRawEmailAPI(func(ctx context.Context, params *ses.SendRawEmailInput, optFns ...func(*ses.Options)) (*ses.SendRawEmailOutput, error) {
 					t.Helper()
-					if params.Destination == nil {
-						t.Fatal("expect destination to not be nil")
-					}
-					if e, a := "user@example.com", params.Destination.ToAddresses[0]; e != a {
+					if e, a := "user@example.com", params.Destinations[0]; e != a {
 						t.Errorf("expect %v, got %v", e, a)
 					}
 					if params.Source == nil {
@@ -144,39 +527,23 @@ func TestSendEmail(t *testing.T) {
 					if e, a := "no-reply@example.com", *params.Source; e != a {
 						t.Errorf("expect %v, got %v", e, a)
 					}
-					if *params.Message.Subject.Data == "" {
-						t.Fatal("expect Subject to not be empty")
+					if params.RawMessage == nil {
+						t.Fatal("expect raw message to not be nil")
 					}
-					if e, a := "test", *params.Message.Subject.Data; e != a {
-						t.Errorf("expect %v, got %v", e, a)
-					}
-					if *params.Message.Body.Text.Data == "" {
-						t.Fatal("expect text message body not to be empty")
-					}
-					if e, a := "text message", *params.Message.Body.Text.Data; e != a {
-						t.Errorf("expect %v, got %v", e, a)
-					}
-					if *params.Message.Body.Html.Data == "" {
-						t.Fatal("expect HTML message body not to be empty")
-					}
-					if e, a := "html message", *params.Message.Body.Html.Data; e != a {
+					if e, a := "raw message", string(params.RawMessage.Data); e != a {
 						t.Errorf("expect %v, got %v", e, a)
 					}
 
-					return &ses.SendEmailOutput{
+					return &ses.SendRawEmailOutput{
 						MessageId:      aws.String(messageID),
 						ResultMetadata: middleware.Metadata{},
 					}, nil
 				})
 			},
-			sender:    "no-reply@example.com",
-			recipient: "user@example.com",
-			msg: Message{
-				Subject:  "test",
-				TextBody: "text message",
-				HtmlBody: "html message",
-			},
-			expect: &ses.SendEmailOutput{
+			sender:     "no-reply@example.com",
+			recipients: []string{"user@example.com"},
+			data:       []byte("raw message"),
+			expect: &ses.SendRawEmailOutput{
 				MessageId:      aws.String(messageID),
 				ResultMetadata: middleware.Metadata{},
 			},
@@ -186,7 +553,7 @@ func TestSendEmail(t *testing.T) {
 	for i, tt := range cases {
 		t.Run(strconv.Itoa(i), func(t *testing.T) {
 			ctx := context.TODO()
-			output, err := SendEmail(ctx, tt.client(t), tt.sender, tt.recipient, tt.msg)
+			output, err := SendRawEmail(ctx, tt.client(t), tt.sender, tt.recipients, tt.data)
 			if err != nil {
 				t.Fatalf("expect no error, got %v", err)
 			}
@@ -197,12 +564,469 @@ func TestSendEmail(t *testing.T) {
 	}
 }
 
+func TestConstructRawEmail(t *testing.T) {
+	item := &Diff{State: "created", Shift: mockShift()}
+	msg := Message{Subject: "Shift added: Café", TextBody: "text message", HtmlBody: "<p>html message</p>"}
+
+	invite, err := newInvite(item, "ShiftBoard Bot <no-reply@example.com>", []string{"user@example.com"}, "")
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+
+	data, err := constructRawEmail("no-reply@example.com", []string{"user@example.com"}, msg, invite)
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+
+	m, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("expect valid message, got %v", err)
+	}
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(m.Header.Get("Subject"))
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if e, a := msg.Subject, subject; e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("expect multipart/mixed, got %v %v", mediaType, err)
+	}
+
+	types := []string{}
+	var walk func(r io.Reader, boundary string)
+	walk = func(r io.Reader, boundary string) {
+		mr := multipart.NewReader(r, boundary)
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				t.Fatalf("expect valid part, got %v", err)
+			}
+
+			mediaType, params, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+			types = append(types, mediaType)
+			if strings.HasPrefix(mediaType, "multipart/") {
+				walk(p, params["boundary"])
+			}
+		}
+	}
+	walk(m.Body, params["boundary"])
+
+	expect := []string{"multipart/alternative", "text/plain", "text/html", "text/calendar", "application/ics"}
+	if e, a := fmt.Sprint(expect), fmt.Sprint(types); e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+}
+
+func TestNewInvite(t *testing.T) {
+	shift := mockShift()
+	shift.StartDate = "2022-06-15T22:00:00"
+	shift.EndDate = "2022-06-15T06:00:00"
+
+	cases := []struct {
+		description    string
+		state          string
+		timezone       string
+		expectMethod   string
+		expectStart    string
+		expectEnd      string
+		expectSequence int64
+	}{
+		{
+			description:    "floating",
+			state:          "created",
+			expectMethod:   "REQUEST",
+			expectStart:    "DTSTART:20220615T220000",
+			expectEnd:      "DTEND:20220616T060000",
+			expectSequence: shift.Updated.Unix(),
+		},
+		{
+			description:    "timezone",
+			state:          "updated",
+			timezone:       "America/Los_Angeles",
+			expectMethod:   "REQUEST",
+			expectStart:    "DTSTART:20220616T050000Z",
+			expectEnd:      "DTEND:20220616T130000Z",
+			expectSequence: shift.Updated.Unix(),
+		},
+		{
+			description:  "removed",
+			state:        "removed",
+			expectMethod: "CANCEL",
+			expectStart:  "DTSTART:20220615T220000",
+			expectEnd:    "DTEND:20220616T060000",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.description, func(t *testing.T) {
+			invite, err := newInvite(&Diff{State: tt.state, Shift: shift}, "ShiftBoard Bot <no-reply@example.com>",
+				[]string{"user@example.com"}, tt.timezone)
+			if err != nil {
+				t.Fatalf("expect no error, got %v", err)
+			}
+
+			if e, a := tt.expectMethod, invite.Method; e != a {
+				t.Errorf("expect %v, got %v", e, a)
+			}
+			if e, a := shift.ID+"@shiftboard-bot", invite.UID; e != a {
+				t.Errorf("expect %v, got %v", e, a)
+			}
+			if tt.expectSequence != 0 && tt.expectSequence != invite.Sequence {
+				t.Errorf("expect sequence %v, got %v", tt.expectSequence, invite.Sequence)
+			}
+			if invite.Method == "CANCEL" && invite.Sequence <= shift.Updated.Unix() {
+				t.Errorf("expect cancellation sequence to be bumped, got %v", invite.Sequence)
+			}
+
+			ics := string(invite.ICS())
+			for _, expect := range []string{
+				"METHOD:" + tt.expectMethod + "\r\n",
+				tt.expectStart + "\r\n",
+				tt.expectEnd + "\r\n",
+				"ORGANIZER:mailto:no-reply@example.com\r\n",
+				"ATTENDEE;ROLE=REQ-PARTICIPANT:mailto:user@example.com\r\n",
+			} {
+				if !strings.Contains(ics, expect) {
+					t.Errorf("expect invite to contain %q, got %v", expect, ics)
+				}
+			}
+		})
+	}
+
+	if _, err := newInvite(&Diff{State: "created", Shift: shift}, "", nil, "Invalid/Zone"); err == nil {
+		t.Error("expect error for invalid time zone")
+	}
+}
+
+func TestICSFold(t *testing.T) {
+	line := "SUMMARY:" + strings.Repeat("é", 50)
+
+	folded := icsFold(line)
+	for _, l := range strings.Split(folded, "\r\n") {
+		if len(l) > icsLineLength {
+			t.Errorf("expect line of at most %d octets, got %d", icsLineLength, len(l))
+		}
+		if !utf8.ValidString(l) {
+			t.Errorf("expect valid UTF-8, got %q", l)
+		}
+	}
+
+	if e, a := line, strings.ReplaceAll(folded, "\r\n ", ""); e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+
+	if e, a := `Setup\, teardown\; \\ cleanup\nDay 2`, icsEscape("Setup, teardown; \\ cleanup\nDay 2"); e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+}
+
+func TestWebhookNotify(t *testing.T) {
+	cases := []struct {
+		description    string
+		statuses       []int
+		secret         string
+		expectAttempts int
+		expectErr      bool
+	}{
+		{
+			description:    "delivered",
+			statuses:       []int{http.StatusOK},
+			secret:         "secret",
+			expectAttempts: 1,
+			expectErr:      false,
+		},
+		{
+			description:    "retryServerError",
+			statuses:       []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusNoContent},
+			secret:         "secret",
+			expectAttempts: 3,
+			expectErr:      false,
+		},
+		{
+			description:    "retriesExhausted",
+			statuses:       []int{http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError},
+			secret:         "secret",
+			expectAttempts: 3,
+			expectErr:      true,
+		},
+		{
+			description:    "noRetryClientError",
+			statuses:       []int{http.StatusBadRequest},
+			secret:         "secret",
+			expectAttempts: 1,
+			expectErr:      true,
+		},
+		{
+			description:    "missingSecret",
+			statuses:       []int{},
+			secret:         "",
+			expectAttempts: 0,
+			expectErr:      true,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.description, func(t *testing.T) {
+			attempts := 0
+			deliveryIDs := map[string]bool{}
+
+			server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				timestamp := r.Header.Get(webhookTimestampHeader)
+				deliveryIDs[r.Header.Get(webhookDeliveryHeader)] = true
+
+				if e, a := "sha256="+signWebhook(tt.secret, timestamp, body), r.Header.Get(webhookSignatureHeader); e != a {
+					t.Errorf("expect signature %v, got %v", e, a)
+				}
+
+				var event WebhookEvent
+				if err := json.Unmarshal(body, &event); err != nil {
+					t.Errorf("expect no error, got %v", err)
+				}
+				if e, a := "shift.updated", event.Event; e != a {
+					t.Errorf("expect %v, got %v", e, a)
+				}
+				if e, a := webhookVersion, event.Version; e != a {
+					t.Errorf("expect %v, got %v", e, a)
+				}
+
+				w.WriteHeader(tt.statuses[attempts])
+				attempts++
+			}))
+			defer server.Close()
+
+			n := &webhookNotifier{
+				client:  server.Client(),
+				url:     server.URL,
+				secret:  tt.secret,
+				backoff: time.Millisecond,
+			}
+
+			item := &Diff{
+				Tenant:  "alice",
+				State:   "updated",
+				Shift:   mockShift(),
+				Changes: []Change{{Field: "DisplayTime", Old: "9:00am", New: "10:00am"}},
+			}
+
+			err := n.Notify(context.TODO(), item)
+			if e, a := tt.expectErr, err != nil; e != a {
+				t.Errorf("expect error %v, got %v", e, err)
+			}
+			if e, a := tt.expectAttempts, attempts; e != a {
+				t.Errorf("expect %v attempts, got %v", e, a)
+			}
+			if len(deliveryIDs) > 1 {
+				t.Errorf("expect a single delivery ID across retries, got %v", deliveryIDs)
+			}
+		})
+	}
+}
+
+func TestWebhookDeliveryID(t *testing.T) {
+	n := &webhookNotifier{url: "https://example.com/hook"}
+	other := &webhookNotifier{url: "https://example.com/other"}
+	item := &Diff{Tenant: "alice", State: "updated", Shift: mockShift(), OutboxID: "1001#123456789#1652270400#updated"}
+
+	// Redeliveries of the change carry the same ID, even with another body
+	if e, a := webhookDeliveryID(item, n, []byte(`{"a":1}`)), webhookDeliveryID(item, n, []byte(`{"a":2}`)); e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+	if webhookDeliveryID(item, n, nil) == webhookDeliveryID(item, other, nil) {
+		t.Error("expect different IDs for different endpoints")
+	}
+
+	next := *item
+	next.OutboxID = "1001#123456789#1652274000#updated"
+	if webhookDeliveryID(item, n, nil) == webhookDeliveryID(&next, n, nil) {
+		t.Error("expect different IDs for different changes")
+	}
+
+	// Changes without an outbox entry are identified by their body
+	direct := &Diff{Tenant: "alice", State: "updated", Shift: mockShift()}
+	if e, a := webhookDeliveryID(direct, n, []byte(`{"a":1}`)), webhookDeliveryID(direct, n, []byte(`{"a":1}`)); e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+}
+
+func TestWebhookNotifyRequiresHTTPS(t *testing.T) {
+	n := &webhookNotifier{client: http.DefaultClient, url: "http://example.com/hook", secret: "secret"}
+
+	if err := n.Notify(context.TODO(), &Diff{State: "created", Shift: mockShift()}); err == nil {
+		t.Errorf("expect error for non-HTTPS webhook URL")
+	}
+}
+
+func TestSignWebhook(t *testing.T) {
+	// echo -n '1660000000.{"version":"1"}' | openssl dgst -sha256 -hmac secret
+	expect := "d17c540e6c32939bdedede73e38f0a7758759a0dedd66f3fc8d8b534c4e884fd"
+
+	if e, a := expect, signWebhook("secret", "1660000000", []byte(`{"version":"1"}`)); e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+}
+
+func TestPublish(t *testing.T) {
+	messageID := "2b1f2a6c-6d1f-5d6b-9a7e-3c1d2b4e5f60"
+
+	client := mockPublishAPI(func(ctx context.Context, params *sns.PublishInput, optFns ...func(*sns.Options)) (*sns.PublishOutput, error) {
+		if params.PhoneNumber == nil {
+			t.Fatal("expect phone number to not be nil")
+		}
+		if e, a := "+15555550100", *params.PhoneNumber; e != a {
+			t.Errorf("expect %v, got %v", e, a)
+		}
+		if e, a := "sms message", *params.Message; e != a {
+			t.Errorf("expect %v, got %v", e, a)
+		}
+		if e, a := "Transactional", *params.MessageAttributes["AWS.SNS.SMS.SMSType"].StringValue; e != a {
+			t.Errorf("expect %v, got %v", e, a)
+		}
+
+		return &sns.PublishOutput{MessageId: aws.String(messageID)}, nil
+	})
+
+	output, err := Publish(context.TODO(), client, "+15555550100", "sms message")
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if e, a := messageID, *output.MessageId; e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+}
+
+func TestSMSNotifyLogsNoPhoneNumber(t *testing.T) {
+	client := mockPublishAPI(func(ctx context.Context, params *sns.PublishInput, optFns ...func(*sns.Options)) (*sns.PublishOutput, error) {
+		return &sns.PublishOutput{MessageId: aws.String("2b1f2a6c")}, nil
+	})
+
+	var buf bytes.Buffer
+	ctx := withLogger(context.TODO(), newLogger(&buf, LevelDebug))
+
+	n := &smsNotifier{api: client, phoneNumber: "+15555550100"}
+	if err := n.Notify(ctx, &Diff{State: "created", Shift: mockShift()}); err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+
+	if strings.Contains(buf.String(), "5555550100") {
+		t.Errorf("expect phone number to be masked, got %s", buf.String())
+	}
+	if !strings.Contains(buf.String(), "***00") {
+		t.Errorf("expect masked phone number to be logged, got %s", buf.String())
+	}
+}
+
+func TestConstructSMS(t *testing.T) {
+	shift := mockShift()
+	shift.Name = "Front Desk"
+	shift.DisplayDate = "Wed Jun 15"
+	shift.DisplayTime = "9:00am - 1:00pm"
+
+	longName := shift
+	longName.Name = strings.Repeat("Concession Stand ", 6)
+
+	longDetails := shift
+	longDetails.Name = "Front Desk Volunteer"
+	longDetails.DisplayTime = strings.Repeat("9:00am - 1:00pm ", 6)
+
+	cases := []struct {
+		description string
+		item        Diff
+		expect      string
+		expectLink  bool
+	}{
+		{
+			description: "shortMessage",
+			item:        Diff{State: "updated", Shift: shift},
+			expect:      "Shift updated: Front Desk Wed Jun 15 9:00am - 1:00pm " + shiftURL + shift.ID,
+			expectLink:  true,
+		},
+		{
+			description: "truncatedName",
+			item:        Diff{State: "created", Shift: longName},
+			expect:      "New shift: Concession Stand",
+			expectLink:  true,
+		},
+		{
+			description: "droppedLink",
+			item:        Diff{State: "removed", Shift: longDetails},
+			expect:      "Shift removed: Front Desk Volunteer Wed Jun 15",
+			expectLink:  false,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.description, func(t *testing.T) {
+			msg := constructSMS(&tt.item)
+			if a := runeLen(msg); a > smsMaxLength {
+				t.Errorf("expect at most %v characters, got %v", smsMaxLength, a)
+			}
+			if e, a := tt.expect, msg; !strings.HasPrefix(a, e) {
+				t.Errorf("expect prefix %v, got %v", e, a)
+			}
+			if e, a := tt.expectLink, strings.Contains(msg, shiftURL); e != a {
+				t.Errorf("expect link %v, got %v", e, msg)
+			}
+		})
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	cases := []struct {
+		description string
+		text        string
+		length      int
+		expect      string
+	}{
+		{
+			description: "shortText",
+			text:        "Front Desk",
+			length:      20,
+			expect:      "Front Desk",
+		},
+		{
+			description: "longText",
+			text:        "Front Desk Volunteer",
+			length:      13,
+			expect:      "Front Desk...",
+		},
+		{
+			description: "multibyteText",
+			text:        "Café Counter",
+			length:      7,
+			expect:      "Café...",
+		},
+		{
+			description: "noRoom",
+			text:        "Front Desk",
+			length:      -5,
+			expect:      "",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.description, func(t *testing.T) {
+			if e, a := tt.expect, truncate(tt.text, tt.length); e != a {
+				t.Errorf("expect %v, got %v", e, a)
+			}
+		})
+	}
+}
+
 func TestParseParameters(t *testing.T) {
 	cases := []struct {
 		description     string
 		output          *ssm.GetParametersByPathOutput
 		expectSender    string
 		expectRecipient string
+		expectSlack     []string
 		expectErr       error
 	}{
 		{
@@ -210,6 +1034,20 @@ func TestParseParameters(t *testing.T) {
 			output:          mockParametersOutput(true),
 			expectSender:    "no-reply@example.com",
 			expectRecipient: "user@example.com",
+			expectSlack:     []string{"https://hooks.slack.com/services/T000/B000/XXXX"},
+			expectErr:       nil,
+		},
+		{
+			description: "checkUserParameters",
+			output: &ssm.GetParametersByPathOutput{
+				Parameters: []types.Parameter{
+					{Name: aws.String("/shiftboard/users/alice/notifications/sender"), Value: aws.String("no-reply@example.com")},
+					{Name: aws.String("/shiftboard/users/alice/notifications/recipient"), Value: aws.String("alice@example.com")},
+				},
+			},
+			expectSender:    "no-reply@example.com",
+			expectRecipient: "alice@example.com",
+			expectSlack:     nil,
 			expectErr:       nil,
 		},
 		{
@@ -217,26 +1055,300 @@ func TestParseParameters(t *testing.T) {
 			output:          mockParametersOutput(false),
 			expectSender:    "",
 			expectRecipient: "",
+			expectSlack:     nil,
 			expectErr:       errors.New("no parameters returned from SSM parameter store"),
 		},
 	}
 
 	for _, tt := range cases {
 		t.Run(tt.description, func(t *testing.T) {
-			sender, recipient, err := parseParameters(tt.output)
+			cfg, err := parseParameters(tt.output)
 			if e, a := tt.expectErr, err; a != nil && e.Error() != a.Error() {
 				t.Errorf("expect %v, got %v", e, a)
 			}
-			if e, a := tt.expectSender, sender; e != a {
+			if cfg == nil {
+				cfg = &Config{}
+			}
+			if e, a := tt.expectSender, cfg.Sender; e != a {
+				t.Errorf("expect %v, got %v", e, a)
+			}
+			if e, a := tt.expectRecipient, cfg.Recipient; e != a {
 				t.Errorf("expect %v, got %v", e, a)
 			}
-			if e, a := tt.expectRecipient, recipient; e != a {
+			if e, a := fmt.Sprint(tt.expectSlack), fmt.Sprint(cfg.SlackWebhooks); len(tt.expectSlack) != 0 && e != a {
 				t.Errorf("expect %v, got %v", e, a)
 			}
 		})
 	}
 }
 
+func TestNewNotifiers(t *testing.T) {
+	h := handler{}
+	templates := mockTemplates(t)
+
+	cases := []struct {
+		description string
+		cfg         *Config
+		expect      []string
+	}{
+		{
+			description: "allChannels",
+			cfg: &Config{
+				Sender:        "no-reply@example.com",
+				Recipient:     "user@example.com",
+				SlackWebhooks: []string{"https://hooks.slack.com/a", "https://hooks.slack.com/b"},
+				PhoneNumbers:  []string{"+15555550100"},
+				Webhooks:      []string{"https://example.com/hook"},
+				WebhookSecret: "secret",
+			},
+			expect: []string{"email", "slack", "slack", "sms", "webhook"},
+		},
+		{
+			description: "missingSender",
+			cfg:         &Config{Recipient: "user@example.com"},
+			expect:      []string{},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.description, func(t *testing.T) {
+			channels := []string{}
+			for _, n := range h.newNotifiers(tt.cfg, templates) {
+				channels = append(channels, n.Channel())
+			}
+			if e, a := fmt.Sprint(tt.expect), fmt.Sprint(channels); e != a {
+				t.Errorf("expect %v, got %v", e, a)
+			}
+		})
+	}
+}
+
+func TestHandleRequest(t *testing.T) {
+	h := handler{}
+	event := events.SQSEvent{
+		Records: []events.SQSMessage{
+			{MessageId: "invalid", Body: `{"Tenant":`},
+		},
+	}
+
+	response, err := h.HandleRequest(context.TODO(), event)
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+
+	if e, a := 1, len(response.BatchItemFailures); e != a {
+		t.Fatalf("expect %v failures, got %v", e, a)
+	}
+	if e, a := "invalid", response.BatchItemFailures[0].ItemIdentifier; e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+}
+
+func TestGetOutboxEntry(t *testing.T) {
+	av, err := attributevalue.MarshalMap(OutboxEntry{
+		Tenant:       "default",
+		ID:           "1001#123456789#1652270400#updated",
+		Status:       "pending",
+		SentChannels: []string{"email:b4c9a289323b"},
+	})
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+
+	client := &mockOutboxAPI{items: map[string]map[string]dbtypes.AttributeValue{
+		"1001#123456789#1652270400#updated": av,
+	}}
+
+	entry, err := getOutboxEntry(context.TODO(), client, "outboxTable", "default", "1001#123456789#1652270400#updated")
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if e, a := "[email:b4c9a289323b]", fmt.Sprint(entry.SentChannels); e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+
+	entry, err = getOutboxEntry(context.TODO(), client, "outboxTable", "default", "1001#123456789#1652270400#removed")
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if entry != nil {
+		t.Errorf("expect no entry, got %v", entry)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	email := &mockNotifier{channel: "email", destination: "user@example.com"}
+	sms := &mockNotifier{channel: "sms", destination: "+15555550100"}
+	slack := &mockNotifier{channel: "slack", destination: "https://hooks.slack.com/a", err: errors.New("timeout")}
+
+	client := &mockOutboxAPI{}
+	h := handler{dbClient: client, outboxTable: "outboxTable"}
+	entry := &OutboxEntry{
+		Tenant:       "default",
+		ID:           "1001#123456789#1652270400#updated",
+		SentChannels: []string{deliveryID(sms)},
+	}
+
+	var buf bytes.Buffer
+	ctx := withRun(withLogger(context.TODO(), newLogger(&buf, LevelInfo)), "run-1", field("shiftId", "123456789"))
+
+	item := Diff{State: "updated", Shift: mockShift()}
+	if err := h.notify(ctx, &item, []Notifier{email, sms, slack}, entry); err == nil {
+		t.Fatal("expect error, got nil")
+	}
+
+	// Every delivery is logged with the run and the shift
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("expect no error, got %v", err)
+		}
+		if entry["runId"] != "run-1" || entry["shiftId"] != "123456789" {
+			t.Errorf("expect run and shift ID, got %s", line)
+		}
+	}
+
+	if e, a := "[1 0 1]", fmt.Sprint([]int{email.calls, sms.calls, slack.calls}); e != a {
+		t.Errorf("expect calls %v, got %v", e, a)
+	}
+
+	// Only the notifier which sent the change is recorded
+	if e, a := 1, len(client.updates); e != a {
+		t.Fatalf("expect %v updates, got %v", e, a)
+	}
+	if e, a := deliveryID(email), client.updates[0].ExpressionAttributeValues[":channel"].(*dbtypes.AttributeValueMemberSS).Value[0]; e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+
+	// Without an outbox entry every notifier is called and nothing is recorded
+	client.updates = nil
+	if err := h.notify(context.TODO(), &item, []Notifier{email, sms}, nil); err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if e, a := "[2 1]", fmt.Sprint([]int{email.calls, sms.calls}); e != a {
+		t.Errorf("expect calls %v, got %v", e, a)
+	}
+	if e, a := 0, len(client.updates); e != a {
+		t.Errorf("expect %v updates, got %v", e, a)
+	}
+}
+
+func TestDeliveryID(t *testing.T) {
+	a := deliveryID(&mockNotifier{channel: "sms", destination: "+15555550100"})
+	b := deliveryID(&mockNotifier{channel: "sms", destination: "+15555550101"})
+
+	if !strings.HasPrefix(a, "sms:") || len(a) != len("sms:")+12 {
+		t.Errorf("expect channel and hash of the destination, got %v", a)
+	}
+	if strings.Contains(a, "5555550100") {
+		t.Errorf("expect destination to be hashed, got %v", a)
+	}
+	if a == b {
+		t.Errorf("expect different IDs for different destinations, got %v", a)
+	}
+}
+
+func TestConstructSlackMessage(t *testing.T) {
+	shift := mockShift()
+	shift.Name = "Setup & <Teardown>"
+
+	item := Diff{
+		State:   "updated",
+		Shift:   shift,
+		Changes: []Change{{Field: "DisplayTime", Old: "9:00am", New: "10:00am"}},
+	}
+
+	msg := constructSlackMessage(&item)
+
+	if e, a := "Shift updated: Setup & <Teardown>", msg.Text; e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+	if e, a := 3, len(msg.Blocks); e != a {
+		t.Fatalf("expect %v, got %v", e, a)
+	}
+	if e, a := "Shift updated", msg.Blocks[0].Text.Text; e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+	if e, a := "Setup &amp; &lt;Teardown&gt;", msg.Blocks[1].Text.Text; !strings.Contains(a, e) {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+	if e, a := "• Time: 9:00am → 10:00am", msg.Blocks[2].Text.Text; !strings.Contains(a, e) {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+}
+
+func TestSlackNotify(t *testing.T) {
+	cases := []struct {
+		description string
+		status      int
+		expectErr   bool
+	}{
+		{
+			description: "delivered",
+			status:      http.StatusOK,
+			expectErr:   false,
+		},
+		{
+			description: "rejected",
+			status:      http.StatusForbidden,
+			expectErr:   true,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.description, func(t *testing.T) {
+			var received SlackMessage
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if e, a := "application/json", r.Header.Get("Content-Type"); e != a {
+					t.Errorf("expect %v, got %v", e, a)
+				}
+				if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+					t.Errorf("expect no error, got %v", err)
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+
+			n := &slackNotifier{client: server.Client(), webhookURL: server.URL}
+			err := n.Notify(context.TODO(), &Diff{State: "created", Shift: mockShift()})
+			if e, a := tt.expectErr, err != nil; e != a {
+				t.Errorf("expect error %v, got %v", e, err)
+			}
+			if e, a := "New shift added", received.Blocks[0].Text.Text; e != a {
+				t.Errorf("expect %v, got %v", e, a)
+			}
+		})
+	}
+}
+
+func TestWithDeadlineMargin(t *testing.T) {
+	deadline := time.Now().Add(time.Minute)
+	parent, cancelParent := context.WithDeadline(context.Background(), deadline)
+	defer cancelParent()
+
+	ctx, cancel := withDeadlineMargin(parent, deadlineMargin)
+	defer cancel()
+
+	actual, ok := ctx.Deadline()
+	if !ok {
+		t.Fatal("expect deadline to be set")
+	}
+	if e, a := deadline.Add(-deadlineMargin), actual; !e.Equal(a) {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+
+	ctx, cancel = withDeadlineMargin(context.Background(), deadlineMargin)
+	if _, ok := ctx.Deadline(); ok {
+		t.Error("expect no deadline without a parent deadline")
+	}
+
+	cancel()
+	if ctx.Err() == nil {
+		t.Error("expect context to be cancelled")
+	}
+}
+
 // mockParametersOutput returns mock parameters if 'params' bool is true, otherwise
 // returns an empty parameters slice if false.
 func mockParametersOutput(params bool) *ssm.GetParametersByPathOutput {
@@ -252,6 +1364,11 @@ func mockParametersOutput(params bool) *ssm.GetParametersByPathOutput {
 			Name:  aws.String("/shiftboard/notifications/recipient"),
 			Value: aws.String("user@example.com"),
 		})
+
+		parameters = append(parameters, types.Parameter{
+			Name:  aws.String("/shiftboard/notifications/slack_webhook"),
+			Value: aws.String("https://hooks.slack.com/services/T000/B000/XXXX"),
+		})
 	}
 
 	return &ssm.GetParametersByPathOutput{
@@ -273,6 +1390,15 @@ func (m *MockItem) New() *MockItem {
 	return m
 }
 
+func mockTemplates(t *testing.T) Templates {
+	templates, err := parseTemplates(builtinTemplates())
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+
+	return templates
+}
+
 func mockShift() shiftboard.Shift {
 	item := &MockItem{&shiftboard.Shift{}}
 	item.New()
@@ -300,3 +1426,76 @@ func randomString() string {
 
 	return string(b)
 }
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := newLogger(&buf, LevelInfo).With(field("function", "test"))
+
+	logger.Debug("not logged")
+	logger.Info("Sent message to jane.doe@example.com",
+		field("password", "password123"),
+		field("accessToken", "eyJhbGciOi"),
+		field("recipients", []string{"john.doe@example.com"}),
+		field("phoneNumber", "+15555550100"),
+		field("webhookURL", "https://hooks.slack.com/services/T000/B000/XXXX"),
+		field("count", 2),
+		errField(errors.New(`Post "https://hooks.slack.com/services/T000/B000/XXXX": error sending to john.doe@example.com`)))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if e, a := 1, len(lines); e != a {
+		t.Fatalf("expect %v lines, got %v: %s", e, a, buf.String())
+	}
+
+	for _, secret := range []string{"password123", "eyJhbGciOi", "jane.doe", "john.doe", "5555550100", "T000", "not logged"} {
+		if strings.Contains(buf.String(), secret) {
+			t.Errorf("expect %q to be redacted, got %s", secret, buf.String())
+		}
+	}
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("expect JSON log entry, got %v", err)
+	}
+
+	expect := map[string]interface{}{
+		"level":       "info",
+		"msg":         "Sent message to j***@example.com",
+		"function":    "test",
+		"password":    redacted,
+		"phoneNumber": "***00",
+		"webhookURL":  "https://hooks.slack.com/" + redacted,
+		"count":       float64(2),
+		"error":       `Post "https://hooks.slack.com/` + redacted + `": error sending to j***@example.com`,
+	}
+	for k, e := range expect {
+		if a := entry[k]; e != a {
+			t.Errorf("expect %s %v, got %v", k, e, a)
+		}
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	cases := []struct {
+		value     string
+		expect    Level
+		expectErr bool
+	}{
+		{value: "", expect: LevelInfo},
+		{value: "DEBUG", expect: LevelDebug},
+		{value: "warn", expect: LevelWarn},
+		{value: "error", expect: LevelError},
+		{value: "verbose", expect: LevelInfo, expectErr: true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.value, func(t *testing.T) {
+			level, err := parseLevel(tt.value)
+			if e, a := tt.expectErr, err != nil; e != a {
+				t.Errorf("expect error %v, got %v", e, err)
+			}
+			if e, a := tt.expect, level; e != a {
+				t.Errorf("expect %v, got %v", e, a)
+			}
+		})
+	}
+}
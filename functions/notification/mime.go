@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strings"
+)
+
+// constructRawEmail builds a MIME message with text and HTML alternatives. The
+// invite, if any, is added as a text/calendar alternative that calendar
+// clients render as an invitation, and as an .ics attachment for the others.
+func constructRawEmail(sender string, recipients []string, msg Message, invite *Invite) ([]byte, error) {
+	var alternativeBody bytes.Buffer
+	alternative := multipart.NewWriter(&alternativeBody)
+
+	if err := writeQuotedPrintable(alternative, "text/plain; charset="+charSet, msg.TextBody); err != nil {
+		return nil, err
+	}
+	if err := writeQuotedPrintable(alternative, "text/html; charset="+charSet, msg.HtmlBody); err != nil {
+		return nil, err
+	}
+
+	var ics []byte
+	if invite != nil {
+		ics = invite.ICS()
+		contentType := fmt.Sprintf("text/calendar; charset=%s; method=%s", charSet, invite.Method)
+
+		if err := writeBase64(alternative, textproto.MIMEHeader{"Content-Type": {contentType}}, ics); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := alternative.Close(); err != nil {
+		return nil, err
+	}
+
+	var mixedBody bytes.Buffer
+	mixed := multipart.NewWriter(&mixedBody)
+
+	part, err := mixed.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"multipart/alternative; boundary=" + alternative.Boundary()},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := part.Write(alternativeBody.Bytes()); err != nil {
+		return nil, err
+	}
+
+	if invite != nil {
+		if err := writeBase64(mixed, textproto.MIMEHeader{
+			"Content-Type":        {"application/ics; name=invite.ics"},
+			"Content-Disposition": {"attachment; filename=invite.ics"},
+		}, ics); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := mixed.Close(); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	for _, line := range []string{
+		"From: " + sender,
+		"To: " + strings.Join(recipients, ", "),
+		"Subject: " + mime.QEncoding.Encode(charSet, msg.Subject),
+		"MIME-Version: 1.0",
+		"Content-Type: multipart/mixed; boundary=" + mixed.Boundary(),
+	} {
+		buf.WriteString(line + "\r\n")
+	}
+	buf.WriteString("\r\n")
+	buf.Write(mixedBody.Bytes())
+
+	return buf.Bytes(), nil
+}
+
+func writeQuotedPrintable(w *multipart.Writer, contentType string, body string) error {
+	part, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return err
+	}
+
+	qp := quotedprintable.NewWriter(part)
+	if _, err := qp.Write([]byte(body)); err != nil {
+		return err
+	}
+
+	return qp.Close()
+}
+
+// writeBase64 writes a base64 encoded part wrapped at 76 characters.
+func writeBase64(w *multipart.Writer, header textproto.MIMEHeader, body []byte) error {
+	header.Set("Content-Transfer-Encoding", "base64")
+
+	part, err := w.CreatePart(header)
+	if err != nil {
+		return err
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(body)
+	for len(encoded) > 76 {
+		if _, err := part.Write([]byte(encoded[:76] + "\r\n")); err != nil {
+			return err
+		}
+		encoded = encoded[76:]
+	}
+
+	_, err = part.Write([]byte(encoded + "\r\n"))
+	return err
+}
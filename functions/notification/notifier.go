@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// Notifier delivers a shift change to recipients over a notification channel.
+type Notifier interface {
+	Channel() string
+	Destination() string
+	Notify(ctx context.Context, item *Diff) error
+}
+
+// emailNotifier sends the rendered email message to recipients through SES,
+// with a calendar invite of the shift.
+type emailNotifier struct {
+	templates Templates
+	api       SESSendRawEmailAPI
+	sender    string
+	recipient string
+	timezone  string
+}
+
+func (n *emailNotifier) Channel() string {
+	return "email"
+}
+
+func (n *emailNotifier) Destination() string {
+	return n.recipient
+}
+
+func (n *emailNotifier) Notify(ctx context.Context, item *Diff) error {
+	// Render email from templates
+	msg, err := n.templates.constructMessage(item, n.recipient)
+	if err != nil {
+		return fmt.Errorf("error rendering email message: %v", err)
+	}
+
+	recipients := splitList(n.recipient)
+
+	// A shift with unparsable dates is still notified, without the invite
+	invite, err := newInvite(item, n.sender, recipients, n.timezone)
+	if err != nil {
+		loggerFrom(ctx).Warn("error creating calendar invite", errField(err))
+	}
+
+	data, err := constructRawEmail(n.sender, recipients, msg, invite)
+	if err != nil {
+		return fmt.Errorf("error constructing email message: %v", err)
+	}
+
+	// Send email to recipients
+	output, err := SendRawEmail(ctx, n.api, n.sender, recipients, data)
+	if err != nil {
+		return fmt.Errorf("error sending SES notification: %v", err)
+	}
+
+	loggerFrom(ctx).Info("Email sent", field("messageId", aws.ToString(output.MessageId)), field("recipients", recipients))
+
+	return nil
+}
+
+// newNotifiers returns a notifier for every recipient configured for the
+// tenant.
+func (h *handler) newNotifiers(cfg *Config, templates Templates) []Notifier {
+	notifiers := []Notifier{}
+
+	if cfg.Sender != "" && cfg.Recipient != "" {
+		notifiers = append(notifiers, &emailNotifier{
+			templates: templates,
+			api:       h.sesClient,
+			sender:    cfg.Sender,
+			recipient: cfg.Recipient,
+			timezone:  cfg.Timezone,
+		})
+	}
+
+	for _, url := range cfg.SlackWebhooks {
+		notifiers = append(notifiers, &slackNotifier{
+			client:     h.httpClient,
+			webhookURL: url,
+		})
+	}
+
+	for _, phoneNumber := range cfg.PhoneNumbers {
+		notifiers = append(notifiers, &smsNotifier{
+			api:         h.snsClient,
+			phoneNumber: phoneNumber,
+		})
+	}
+
+	for _, url := range cfg.Webhooks {
+		notifiers = append(notifiers, &webhookNotifier{
+			client:  h.httpClient,
+			url:     url,
+			secret:  cfg.WebhookSecret,
+			backoff: webhookBackoff,
+		})
+	}
+
+	return notifiers
+}
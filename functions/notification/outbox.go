@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+
+	dbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const outboxSent = "sent"
+
+// OutboxEntry is the delivery state of a shift change recorded by the worker.
+// SentChannels holds the delivery IDs of the notifiers which already sent it.
+type OutboxEntry struct {
+	Tenant       string
+	ID           string
+	Status       string
+	SentChannels []string `dynamodbav:",stringset,omitempty"`
+}
+
+type DynamoDBGetItemAPI interface {
+	GetItem(ctx context.Context,
+		params *dynamodb.GetItemInput,
+		optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+}
+
+type DynamoDBUpdateItemAPI interface {
+	UpdateItem(ctx context.Context,
+		params *dynamodb.UpdateItemInput,
+		optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error)
+}
+
+type DynamoDBOutboxAPI interface {
+	DynamoDBGetItemAPI
+	DynamoDBUpdateItemAPI
+}
+
+// getOutboxEntry returns the outbox entry of a change, or nil if it does not
+// exist (anymore).
+func getOutboxEntry(ctx context.Context, api DynamoDBGetItemAPI, tableName string, tenant string, id string) (*OutboxEntry, error) {
+	output, err := api.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(tableName),
+		Key:            outboxKey(tenant, id),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error calling DynamoDB GetItem: %v", err)
+	}
+
+	if output.Item == nil {
+		return nil, nil
+	}
+
+	entry := OutboxEntry{}
+	if err := attributevalue.UnmarshalMap(output.Item, &entry); err != nil {
+		return nil, fmt.Errorf("error unmarshalling outbox entry: %v", err)
+	}
+
+	return &entry, nil
+}
+
+// markDelivered records that a notifier sent the change, so a redelivery of
+// the change skips it.
+func markDelivered(ctx context.Context, api DynamoDBUpdateItemAPI, tableName string, tenant string, id string, deliveryID string) error {
+	_, err := api.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(tableName),
+		Key:              outboxKey(tenant, id),
+		UpdateExpression: aws.String("ADD SentChannels :channel"),
+		ExpressionAttributeValues: map[string]dbtypes.AttributeValue{
+			":channel": &dbtypes.AttributeValueMemberSS{Value: []string{deliveryID}},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error calling DynamoDB UpdateItem: %v", err)
+	}
+
+	return nil
+}
+
+// markSent completes the outbox entry once every notifier sent the change. The
+// entry is removed from the worker's pending index.
+func markSent(ctx context.Context, api DynamoDBUpdateItemAPI, tableName string, tenant string, id string) error {
+	_, err := api.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(tableName),
+		Key:              outboxKey(tenant, id),
+		UpdateExpression: aws.String("SET #status = :sent REMOVE PendingAt"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "Status",
+		},
+		ExpressionAttributeValues: map[string]dbtypes.AttributeValue{
+			":sent": &dbtypes.AttributeValueMemberS{Value: outboxSent},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error calling DynamoDB UpdateItem: %v", err)
+	}
+
+	return nil
+}
+
+// deliveryID identifies a notifier by its channel and a hash of its
+// destination, e.g. "sms:5d41402abc4b", without storing phone numbers or
+// webhook URLs in the outbox.
+func deliveryID(n Notifier) string {
+	sum := sha256.Sum256([]byte(n.Destination()))
+	return n.Channel() + ":" + hex.EncodeToString(sum[:6])
+}
+
+func outboxKey(tenant string, id string) map[string]dbtypes.AttributeValue {
+	return map[string]dbtypes.AttributeValue{
+		"Tenant": &dbtypes.AttributeValueMemberS{Value: tenant},
+		"ID":     &dbtypes.AttributeValueMemberS{Value: id},
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// slackHeader returns the Slack message header of a shift state.
+func slackHeader(state string) string {
+	return map[string]string{
+		"created": "New shift added",
+		"updated": "Shift updated",
+		"removed": "Shift removed",
+	}[state]
+}
+
+// SlackMessage is an incoming webhook payload rendered with Block Kit.
+type SlackMessage struct {
+	Text   string       `json:"text"`
+	Blocks []SlackBlock `json:"blocks"`
+}
+
+type SlackBlock struct {
+	Type string     `json:"type"`
+	Text *SlackText `json:"text,omitempty"`
+}
+
+type SlackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// slackNotifier posts the rendered Block Kit message to a Slack incoming
+// webhook.
+type slackNotifier struct {
+	client     *http.Client
+	webhookURL string
+}
+
+func (n *slackNotifier) Channel() string {
+	return "slack"
+}
+
+func (n *slackNotifier) Destination() string {
+	return n.webhookURL
+}
+
+func (n *slackNotifier) Notify(ctx context.Context, item *Diff) error {
+	body, err := json.Marshal(constructSlackMessage(item))
+	if err != nil {
+		return fmt.Errorf("error marshalling Slack message: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating Slack webhook request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error calling Slack webhook: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected Slack webhook response %s: %s", resp.Status, msg)
+	}
+
+	loggerFrom(ctx).Info("Slack message sent")
+
+	return nil
+}
+
+// constructSlackMessage renders a shift change as Block Kit blocks with a
+// plain text fallback for notifications.
+func constructSlackMessage(item *Diff) (msg SlackMessage) {
+	shift := item.Shift
+
+	msg.Text = fmt.Sprintf("%s: %s", slackHeader(item.State), shift.Name)
+	msg.Blocks = append(msg.Blocks, SlackBlock{
+		Type: "header",
+		Text: &SlackText{Type: "plain_text", Text: slackHeader(item.State)},
+	})
+
+	msg.Blocks = append(msg.Blocks, SlackBlock{
+		Type: "section",
+		Text: &SlackText{
+			Type: "mrkdwn",
+			Text: fmt.Sprintf("*<%s%s|%s>*\n%s from %s", shiftURL, shift.ID, slackEscape(shift.Name),
+				slackEscape(shift.DisplayDate), slackEscape(shift.DisplayTime)),
+		},
+	})
+
+	lines := []string{}
+	for _, c := range item.Changes {
+		if label, ok := changeLabel(c.Field); ok {
+			lines = append(lines, fmt.Sprintf("• %s: %s → %s", label, slackEscape(c.Old), slackEscape(c.New)))
+		}
+	}
+
+	if len(lines) != 0 {
+		msg.Blocks = append(msg.Blocks, SlackBlock{
+			Type: "section",
+			Text: &SlackText{Type: "mrkdwn", Text: "*What changed*\n" + strings.Join(lines, "\n")},
+		})
+	}
+
+	return msg
+}
+
+// slackEscape escapes the control characters of Slack mrkdwn text.
+func slackEscape(text string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(text)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+const (
+	// Maximum length of a single SMS message with the GSM character set
+	smsMaxLength = 160
+	// Shortest shift name kept before the link is dropped from the message
+	smsMinNameLength = 12
+)
+
+// smsPrefix returns the SMS message prefix of a shift state.
+func smsPrefix(state string) string {
+	return map[string]string{
+		"created": "New shift",
+		"updated": "Shift updated",
+		"removed": "Shift removed",
+	}[state]
+}
+
+// smsNotifier sends a one-line summary of the shift change to a phone number
+// through SNS.
+type smsNotifier struct {
+	api         SNSPublishAPI
+	phoneNumber string
+}
+
+func (n *smsNotifier) Channel() string {
+	return "sms"
+}
+
+func (n *smsNotifier) Destination() string {
+	return n.phoneNumber
+}
+
+func (n *smsNotifier) Notify(ctx context.Context, item *Diff) error {
+	output, err := Publish(ctx, n.api, n.phoneNumber, constructSMS(item))
+	if err != nil {
+		return fmt.Errorf("error publishing SNS SMS message: %v", err)
+	}
+
+	loggerFrom(ctx).Info("SMS message sent", field("messageId", aws.ToString(output.MessageId)), field("phoneNumber", n.phoneNumber))
+
+	return nil
+}
+
+// constructSMS renders a shift change as a single SMS message. The shift name
+// is truncated first to fit the character budget, and the link is dropped if
+// the name would otherwise become too short to recognize.
+func constructSMS(item *Diff) string {
+	shift := item.Shift
+
+	prefix := smsPrefix(item.State) + ": "
+	details := strings.TrimRight(fmt.Sprintf(" %s %s", shift.DisplayDate, shift.DisplayTime), " ")
+	link := " " + shiftURL + shift.ID
+
+	room := smsMaxLength - runeLen(prefix) - runeLen(details) - runeLen(link)
+	if room < smsMinNameLength && runeLen(shift.Name) > room {
+		link = ""
+		room = smsMaxLength - runeLen(prefix) - runeLen(details)
+	}
+
+	msg := prefix + truncate(shift.Name, room) + details + link
+
+	return truncate(msg, smsMaxLength)
+}
+
+// truncate shortens text to at most length characters, marking the cut with
+// an ellipsis.
+func truncate(text string, length int) string {
+	runes := []rune(text)
+	if len(runes) <= length {
+		return text
+	}
+
+	if length <= 3 {
+		if length < 0 {
+			length = 0
+		}
+		return string(runes[:length])
+	}
+
+	return strings.TrimSpace(string(runes[:length-3])) + "..."
+}
+
+func runeLen(text string) int {
+	return len([]rune(text))
+}
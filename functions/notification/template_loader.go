@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const defaultTemplateCacheTTL = 15 * time.Minute
+
+type S3GetObjectAPI interface {
+	GetObject(ctx context.Context,
+		params *s3.GetObjectInput,
+		optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
+func GetObject(ctx context.Context, api S3GetObjectAPI, bucket string, key string) (*s3.GetObjectOutput, error) {
+	return api.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+}
+
+// templateLoader returns the template overrides by shift state. Parts that are
+// not set fall back to the built-in templates.
+type templateLoader func(ctx context.Context) (map[string]TemplateSource, error)
+
+// newTemplateLoader returns the loader of a template source, which is either
+// "s3://<bucket>/<prefix>" or "ssm:<path>". An empty source uses the built-in
+// templates only.
+func newTemplateLoader(source string, s3Client S3GetObjectAPI, ssmClient SSMGetParametersByPathAPI) (templateLoader, error) {
+	switch {
+	case source == "":
+		return nil, nil
+	case strings.HasPrefix(source, "s3://"):
+		u, err := url.Parse(source)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid S3 template source '%s'", source)
+		}
+		bucket, prefix := u.Host, strings.Trim(u.Path, "/")
+
+		return func(ctx context.Context) (map[string]TemplateSource, error) {
+			return loadS3Templates(ctx, s3Client, bucket, prefix)
+		}, nil
+	case strings.HasPrefix(source, "ssm:"):
+		paramPath := "/" + strings.Trim(strings.TrimPrefix(source, "ssm:"), "/")
+
+		return func(ctx context.Context) (map[string]TemplateSource, error) {
+			return loadSSMTemplates(ctx, ssmClient, paramPath)
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported template source '%s', expected s3://<bucket>/<prefix> or ssm:<path>", source)
+}
+
+// loadS3Templates reads "<prefix>/<state>/<part>.tmpl" objects for every
+// built-in state. Missing objects are skipped.
+func loadS3Templates(ctx context.Context, api S3GetObjectAPI, bucket string, prefix string) (map[string]TemplateSource, error) {
+	sources := map[string]TemplateSource{}
+
+	for state := range builtinTemplates() {
+		src := TemplateSource{}
+
+		for _, part := range []string{"subject", "text", "html"} {
+			key := path.Join(prefix, state, part+".tmpl")
+
+			output, err := GetObject(ctx, api, bucket, key)
+			if err != nil {
+				var noSuchKey *s3types.NoSuchKey
+				if errors.As(err, &noSuchKey) {
+					continue
+				}
+				return nil, fmt.Errorf("error reading template s3://%s/%s: %v", bucket, key, err)
+			}
+
+			body, err := io.ReadAll(output.Body)
+			output.Body.Close()
+			if err != nil {
+				return nil, fmt.Errorf("error reading template s3://%s/%s: %v", bucket, key, err)
+			}
+
+			setTemplatePart(&src, part, string(body))
+		}
+
+		if src != (TemplateSource{}) {
+			sources[state] = src
+		}
+	}
+
+	return sources, nil
+}
+
+// loadSSMTemplates reads "<path>/<state>/<part>" parameters.
+func loadSSMTemplates(ctx context.Context, api SSMGetParametersByPathAPI, paramPath string) (map[string]TemplateSource, error) {
+	sources := map[string]TemplateSource{}
+
+	p := ssm.NewGetParametersByPathPaginator(api, &ssm.GetParametersByPathInput{
+		Path:           aws.String(paramPath),
+		Recursive:      true,
+		WithDecryption: true,
+	})
+
+	for p.HasMorePages() {
+		output, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error reading templates from SSM parameter store: %v", err)
+		}
+
+		for _, param := range output.Parameters {
+			state, part := path.Split(strings.TrimPrefix(*param.Name, paramPath+"/"))
+			state = strings.Trim(state, "/")
+			if strings.Contains(state, "/") {
+				continue
+			}
+
+			src := sources[state]
+			if setTemplatePart(&src, part, *param.Value) {
+				sources[state] = src
+			}
+		}
+	}
+
+	return sources, nil
+}
+
+func setTemplatePart(src *TemplateSource, part string, value string) bool {
+	switch part {
+	case "subject":
+		src.Subject = value
+	case "text":
+		src.Text = value
+	case "html":
+		src.HTML = value
+	default:
+		return false
+	}
+
+	return true
+}
+
+// buildTemplates merges the overrides over the built-in templates. A state
+// whose overrides fail to parse or render keeps its built-in templates, so a
+// bad edit cannot stop notifications from being sent.
+func buildTemplates(ctx context.Context, builtin Templates, overrides map[string]TemplateSource) Templates {
+	templates := Templates{}
+	for state, tmpl := range builtin {
+		templates[state] = tmpl
+	}
+
+	states := make([]string, 0, len(overrides))
+	for state := range overrides {
+		states = append(states, state)
+	}
+	sort.Strings(states)
+
+	for _, state := range states {
+		src, ok := builtinTemplates()[state]
+		if !ok {
+			loggerFrom(ctx).Warn("Ignoring templates for unknown state", field("state", state))
+			continue
+		}
+
+		override := overrides[state]
+		if override.Subject != "" {
+			src.Subject = override.Subject
+		}
+		if override.Text != "" {
+			src.Text = override.Text
+		}
+		if override.HTML != "" {
+			src.HTML = override.HTML
+		}
+
+		tmpl, err := parseTemplate(state, src)
+		if err != nil {
+			loggerFrom(ctx).Warn("Using built-in templates", field("state", state), errField(err))
+			continue
+		}
+
+		templates[state] = tmpl
+	}
+
+	return templates
+}
+
+// templateCache holds the loaded templates and reloads them once they are
+// older than the TTL. When a reload fails the previous templates are kept.
+type templateCache struct {
+	mu       sync.Mutex
+	load     templateLoader
+	ttl      time.Duration
+	builtin  Templates
+	current  Templates
+	loadedAt time.Time
+}
+
+func newTemplateCache(builtin Templates, load templateLoader, ttl time.Duration) *templateCache {
+	return &templateCache{
+		load:    load,
+		ttl:     ttl,
+		builtin: builtin,
+		current: builtin,
+	}
+}
+
+// Get returns the current templates, reloading them if they have expired.
+func (c *templateCache) Get(ctx context.Context) Templates {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.load == nil || (!c.loadedAt.IsZero() && time.Since(c.loadedAt) < c.ttl) {
+		return c.current
+	}
+
+	overrides, err := c.load(ctx)
+	if err != nil {
+		loggerFrom(ctx).Error("error loading message templates, using previous templates", errField(err))
+	} else {
+		c.current = buildTemplates(ctx, c.builtin, overrides)
+	}
+
+	// Also wait for the TTL after a failure instead of retrying every request
+	c.loadedAt = time.Now()
+
+	return c.current
+}
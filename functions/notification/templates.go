@@ -1,43 +1,134 @@
 package main
 
-func generateTemplate(state string) Message {
-	tmpl := map[string]Message{
-		"created": Message{
-			Subject: "New shift added: %s",
-			// Text template for new shifts
-			TextBody: `Greetings,
+import (
+	"bytes"
+	"fmt"
+	"sort"
 
-New shift added for '%s' starting on %s from %s.
+	"github.com/edevenport/shiftboard-sdk-go"
 
-https://m.shiftboard.com/onlocationexp/schedules/shifts/%s
+	htmltemplate "html/template"
+	texttemplate "text/template"
+)
+
+const (
+	shiftURL    = "https://m.shiftboard.com/onlocationexp/schedules/shifts/"
+	scheduleURL = "https://m.shiftboard.com/onlocationexp/schedules/shifts"
+)
+
+// changeLabel returns the display label of a changed field rendered in update
+// notifications. The raw StartDate and EndDate values are already covered by
+// the display fields.
+func changeLabel(field string) (string, bool) {
+	label, ok := map[string]string{
+		"Name":        "Name",
+		"DisplayDate": "Date",
+		"DisplayTime": "Time",
+	}[field]
+
+	return label, ok
+}
+
+// TemplateSource holds the unparsed subject, text and HTML templates of a
+// shift state.
+type TemplateSource struct {
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// MessageTemplate holds the parsed templates of a shift state. The HTML body
+// is rendered with html/template so shift values are escaped.
+type MessageTemplate struct {
+	Subject *texttemplate.Template
+	Text    *texttemplate.Template
+	HTML    *htmltemplate.Template
+}
+
+// Templates maps shift states to their message templates.
+type Templates map[string]*MessageTemplate
+
+// View is the model the message templates are rendered against.
+type View struct {
+	State     string
+	Shift     shiftboard.Shift
+	Changes   []ChangeView
+	Links     Links
+	Recipient string
+}
+
+type ChangeView struct {
+	Label string
+	Old   string
+	New   string
+}
+
+type Links struct {
+	Shift    string
+	Schedule string
+}
+
+// builtinTemplates returns the built-in message templates by shift state.
+func builtinTemplates() map[string]TemplateSource {
+	return map[string]TemplateSource{
+		"created": {
+			Subject: `New shift added: {{.Shift.Name}}`,
+			Text: `Greetings,
+
+New shift added for '{{.Shift.Name}}' starting on {{.Shift.DisplayDate}} from {{.Shift.DisplayTime}}.
+
+{{.Links.Shift}}
 
 Thank you,
 ShiftBoard Bot`,
-			// HTML template for new shifts
-			HtmlBody: `Greetings,
+			HTML: `Greetings,
 <p>
-New shift added for <a href='https://m.shiftboard.com/onlocationexp/schedules/shifts/%s'>%s</a> starting on <a href='https://m.shiftboard.com/onlocationexp/schedules/shifts'>%s from %s</a>.
+New shift added for <a href='{{.Links.Shift}}'>{{.Shift.Name}}</a> starting on <a href='{{.Links.Schedule}}'>{{.Shift.DisplayDate}} from {{.Shift.DisplayTime}}</a>.
 </p>
 <p>
 Thank you,<br>
 ShiftBoard Bot
 </p>`,
 		},
-		"updated": Message{
-			Subject: "Shift updated: %s",
-			// Text template for updated shifts
-			TextBody: `Greetings,
+		"updated": {
+			Subject: `Shift updated: {{.Shift.Name}}`,
+			Text: `Greetings,
 
-The '%s' shift has been updated. The current start date and time is %s from %s.
+The '{{.Shift.Name}}' shift has been updated. The current start date and time is {{.Shift.DisplayDate}} from {{.Shift.DisplayTime}}.
+{{if .Changes}}
+What changed:
+{{range .Changes}}- {{.Label}}: {{.Old}} → {{.New}}
+{{end}}{{end}}
+{{.Links.Shift}}
 
-https://m.shiftboard.com/onlocationexp/schedules/shifts/%s\n
+Thank you,
+ShiftBoard Bot`,
+			HTML: `Greetings,
+<p>
+The <a href='{{.Links.Shift}}'>{{.Shift.Name}}</a> shift has been updated. The current start date is <a href='{{.Links.Schedule}}'>{{.Shift.DisplayDate}} from {{.Shift.DisplayTime}}</a>.
+</p>
+{{if .Changes}}<p>What changed:</p>
+<ul>
+{{range .Changes}}<li>{{.Label}}: {{.Old}} &rarr; {{.New}}</li>
+{{end}}</ul>
+{{end}}<p>
+Thank you,<br>
+ShiftBoard Bot
+</p>`,
+		},
+		"removed": {
+			Subject: `Shift removed: {{.Shift.Name}}`,
+			Text: `Greetings,
+
+The '{{.Shift.Name}}' shift on {{.Shift.DisplayDate}} from {{.Shift.DisplayTime}} has been cancelled or removed from ShiftBoard.
+
+{{.Links.Shift}}
 
 Thank you,
 ShiftBoard Bot`,
-			// HTML template for updated shifts
-			HtmlBody: `Greetings,
+			HTML: `Greetings,
 <p>
-The <a href='https://m.shiftboard.com/onlocationexp/schedules/shifts/%s'>%s</a> shift has been updated. The current start date is <a href='https://m.shiftboard.com/onlocationexp/schedules/shifts'>%s from %s</a>.
+The <a href='{{.Links.Shift}}'>{{.Shift.Name}}</a> shift on <a href='{{.Links.Schedule}}'>{{.Shift.DisplayDate}} from {{.Shift.DisplayTime}}</a> has been cancelled or removed from ShiftBoard.
 </p>
 <p>
 Thank you,<br>
@@ -45,6 +136,115 @@ ShiftBoard Bot
 </p>`,
 		},
 	}
+}
+
+// parseTemplates parses the template sources of every state and renders them
+// against a sample view, so that syntax errors and unknown fields are reported
+// when the function starts instead of producing broken messages.
+func parseTemplates(sources map[string]TemplateSource) (Templates, error) {
+	templates := Templates{}
+
+	states := make([]string, 0, len(sources))
+	for state := range sources {
+		states = append(states, state)
+	}
+	sort.Strings(states)
 
-	return tmpl[state]
+	for _, state := range states {
+		tmpl, err := parseTemplate(state, sources[state])
+		if err != nil {
+			return nil, err
+		}
+
+		templates[state] = tmpl
+	}
+
+	return templates, nil
+}
+
+func parseTemplate(state string, src TemplateSource) (*MessageTemplate, error) {
+	tmpl := &MessageTemplate{}
+
+	var err error
+	if tmpl.Subject, err = texttemplate.New(state + "/subject").Parse(src.Subject); err != nil {
+		return nil, fmt.Errorf("error parsing subject template for '%s': %v", state, err)
+	}
+	if tmpl.Text, err = texttemplate.New(state + "/text").Parse(src.Text); err != nil {
+		return nil, fmt.Errorf("error parsing text template for '%s': %v", state, err)
+	}
+	if tmpl.HTML, err = htmltemplate.New(state + "/html").Parse(src.HTML); err != nil {
+		return nil, fmt.Errorf("error parsing HTML template for '%s': %v", state, err)
+	}
+
+	if _, err := tmpl.render(sampleView(state)); err != nil {
+		return nil, fmt.Errorf("error validating templates for '%s': %v", state, err)
+	}
+
+	return tmpl, nil
+}
+
+// constructMessage renders the email message of a shift change.
+func (t Templates) constructMessage(item *Diff, recipient string) (Message, error) {
+	tmpl, ok := t[item.State]
+	if !ok {
+		return Message{}, fmt.Errorf("no message template for state '%s'", item.State)
+	}
+
+	return tmpl.render(newView(item, recipient))
+}
+
+func (t *MessageTemplate) render(view View) (msg Message, err error) {
+	var buf bytes.Buffer
+
+	if err = t.Subject.Execute(&buf, view); err != nil {
+		return msg, err
+	}
+	msg.Subject = buf.String()
+
+	buf.Reset()
+	if err = t.Text.Execute(&buf, view); err != nil {
+		return msg, err
+	}
+	msg.TextBody = buf.String()
+
+	buf.Reset()
+	if err = t.HTML.Execute(&buf, view); err != nil {
+		return msg, err
+	}
+	msg.HtmlBody = buf.String()
+
+	return msg, nil
+}
+
+func newView(item *Diff, recipient string) View {
+	view := View{
+		State: item.State,
+		Shift: item.Shift,
+		Links: Links{
+			Shift:    shiftURL + item.Shift.ID,
+			Schedule: scheduleURL,
+		},
+		Recipient: recipient,
+	}
+
+	for _, c := range item.Changes {
+		if label, ok := changeLabel(c.Field); ok {
+			view.Changes = append(view.Changes, ChangeView{Label: label, Old: c.Old, New: c.New})
+		}
+	}
+
+	return view
+}
+
+func sampleView(state string) View {
+	return newView(&Diff{
+		State: state,
+		Shift: shiftboard.Shift{
+			ID:          "123456789",
+			Name:        "Sample Shift",
+			DisplayDate: "Wed Jun 15",
+			DisplayTime: "9:00am - 1:00pm",
+		},
+		Changes: []Change{{Field: "DisplayTime", Old: "8:00am - 12:00pm", New: "9:00am - 1:00pm"}},
+	}, "user@example.com")
 }
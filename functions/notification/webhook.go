@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/edevenport/shiftboard-sdk-go"
+)
+
+const (
+	webhookVersion     = "1"
+	webhookMaxAttempts = 3
+	webhookBackoff     = 500 * time.Millisecond
+
+	webhookDeliveryHeader  = "X-ShiftBoard-Bot-Delivery"
+	webhookSignatureHeader = "X-ShiftBoard-Bot-Signature"
+	webhookTimestampHeader = "X-ShiftBoard-Bot-Timestamp"
+)
+
+// WebhookEvent is the versioned JSON document posted to webhook endpoints.
+type WebhookEvent struct {
+	Version string           `json:"version"`
+	Event   string           `json:"event"`
+	Tenant  string           `json:"tenant,omitempty"`
+	Shift   shiftboard.Shift `json:"shift"`
+	Changes []WebhookChange  `json:"changes,omitempty"`
+}
+
+type WebhookChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+// webhookNotifier posts the shift change to an HTTPS endpoint, signed with an
+// HMAC-SHA256 of the timestamp and body. Server errors are retried with
+// exponential backoff.
+type webhookNotifier struct {
+	client  *http.Client
+	url     string
+	secret  string
+	backoff time.Duration
+}
+
+func (n *webhookNotifier) Channel() string {
+	return "webhook"
+}
+
+func (n *webhookNotifier) Destination() string {
+	return n.url
+}
+
+func (n *webhookNotifier) Notify(ctx context.Context, item *Diff) error {
+	endpoint, err := url.Parse(n.url)
+	if err != nil || endpoint.Scheme != "https" {
+		return fmt.Errorf("invalid webhook URL, expected an HTTPS endpoint")
+	}
+
+	if n.secret == "" {
+		return fmt.Errorf("missing webhook signing secret")
+	}
+
+	body, err := json.Marshal(constructWebhookEvent(item))
+	if err != nil {
+		return fmt.Errorf("error marshalling webhook event: %v", err)
+	}
+
+	id := webhookDeliveryID(item, n, body)
+
+	backoff := n.backoff
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		status, err := n.post(ctx, id, body)
+
+		// Delivery log
+		loggerFrom(ctx).Info("Webhook delivery attempt",
+			field("deliveryId", id), field("attempt", attempt), field("host", endpoint.Host),
+			field("status", status), errField(err), durationField(start))
+
+		if err == nil && status >= 200 && status < 300 {
+			return nil
+		}
+
+		retryable := err != nil || status >= 500
+		if !retryable || attempt == webhookMaxAttempts {
+			if err != nil {
+				return fmt.Errorf("error delivering webhook after %d attempts: %v", attempt, err)
+			}
+			return fmt.Errorf("error delivering webhook after %d attempts: status %d", attempt, status)
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return fmt.Errorf("error delivering webhook: %v", ctx.Err())
+		}
+		backoff *= 2
+	}
+}
+
+// post sends a single signed delivery attempt and returns the response status.
+func (n *webhookNotifier) post(ctx context.Context, deliveryID string, body []byte) (int, error) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "shiftboard-bot-webhook/"+webhookVersion)
+	req.Header.Set(webhookDeliveryHeader, deliveryID)
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	req.Header.Set(webhookSignatureHeader, "sha256="+signWebhook(n.secret, timestamp, body))
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	// Drain the body so the connection can be reused by retries
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	return resp.StatusCode, nil
+}
+
+func constructWebhookEvent(item *Diff) WebhookEvent {
+	event := WebhookEvent{
+		Version: webhookVersion,
+		Event:   "shift." + item.State,
+		Tenant:  item.Tenant,
+		Shift:   item.Shift,
+	}
+
+	for _, c := range item.Changes {
+		event.Changes = append(event.Changes, WebhookChange{Field: c.Field, Old: c.Old, New: c.New})
+	}
+
+	return event
+}
+
+// signWebhook returns the hex encoded HMAC-SHA256 of "<timestamp>.<body>".
+// Receivers recompute it with the shared secret and should reject deliveries
+// with old timestamps.
+func signWebhook(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookDeliveryID identifies the delivery of a change to the endpoint. It is
+// derived from the change's outbox entry and the notifier, so redeliveries of
+// the change carry the same ID. Changes sent without an outbox entry are
+// identified by their body instead.
+func webhookDeliveryID(item *Diff, n Notifier, body []byte) string {
+	source := string(body)
+	if item.OutboxID != "" {
+		source = item.Tenant + "#" + item.OutboxID
+	}
+
+	sum := sha256.Sum256([]byte(source + "#" + deliveryID(n)))
+	return hex.EncodeToString(sum[:16])
+}
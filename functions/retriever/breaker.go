@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+
+	dbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	// The breaker is stored in the cache table. It has no tenant or start
+	// date, so it is not part of the index the cache is read from.
+	breakerKey    = "circuit#shiftboard"
+	breakerClosed = "closed"
+	breakerOpen   = "open"
+
+	defaultBreakerThreshold  = 3
+	defaultBreakerCooldown   = 2 * time.Hour
+	defaultBreakerAlertAfter = 6 * time.Hour
+
+	// Time to save the breaker and send its alert once the run's deadline has
+	// been reached, within the deadline margin
+	breakerSaveTimeout = 1500 * time.Millisecond
+)
+
+// BreakerState is the state of the ShiftBoard API circuit breaker, kept
+// between invocations. OpenedAt is the start of the outage, RetryAt the time
+// after which a run tries the API again.
+type BreakerState struct {
+	Key       string
+	State     string
+	Failures  int
+	OpenedAt  int64 `dynamodbav:",omitempty"`
+	RetryAt   int64 `dynamodbav:",omitempty"`
+	AlertedAt int64 `dynamodbav:",omitempty"`
+}
+
+// BreakerConfig configures when the breaker opens, for how long, and when an
+// open breaker is reported to the admins.
+type BreakerConfig struct {
+	Threshold  int
+	Cooldown   time.Duration
+	AlertAfter time.Duration
+}
+
+// circuitOpenError is returned instead of calling the API while the breaker
+// is open.
+type circuitOpenError struct {
+	retryAt time.Time
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("ShiftBoard API circuit is open until %s", e.retryAt.UTC().Format(time.RFC3339))
+}
+
+// breaker counts consecutive failed API calls. It opens once they reach the
+// threshold and stays open for the cooldown, after which a single call is let
+// through: the breaker closes if it succeeds and opens again otherwise.
+type breaker struct {
+	config    BreakerConfig
+	state     BreakerState
+	changed   bool
+	recovered bool
+}
+
+func newBreaker(config BreakerConfig, state BreakerState) *breaker {
+	if state.State == "" {
+		state.State = breakerClosed
+	}
+	state.Key = breakerKey
+
+	return &breaker{config: config, state: state}
+}
+
+func (b *breaker) allow(now time.Time) error {
+	if b.state.State == breakerOpen && now.Unix() < b.state.RetryAt {
+		return &circuitOpenError{retryAt: time.Unix(b.state.RetryAt, 0)}
+	}
+
+	return nil
+}
+
+func (b *breaker) success() {
+	if b.state.State == breakerClosed && b.state.Failures == 0 {
+		return
+	}
+
+	b.recovered = b.state.AlertedAt != 0
+	b.state = BreakerState{Key: breakerKey, State: breakerClosed}
+	b.changed = true
+}
+
+func (b *breaker) failure(now time.Time) {
+	b.state.Failures++
+	b.changed = true
+
+	// A failed call after the cooldown opens the breaker again right away
+	if b.state.State != breakerOpen && b.state.Failures < b.config.Threshold {
+		return
+	}
+
+	b.state.State = breakerOpen
+	b.state.RetryAt = now.Add(b.config.Cooldown).Unix()
+	if b.state.OpenedAt == 0 {
+		b.state.OpenedAt = now.Unix()
+	}
+}
+
+// isOpen reports whether calls are currently rejected.
+func (b *breaker) isOpen(now time.Time) bool {
+	return b.allow(now) != nil
+}
+
+type DynamoDBGetItemAPI interface {
+	GetItem(ctx context.Context,
+		params *dynamodb.GetItemInput,
+		optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+}
+
+type DynamoDBPutItemAPI interface {
+	PutItem(ctx context.Context,
+		params *dynamodb.PutItemInput,
+		optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+}
+
+type DynamoDBBreakerAPI interface {
+	DynamoDBGetItemAPI
+	DynamoDBPutItemAPI
+}
+
+type SNSPublishAPI interface {
+	Publish(ctx context.Context,
+		params *sns.PublishInput,
+		optFns ...func(*sns.Options)) (*sns.PublishOutput, error)
+}
+
+// loadBreaker reads the breaker state of the previous runs. The breaker is
+// not kept between invocations when no table is configured.
+func (h handler) loadBreaker(ctx context.Context) (*breaker, error) {
+	if h.tableName == "" {
+		return newBreaker(h.breaker, BreakerState{}), nil
+	}
+
+	output, err := h.dbClient.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(h.tableName),
+		Key:            map[string]dbtypes.AttributeValue{"Key": &dbtypes.AttributeValueMemberS{Value: breakerKey}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error calling DynamoDB GetItem: %v", err)
+	}
+
+	state := BreakerState{}
+	if err := attributevalue.UnmarshalMap(output.Item, &state); err != nil {
+		return nil, fmt.Errorf("error unmarshalling breaker state: %v", err)
+	}
+
+	return newBreaker(h.breaker, state), nil
+}
+
+// saveBreaker alerts the admins of a long outage or its recovery and stores
+// the breaker state if it changed during the run.
+func (h handler) saveBreaker(ctx context.Context, b *breaker, now time.Time) error {
+	if err := h.alertBreaker(ctx, b, now); err != nil {
+		loggerFrom(ctx).Error("error sending circuit breaker alert", errField(err))
+	}
+
+	if !b.changed || h.tableName == "" {
+		return nil
+	}
+
+	av, err := attributevalue.MarshalMap(b.state)
+	if err != nil {
+		return fmt.Errorf("error marshalling breaker state: %v", err)
+	}
+
+	if _, err := h.dbClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(h.tableName),
+		Item:      av,
+	}); err != nil {
+		return fmt.Errorf("error calling DynamoDB PutItem: %v", err)
+	}
+
+	return nil
+}
+
+// alertBreaker publishes an alert once the breaker has been open for longer
+// than the alert period, and again when the API recovers from that outage.
+func (h handler) alertBreaker(ctx context.Context, b *breaker, now time.Time) error {
+	var subject, message string
+
+	switch {
+	case b.recovered:
+		subject = "ShiftBoard API recovered"
+		message = "The ShiftBoard API is available again, shifts are retrieved by the next runs."
+		b.recovered = false
+	case b.state.State == breakerOpen && b.state.AlertedAt == 0 &&
+		now.Sub(time.Unix(b.state.OpenedAt, 0)) >= h.breaker.AlertAfter:
+		subject = "ShiftBoard API unavailable"
+		message = fmt.Sprintf("Shifts could not be retrieved from the ShiftBoard API since %s. "+
+			"The next attempt is at %s, no changes are notified until then.",
+			time.Unix(b.state.OpenedAt, 0).UTC().Format(time.RFC3339), time.Unix(b.state.RetryAt, 0).UTC().Format(time.RFC3339))
+		b.state.AlertedAt = now.Unix()
+		b.changed = true
+	default:
+		return nil
+	}
+
+	if h.alertTopic == "" {
+		loggerFrom(ctx).Warn(subject, field("alert", "no alert topic configured"))
+		return nil
+	}
+
+	if _, err := h.snsClient.Publish(ctx, &sns.PublishInput{
+		TopicArn: aws.String(h.alertTopic),
+		Subject:  aws.String(subject),
+		Message:  aws.String(message),
+	}); err != nil {
+		return fmt.Errorf("error publishing SNS alert: %v", err)
+	}
+
+	loggerFrom(ctx).Info("Sent circuit breaker alert", field("subject", subject))
+
+	return nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/edevenport/shiftboard-sdk-go"
+)
+
+const (
+	defaultAPITimeout = 15 * time.Second
+	apiRetryAttempts  = 3
+	apiRetryBase      = 500 * time.Millisecond
+	apiRetryMax       = 5 * time.Second
+)
+
+// retryPolicy configures the attempts and exponential backoff of API calls.
+type retryPolicy struct {
+	attempts int
+	base     time.Duration
+	max      time.Duration
+}
+
+func apiRetryPolicy() retryPolicy {
+	return retryPolicy{attempts: apiRetryAttempts, base: apiRetryBase, max: apiRetryMax}
+}
+
+// apiClient wraps the ShiftBoard client with a timeout per call, retries of
+// transient errors and the circuit breaker of the API.
+type apiClient struct {
+	client    *shiftboard.Client
+	transport *contextTransport
+	timeout   time.Duration
+	retry     retryPolicy
+	breaker   *breaker
+}
+
+func newAPIClient(ctx context.Context, user User, timeout time.Duration, retry retryPolicy, b *breaker) *apiClient {
+	client := shiftboard.NewClient(user.Email, user.Password)
+
+	// The ShiftBoard SDK does not take a context, cancel its requests instead
+	transport := &contextTransport{ctx: ctx, base: http.DefaultTransport}
+	client.HTTPClient.Transport = transport
+
+	return &apiClient{client: client, transport: transport, timeout: timeout, retry: retry, breaker: b}
+}
+
+func (c *apiClient) ListSites(ctx context.Context) (*shiftboard.Response, error) {
+	return c.call(ctx, "ListSites", c.client.ListSites)
+}
+
+func (c *apiClient) Login(ctx context.Context, orgID string) (*shiftboard.Response, error) {
+	return c.call(ctx, "Login", func() (*shiftboard.Response, error) {
+		// Clear the access token of any previously selected organization
+		c.client.Auth.AccessToken = ""
+		return c.client.Login(orgID)
+	})
+}
+
+func (c *apiClient) ListShifts(ctx context.Context, startDate string, endDate string) (*shiftboard.Response, error) {
+	return c.call(ctx, "ListShifts", func() (*shiftboard.Response, error) {
+		return c.client.ListShifts(startDate, endDate)
+	})
+}
+
+// useLogin selects the organization of a cached login for the next calls.
+func (c *apiClient) useLogin(login CachedLogin) {
+	c.client.Auth.AccessToken = login.AccessToken
+	c.client.Cookies = nil
+	for _, cookie := range login.Cookies {
+		c.client.Cookies = append(c.client.Cookies, &http.Cookie{Name: cookie.Name, Value: cookie.Value})
+	}
+}
+
+// currentLogin returns the login of the selected organization to cache it.
+func (c *apiClient) currentLogin(expiresAt time.Time) CachedLogin {
+	login := CachedLogin{AccessToken: c.client.Auth.AccessToken, ExpiresAt: expiresAt.Unix()}
+	for _, cookie := range c.client.Cookies {
+		login.Cookies = append(login.Cookies, CachedCookie{Name: cookie.Name, Value: cookie.Value})
+	}
+
+	return login
+}
+
+// authFailed reports whether the last call was rejected as unauthorized, e.g.
+// with an expired access token.
+func (c *apiClient) authFailed() bool {
+	return c.transport.status == http.StatusUnauthorized || c.transport.status == http.StatusForbidden
+}
+
+// call calls the API until it succeeds, fails with a permanent error or the
+// attempts are exhausted. Calls which failed every attempt count against the
+// circuit breaker, and no calls are made while it is open.
+func (c *apiClient) call(ctx context.Context, name string, fn func() (*shiftboard.Response, error)) (*shiftboard.Response, error) {
+	if err := c.breaker.allow(time.Now()); err != nil {
+		return nil, err
+	}
+
+	// Every response replaces the cookies, retries send the original ones
+	cookies := c.client.Cookies
+
+	for attempt := 1; ; attempt++ {
+		c.client.Cookies = cookies
+		c.transport.status = 0
+
+		start := time.Now()
+		callCtx, cancel := context.WithTimeout(ctx, c.timeout)
+		c.transport.ctx = callCtx
+		resp, err := fn()
+		c.transport.ctx = ctx
+		cancel()
+
+		if err == nil {
+			c.breaker.success()
+			return resp, nil
+		}
+
+		status := c.transport.status
+		if ctx.Err() != nil {
+			// An API which hangs until the deadline of every run still opens
+			// the breaker
+			if isTransient(status) {
+				c.breaker.failure(time.Now())
+			}
+			return nil, err
+		}
+
+		// A permanent error, e.g. invalid credentials, is an answer of an
+		// available API
+		if !isTransient(status) {
+			c.breaker.success()
+			return nil, err
+		}
+
+		loggerFrom(ctx).Warn("ShiftBoard API call failed", field("call", name), field("attempt", attempt),
+			field("status", status), errField(err), durationField(start))
+
+		if attempt >= c.retry.attempts {
+			c.breaker.failure(time.Now())
+			return nil, fmt.Errorf("%v (after %d attempts)", err, attempt)
+		}
+
+		delay := backoff(c.retry, attempt-1)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			c.breaker.failure(time.Now())
+			return nil, fmt.Errorf("%v (deadline reached after %d attempts)", err, attempt)
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			c.breaker.failure(time.Now())
+			return nil, err
+		}
+	}
+}
+
+// retryBudget returns the longest time a call takes when every attempt times
+// out and waits for the longest backoff.
+func retryBudget(timeout time.Duration, policy retryPolicy) time.Duration {
+	budget := time.Duration(policy.attempts) * timeout
+	for attempt := 0; attempt < policy.attempts-1; attempt++ {
+		limit := policy.max
+		if attempt < 30 && policy.base<<attempt < policy.max {
+			limit = policy.base << attempt
+		}
+		budget += limit
+	}
+
+	return budget
+}
+
+// isTransient reports whether a failed call may succeed when retried: the
+// request failed or timed out without a response (status 0), was throttled or
+// failed with a server error. The SDK does not return the status, it is
+// recorded by the transport.
+func isTransient(status int) bool {
+	return status == 0 || status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+}
+
+// backoff returns a random delay up to the exponentially growing cap of the
+// attempt ("full jitter").
+func backoff(policy retryPolicy, attempt int) time.Duration {
+	limit := policy.max
+	if attempt < 30 && policy.base<<attempt < policy.max {
+		limit = policy.base << attempt
+	}
+
+	if limit <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(limit))) + 1
+}
+
+// contextTransport sends HTTP requests with the context of the current call,
+// so they are cancelled when it is done, and records the status of the last
+// response.
+type contextTransport struct {
+	ctx    context.Context
+	base   http.RoundTripper
+	status int
+}
+
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req.WithContext(t.ctx))
+	if resp != nil {
+		t.status = resp.StatusCode
+	}
+
+	return resp, err
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+const (
+	// Secrets Manager secrets are read through their SSM parameter reference,
+	// which needs no client of its own
+	secretReferencePath   = "/aws/reference/secretsmanager/"
+	defaultCredentialsTTL = 5 * time.Minute
+)
+
+// Credentials are the ShiftBoard credentials of the default user.
+type Credentials struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// validate returns an error naming the values missing from the source.
+func (c Credentials) validate(source string) error {
+	missing := []string{}
+	if c.Email == "" {
+		missing = append(missing, "email")
+	}
+	if c.Password == "" {
+		missing = append(missing, "password")
+	}
+
+	if len(missing) != 0 {
+		return fmt.Errorf("missing %s in %s", strings.Join(missing, " and "), source)
+	}
+
+	return nil
+}
+
+// CredentialsProvider reads the ShiftBoard credentials of the default user.
+type CredentialsProvider interface {
+	Credentials(ctx context.Context) (Credentials, error)
+}
+
+// ssmCredentials reads the credentials from the 'email' and 'password'
+// parameters below a path.
+type ssmCredentials struct {
+	api  SSMGetParametersByPathAPI
+	path string
+}
+
+func (p ssmCredentials) Credentials(ctx context.Context) (Credentials, error) {
+	output, err := GetParametersByPath(ctx, p.api, p.path, true)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("error reading AWS parameter store: %v", err)
+	}
+
+	loggerFrom(ctx).Debug("Read API parameters", field("path", p.path), field("count", len(output.Parameters)))
+
+	return parseParameters(output, p.path)
+}
+
+// secretCredentials reads the credentials from a Secrets Manager secret with
+// a JSON object of 'email' and 'password'. The secret is read through the SSM
+// parameter store, so a missing or inaccessible secret fails with an SSM
+// ParameterNotFound or AccessDeniedException error rather than a Secrets
+// Manager one.
+type secretCredentials struct {
+	api      SSMGetParameterAPI
+	secretID string
+}
+
+func (p secretCredentials) Credentials(ctx context.Context) (Credentials, error) {
+	name := secretReferencePath + p.secretID
+	output, err := p.api.GetParameter(ctx, &ssm.GetParameterInput{
+		Name:           aws.String(name),
+		WithDecryption: true,
+	})
+	if err != nil {
+		return Credentials{}, fmt.Errorf("error reading secret '%s' through SSM parameter '%s': %v", p.secretID, name, err)
+	}
+
+	loggerFrom(ctx).Debug("Read API secret", field("secret", p.secretID))
+
+	creds := Credentials{}
+	if err := json.Unmarshal([]byte(aws.ToString(output.Parameter.Value)), &creds); err != nil {
+		return Credentials{}, fmt.Errorf("error parsing secret '%s', expected a JSON object with email and password: %v", p.secretID, err)
+	}
+
+	if err := creds.validate(fmt.Sprintf("secret '%s'", p.secretID)); err != nil {
+		return Credentials{}, err
+	}
+
+	return creds, nil
+}
+
+// validateSecretID returns an error if the secret is not given by its name.
+// The IAM policy of the retriever only grants access to the secret by name.
+func validateSecretID(secretID string) error {
+	if strings.HasPrefix(secretID, "arn:") {
+		return fmt.Errorf("secret '%s' must be given by its name, not its ARN", secretID)
+	}
+
+	return nil
+}
+
+// cachedCredentials keeps the credentials of a provider between warm
+// invocations. They are read again after the TTL, so rotated credentials are
+// picked up without a redeploy, or right away once they were rejected.
+type cachedCredentials struct {
+	provider CredentialsProvider
+	ttl      time.Duration
+
+	mu          sync.Mutex
+	credentials Credentials
+	expiresAt   time.Time
+}
+
+func newCachedCredentials(provider CredentialsProvider, ttl time.Duration) *cachedCredentials {
+	return &cachedCredentials{provider: provider, ttl: ttl}
+}
+
+func (c *cachedCredentials) Credentials(ctx context.Context) (Credentials, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if now.Before(c.expiresAt) {
+		return c.credentials, nil
+	}
+
+	creds, err := c.provider.Credentials(ctx)
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	c.credentials = creds
+	c.expiresAt = now.Add(c.ttl)
+
+	return creds, nil
+}
+
+// invalidate reads the credentials again on the next call.
+func (c *cachedCredentials) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.expiresAt = time.Time{}
+}
+
+// parseParameters returns the credentials of the parameters below the path.
+// Parameters other than 'email' and 'password' are ignored.
+func parseParameters(output *ssm.GetParametersByPathOutput, path string) (Credentials, error) {
+	if len(output.Parameters) == 0 {
+		return Credentials{}, errors.New("no parameters returned from SSM parameter store")
+	}
+
+	creds := Credentials{}
+	prefix := strings.TrimSuffix(path, "/") + "/"
+
+	for _, item := range output.Parameters {
+		name := aws.ToString(item.Name)
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+
+		switch strings.TrimPrefix(name, prefix) {
+		case "email":
+			creds.Email = aws.ToString(item.Value)
+		case "password":
+			creds.Password = aws.ToString(item.Value)
+		}
+	}
+
+	if err := creds.validate(fmt.Sprintf("parameters below '%s'", path)); err != nil {
+		return Credentials{}, err
+	}
+
+	return creds, nil
+}
@@ -2,29 +2,99 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	mrand "math/rand"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	runtime "github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-lambda-go/lambdacontext"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/lambda"
-	"github.com/aws/aws-sdk-go-v2/service/lambda/types"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	"github.com/edevenport/shiftboard-sdk-go"
+
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
 )
 
-const paramPath = "/shiftboard/api"
+const (
+	paramPath      = "/shiftboard/api"
+	usersParamPath = "/shiftboard/users"
+	defaultTenant  = "default"
+	// Time left to report the users not processed and return before Lambda
+	// times out the function
+	deadlineMargin = 2 * time.Second
+)
 
 type handler struct {
-	workerFunction       string
-	notificationFunction string
-	ssmClient            *ssm.Client
-	lambdaClient         *lambda.Client
+	orgIDs           []string
+	window           WindowConfig
+	payloadBucket    string
+	payloadThreshold int
+	tableName        string
+	alertTopic       string
+	apiTimeout       time.Duration
+	breaker          BreakerConfig
+	sessionTTL       time.Duration
+	sessionKeyID     string
+	credentials      *cachedCredentials
+	ssmClient        SSMGetParametersByPathAPI
+	sessionStore     SSMSessionAPI
+	dbClient         DynamoDBBreakerAPI
+	snsClient        SNSPublishAPI
+	s3Client         S3PutObjectAPI
+	worker           Publisher
+	logger           *Logger
+}
+
+// Shift extends the ShiftBoard shift with the organization it belongs to.
+type Shift struct {
+	shiftboard.Shift
+	OrgID string `json:"org_id"`
+}
+
+// User holds the ShiftBoard credentials and retrieval window of a tenant.
+type User struct {
+	ID       string
+	Email    string
+	Password string
+	Window   WindowConfig
+}
+
+// Event is the invocation event of the retriever. Scheduled invocations leave
+// it empty, operators set it to repair the cache after an outage: the dates
+// override the retrieval window, Tenant limits the run to a single user and
+// ForceResync and DryRun are passed on to the worker. RunID replaces the
+// generated run ID.
+type Event struct {
+	DateFrom    string `json:"dateFrom,omitempty"`
+	DateTo      string `json:"dateTo,omitempty"`
+	ForceResync bool   `json:"forceResync,omitempty"`
+	DryRun      bool   `json:"dryRun,omitempty"`
+	Tenant      string `json:"tenant,omitempty"`
+	RunID       string `json:"runId,omitempty"`
+}
+
+// Payload is the event sent to the worker function for a single tenant. Large
+// payloads are stored in S3 and the event references them instead.
+type Payload struct {
+	Tenant      string      `json:"tenant"`
+	RunID       string      `json:"runId,omitempty"`
+	Window      *Window     `json:"window,omitempty"`
+	ForceResync bool        `json:"forceResync,omitempty"`
+	DryRun      bool        `json:"dryRun,omitempty"`
+	Shifts      []Shift     `json:"shifts"`
+	PayloadRef  *PayloadRef `json:"payloadRef,omitempty"`
 }
 
 type SSMGetParametersByPathAPI interface {
@@ -33,12 +103,6 @@ type SSMGetParametersByPathAPI interface {
 		optFns ...func(*ssm.Options)) (*ssm.GetParametersByPathOutput, error)
 }
 
-type LambdaInvokeAPI interface {
-	Invoke(ctx context.Context,
-		params *lambda.InvokeInput,
-		optFns ...func(*lambda.Options)) (*lambda.InvokeOutput, error)
-}
-
 func GetParametersByPath(ctx context.Context, api SSMGetParametersByPathAPI, path string, withDecryption bool) (*ssm.GetParametersByPathOutput, error) {
 	return api.GetParametersByPath(ctx, &ssm.GetParametersByPathInput{
 		Path:           aws.String(path),
@@ -46,106 +110,407 @@ func GetParametersByPath(ctx context.Context, api SSMGetParametersByPathAPI, pat
 	})
 }
 
-func Invoke(ctx context.Context, api LambdaInvokeAPI, functionName string, payload []byte) (*lambda.InvokeOutput, error) {
-	return api.Invoke(ctx, &lambda.InvokeInput{
-		FunctionName:   aws.String(functionName),
-		InvocationType: types.InvocationTypeEvent,
-		Payload:        payload,
-	})
-}
+func (h handler) HandleRequest(ctx context.Context, event Event) (string, error) {
+	ctx, cancel := withDeadlineMargin(ctx, deadlineMargin)
+	defer cancel()
+	ctx = withLogger(ctx, h.logger)
+	runID := event.RunID
+	if runID == "" {
+		runID = newRunID(ctx)
+	}
+	ctx = withRun(ctx, runID)
+	logger := loggerFrom(ctx)
+	start := time.Now()
+
+	if _, err := overrideWindow(h.window.window(start), event.DateFrom, event.DateTo); err != nil {
+		return "", fmt.Errorf("error in invocation event: %v", err)
+	}
+
+	// A call which times out every attempt should fail before the run's
+	// deadline, so it counts against the breaker
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < retryBudget(h.apiTimeout, apiRetryPolicy()) {
+		logger.Warn("API_TIMEOUT retried on every attempt exceeds the function timeout", field("apiTimeout", h.apiTimeout.String()),
+			field("attempts", apiRetryAttempts), field("remaining", time.Until(deadline).Round(time.Second).String()))
+	}
+
+	if event != (Event{}) {
+		logger.Info("Overriding the run with the invocation event", field("dateFrom", event.DateFrom), field("dateTo", event.DateTo),
+			field("forceResync", event.ForceResync), field("dryRun", event.DryRun), field("tenant", event.Tenant))
+	}
 
-func (h handler) HandleRequest(ctx context.Context) (string, error) {
-	output, err := GetParametersByPath(context.TODO(), h.ssmClient, paramPath, true)
+	b, err := h.loadBreaker(ctx)
 	if err != nil {
-		return "", fmt.Errorf("error reading AWS parameter store: %v", err)
+		return "", fmt.Errorf("error loading circuit breaker: %v", err)
 	}
+	defer func() {
+		// Runs cut short by the deadline still save the failures of the run
+		saveCtx, cancel := withoutDeadline(ctx, breakerSaveTimeout)
+		defer cancel()
 
-	fmt.Printf("GetParametersByPath Output: %+v\n", output)
+		if err := h.saveBreaker(saveCtx, b, time.Now()); err != nil {
+			logger.Error("error saving circuit breaker", errField(err))
+		}
+	}()
+
+	// Runs during a ShiftBoard outage succeed without calling the API, the
+	// admins are alerted once it lasts too long
+	if b.isOpen(start) {
+		logger.Warn("Skipping run while the ShiftBoard API circuit is open", field("stage", "complete"),
+			field("since", time.Unix(b.state.OpenedAt, 0).UTC().Format(time.RFC3339)), field("retryAt", time.Unix(b.state.RetryAt, 0).UTC().Format(time.RFC3339)))
+		return "Skipped", nil
+	}
 
-	email, password, err := parseParameters(output)
+	users, err := h.loadUsers(ctx)
 	if err != nil {
-		return "", fmt.Errorf("error parsing parameters: %v", err)
+		return "", fmt.Errorf("error loading users: %v", err)
+	}
+
+	if event.Tenant != "" {
+		users = selectUser(users, event.Tenant)
+		if len(users) == 0 {
+			return "", fmt.Errorf("no user '%s' configured", event.Tenant)
+		}
+	}
+
+	logger.Info("Loaded users", field("stage", "load_users"), field("count", len(users)), durationField(start))
+
+	// Process every user even if one of them fails
+	failed := []string{}
+	for i, user := range users {
+		// Users not processed yet are retrieved by the next scheduled run
+		if ctx.Err() != nil {
+			logger.Warn("Deadline reached before processing every user", field("processed", i), field("users", len(users)))
+			for _, u := range users[i:] {
+				failed = append(failed, u.ID)
+			}
+			break
+		}
+
+		// Users not processed yet are retrieved once the API is available
+		if b.isOpen(time.Now()) {
+			logger.Warn("ShiftBoard API circuit opened, skipping the remaining users", field("processed", i), field("users", len(users)))
+			break
+		}
+
+		window, err := overrideWindow(user.Window.window(start), event.DateFrom, event.DateTo)
+		if err != nil {
+			logger.Error("error in retrieval window", field("user", user.ID), errField(err))
+			failed = append(failed, user.ID)
+			continue
+		}
+
+		if err := h.processUser(ctx, user, window, event, b); err != nil {
+			logger.Error("error processing user", field("user", user.ID), errField(err))
+			failed = append(failed, user.ID)
+
+			// The credentials may have been rotated, the next run reads them again
+			if user.ID == defaultTenant && h.credentials != nil {
+				h.credentials.invalidate()
+			}
+		}
 	}
 
-	apiClient, err := apiLogin(email, password)
+	logger.Info("Run completed", field("stage", "complete"), field("users", len(users)), field("failed", len(failed)), durationField(start))
+
+	if len(failed) != 0 {
+		return "", fmt.Errorf("error processing users: %v", failed)
+	}
+
+	return "Success", nil
+}
+
+// loadUsers returns the users configured under the users parameter path. A
+// single default user is read from the credentials provider if none are
+// found.
+func (h handler) loadUsers(ctx context.Context) ([]User, error) {
+	params, err := getParametersByPathPages(ctx, h.ssmClient, usersParamPath)
 	if err != nil {
-		return "", fmt.Errorf("error with ShiftBoard API login: %v", err)
+		return nil, fmt.Errorf("error reading AWS parameter store: %v", err)
+	}
+
+	if users := parseUsers(loggerFrom(ctx), params, h.window); len(users) != 0 {
+		return users, nil
 	}
 
-	data, err := readFromAPI(apiClient)
+	creds, err := h.credentials.Credentials(ctx)
 	if err != nil {
-		return "", fmt.Errorf("error retrieving data from ShiftBoard API: %v", err)
+		return nil, fmt.Errorf("error reading ShiftBoard credentials: %v", err)
 	}
 
-	jsonData, err := json.Marshal(data)
+	return []User{{ID: defaultTenant, Email: creds.Email, Password: creds.Password, Window: h.window}}, nil
+}
+
+// processUser retrieves the shifts starting within the window of every
+// selected site for a user and sends them to the worker.
+func (h handler) processUser(ctx context.Context, user User, window Window, options Event, b *breaker) error {
+	logger := loggerFrom(ctx).With(field("user", user.ID), field("dateFrom", window.From), field("dateTo", window.To))
+	ctx = withLogger(ctx, logger)
+
+	apiClient := newAPIClient(ctx, user, h.apiTimeout, apiRetryPolicy(), b)
+
+	session := h.newSessionLogin(ctx, user, apiClient)
+	defer session.save(ctx)
+
+	sites, err := session.sites(ctx, time.Now())
 	if err != nil {
-		return "", fmt.Errorf("error marshalling ShiftBoard API data: %v", err)
+		return fmt.Errorf("error listing ShiftBoard sites: %v", err)
 	}
 
-	fmt.Printf("Payload Size: %d\n", len(string(jsonData)))
+	data := []Shift{}
+	for _, site := range sites {
+		start := time.Now()
+
+		shifts, err := session.readShifts(ctx, site.OrgID, window, start)
+		if err != nil {
+			return err
+		}
+
+		logger.Info("Retrieved shifts", field("stage", "retrieve"), field("org", site.OrgID), field("site", site.Name), field("count", len(shifts)), durationField(start))
 
-	invokeOutput, err := Invoke(context.TODO(), h.lambdaClient, h.workerFunction, jsonData)
+		data = append(data, shifts...)
+	}
+
+	start := time.Now()
+
+	event := Payload{
+		Tenant:      user.ID,
+		RunID:       runIDFrom(ctx),
+		Window:      &window,
+		ForceResync: options.ForceResync,
+		DryRun:      options.DryRun,
+	}
+
+	payload := event
+	payload.Shifts = data
+	jsonData, err := json.Marshal(payload)
 	if err != nil {
-		return "", fmt.Errorf("error invoking function '%v': %v", h.workerFunction, err)
+		return fmt.Errorf("error marshalling ShiftBoard API data: %v", err)
 	}
 
-	fmt.Printf("Lambda Output: %+v\n", invokeOutput)
+	jsonData, err = h.offloadPayload(ctx, event, jsonData, time.Now())
+	if err != nil {
+		return err
+	}
 
-	return "Success", nil
+	if err := h.worker.Publish(ctx, jsonData); err != nil {
+		return fmt.Errorf("error publishing payload to the worker queue: %v", err)
+	}
+
+	logger.Info("Published payload", field("stage", "publish"), field("count", len(data)), field("bytes", len(jsonData)), durationField(start))
+
+	return nil
 }
 
-func parseParameters(output *ssm.GetParametersByPathOutput) (email string, password string, err error) {
-	if len(output.Parameters) == 0 {
-		return "", "", errors.New("no parameters returned from SSM parameter store")
+// getParametersByPathPages returns every decrypted parameter below a path.
+func getParametersByPathPages(ctx context.Context, api SSMGetParametersByPathAPI, path string) ([]ssmtypes.Parameter, error) {
+	var params []ssmtypes.Parameter
+
+	p := ssm.NewGetParametersByPathPaginator(api, &ssm.GetParametersByPathInput{
+		Path:           aws.String(path),
+		Recursive:      true,
+		WithDecryption: true,
+	})
+
+	for p.HasMorePages() {
+		output, err := p.NextPage(ctx)
+		if err != nil {
+			return params, err
+		}
+
+		params = append(params, output.Parameters...)
 	}
 
-	for _, item := range output.Parameters {
-		switch strings.Split(*item.Name, "/")[3] {
+	return params, nil
+}
+
+// parseUsers groups the parameters below the users path by user ID. Users
+// are expected at '<usersParamPath>/<id>/api/email' and '.../api/password',
+// users missing either value are skipped. The optional
+// '.../window/lookback_days' and '.../window/lookahead_months' override the
+// default window.
+func parseUsers(logger *Logger, params []ssmtypes.Parameter, window WindowConfig) []User {
+	byID := map[string]*User{}
+	ids := []string{}
+
+	for _, item := range params {
+		parts := strings.Split(strings.TrimPrefix(*item.Name, usersParamPath+"/"), "/")
+		if len(parts) != 3 || (parts[1] != "api" && parts[1] != "window") {
+			continue
+		}
+
+		user, ok := byID[parts[0]]
+		if !ok {
+			user = &User{ID: parts[0], Window: window}
+			byID[parts[0]] = user
+			ids = append(ids, parts[0])
+		}
+
+		if parts[1] == "window" {
+			if err := user.Window.setParam(parts[2], *item.Value); err != nil {
+				logger.Warn("Ignoring window parameter", field("user", parts[0]), errField(err))
+			}
+			continue
+		}
+
+		switch parts[2] {
 		case "email":
-			email = *item.Value
+			user.Email = *item.Value
 		case "password":
-			password = *item.Value
+			user.Password = *item.Value
 		}
 	}
 
-	return email, password, nil
+	users := []User{}
+	for _, id := range ids {
+		user := byID[id]
+		if user.Email == "" || user.Password == "" {
+			logger.Warn("Skipping user with missing email or password parameter", field("user", id))
+			continue
+		}
+
+		users = append(users, *user)
+	}
+
+	return users
 }
 
-func apiLogin(email string, password string) (*shiftboard.Client, error) {
-	// Initialize ShiftBoard API client
-	client := shiftboard.NewClient(email, password)
+// selectUser returns the user with the ID, if configured.
+func selectUser(users []User, id string) []User {
+	for _, user := range users {
+		if user.ID == id {
+			return []User{user}
+		}
+	}
+
+	return []User{}
+}
 
+func listSites(ctx context.Context, client *apiClient) ([]shiftboard.Site, error) {
 	// Retrieve list of sites for the API login
-	resp, err := client.ListSites()
+	resp, err := client.ListSites(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("error calling ShiftBoard API ListSites (check credentials): %v", err)
 	}
 
-	// Extract Org ID from first site
-	orgID := (*resp.Data.Sites)[0].OrgID
+	if resp.Data.Sites == nil || len(*resp.Data.Sites) == 0 {
+		return nil, errors.New("no sites returned from ShiftBoard API ListSites")
+	}
+
+	return *resp.Data.Sites, nil
+}
+
+// selectSites returns the sites whose org ID is in the allow-list, or every
+// site if the allow-list is empty.
+func selectSites(sites []shiftboard.Site, orgIDs []string) []shiftboard.Site {
+	if len(orgIDs) == 0 {
+		return sites
+	}
+
+	selected := []shiftboard.Site{}
+	for _, site := range sites {
+		for _, id := range orgIDs {
+			if site.OrgID == id {
+				selected = append(selected, site)
+				break
+			}
+		}
+	}
 
+	return selected
+}
+
+func apiLogin(ctx context.Context, client *apiClient, orgID string) error {
 	// Set API access token on login
-	_, err = client.Login(orgID)
+	_, err := client.Login(ctx, orgID)
 	if err != nil {
-		return nil, fmt.Errorf("error calling ShiftBoard API Login: %v", err)
+		return fmt.Errorf("error calling ShiftBoard API Login: %v", err)
 	}
 
-	return client, nil
+	return nil
 }
 
-func readFromAPI(client *shiftboard.Client) (*[]shiftboard.Shift, error) {
-	// From now to 6 months
-	currentTime := time.Now()
-	startDate := currentTime.Format("2006-01-02")
-	endDate := currentTime.AddDate(0, 6, 0).Format("2006-01-02")
-
+func readFromAPI(ctx context.Context, client *apiClient, orgID string, window Window) ([]Shift, error) {
 	// Fetch list of shifts from API
-	resp, err := client.ListShifts(startDate, endDate)
+	resp, err := client.ListShifts(ctx, window.From, window.To)
 	if err != nil {
 		return nil, fmt.Errorf("error calling ShiftBoard API ListShifts: %v", err)
 	}
 
-	return resp.Data.Shifts, nil
+	return tagShifts(resp.Data.Shifts, orgID)
+}
+
+// tagShifts tags every shift with the organization it was retrieved from. A
+// response without a list of shifts is an error rather than no shifts, since
+// the worker notifies every cached shift missing from the payload as removed.
+func tagShifts(shifts *[]shiftboard.Shift, orgID string) ([]Shift, error) {
+	if shifts == nil {
+		return nil, errors.New("no list of shifts in ShiftBoard API response")
+	}
+
+	tagged := []Shift{}
+	for _, shift := range *shifts {
+		tagged = append(tagged, Shift{Shift: shift, OrgID: orgID})
+	}
+
+	return tagged, nil
+}
+
+// splitList splits a comma separated list, ignoring empty entries.
+func splitList(list string) []string {
+	items := []string{}
+
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// newRunID returns the ID of a retriever run, which is the request ID of the
+// invocation so the run can be matched with the Lambda report. A random ID is
+// generated when it is not set, e.g. when testing locally.
+func newRunID(ctx context.Context) string {
+	if lc, ok := lambdacontext.FromContext(ctx); ok && lc.AwsRequestID != "" {
+		return lc.AwsRequestID
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// withDeadlineMargin returns a context which is done the margin before the
+// deadline of the invocation, so there is time left to return an error.
+func withDeadlineMargin(ctx context.Context, margin time.Duration) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithDeadline(ctx, deadline.Add(-margin))
+}
+
+// detachedContext keeps the values of a context, e.g. its logger, without its
+// deadline or cancellation.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+
+func (detachedContext) Done() <-chan struct{} { return nil }
+
+func (detachedContext) Err() error { return nil }
+
+// withoutDeadline returns a context with the values of ctx which is done after
+// the timeout, even if ctx is done already.
+func withoutDeadline(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(detachedContext{ctx}, timeout)
 }
 
 func getEnv(key, fallback string) string {
@@ -167,17 +532,107 @@ func main() {
 		return aws.Endpoint{}, &aws.EndpointNotFoundError{}
 	})
 
+	level, err := parseLevel(os.Getenv("LOG_LEVEL"))
+	logger := newLogger(os.Stdout, level).With(field("function", "retriever"))
+	if err != nil {
+		logger.Warn("error parsing LOG_LEVEL, logging at info level", errField(err))
+	}
+
 	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithEndpointResolverWithOptions(customResolver))
 	if err != nil {
-		fmt.Printf("error loading default AWS configuration: %v\n", err)
+		logger.Error("error loading default AWS configuration", errField(err))
+		os.Exit(1)
+	}
+
+	threshold, err := strconv.Atoi(getEnv("PAYLOAD_THRESHOLD", strconv.Itoa(defaultPayloadThreshold)))
+	if err != nil {
+		logger.Error("error parsing PAYLOAD_THRESHOLD", errField(err))
+		os.Exit(1)
+	}
+
+	window := WindowConfig{LookbackDays: defaultLookbackDays, LookaheadMonths: defaultLookaheadMonths}
+	for key, name := range map[string]string{"LOOKBACK_DAYS": "lookback_days", "LOOKAHEAD_MONTHS": "lookahead_months"} {
+		if value, ok := os.LookupEnv(key); ok && value != "" {
+			if err := window.setParam(name, value); err != nil {
+				logger.Error("error parsing "+key, errField(err))
+				os.Exit(1)
+			}
+		}
+	}
+
+	apiTimeout, err := time.ParseDuration(getEnv("API_TIMEOUT", defaultAPITimeout.String()))
+	if err != nil {
+		logger.Error("error parsing API_TIMEOUT", errField(err))
+		os.Exit(1)
+	}
+
+	breakerConfig := BreakerConfig{}
+	breakerConfig.Threshold, err = strconv.Atoi(getEnv("BREAKER_THRESHOLD", strconv.Itoa(defaultBreakerThreshold)))
+	if err != nil || breakerConfig.Threshold < 1 {
+		logger.Error("error parsing BREAKER_THRESHOLD", errField(err))
+		os.Exit(1)
+	}
+
+	breakerConfig.Cooldown, err = time.ParseDuration(getEnv("BREAKER_COOLDOWN", defaultBreakerCooldown.String()))
+	if err != nil {
+		logger.Error("error parsing BREAKER_COOLDOWN", errField(err))
+		os.Exit(1)
+	}
+
+	breakerConfig.AlertAfter, err = time.ParseDuration(getEnv("BREAKER_ALERT_AFTER", defaultBreakerAlertAfter.String()))
+	if err != nil {
+		logger.Error("error parsing BREAKER_ALERT_AFTER", errField(err))
+		os.Exit(1)
+	}
+
+	sessionTTL, err := time.ParseDuration(getEnv("SESSION_TTL", defaultSessionTTL.String()))
+	if err != nil {
+		logger.Error("error parsing SESSION_TTL", errField(err))
+		os.Exit(1)
+	}
+
+	credentialsTTL, err := time.ParseDuration(getEnv("CREDENTIALS_TTL", defaultCredentialsTTL.String()))
+	if err != nil {
+		logger.Error("error parsing CREDENTIALS_TTL", errField(err))
 		os.Exit(1)
 	}
 
+	// Seed the jitter of retries differently in every execution environment
+	mrand.Seed(time.Now().UnixNano())
+
+	ssmClient := ssm.NewFromConfig(cfg)
+
+	var credentials CredentialsProvider = ssmCredentials{api: ssmClient, path: getEnv("API_PARAMETER_PATH", paramPath)}
+	if secretID := os.Getenv("CREDENTIALS_SECRET_ID"); secretID != "" {
+		if err := validateSecretID(secretID); err != nil {
+			logger.Error("error parsing CREDENTIALS_SECRET_ID", errField(err))
+			os.Exit(1)
+		}
+		credentials = secretCredentials{api: ssmClient, secretID: secretID}
+	}
+
 	h := handler{
-		workerFunction:       getEnv("WORKER_FUNCTION", "WorkerFunction"),
-		notificationFunction: getEnv("NOTIFICATION_FUNCTION", "NotificationFunction"),
-		ssmClient:            ssm.NewFromConfig(cfg),
-		lambdaClient:         lambda.NewFromConfig(cfg),
+		orgIDs:           splitList(os.Getenv("ORG_IDS")),
+		window:           window,
+		payloadBucket:    os.Getenv("PAYLOAD_BUCKET"),
+		payloadThreshold: threshold,
+		tableName:        os.Getenv("TABLE_NAME"),
+		alertTopic:       os.Getenv("ALERT_TOPIC_ARN"),
+		apiTimeout:       apiTimeout,
+		breaker:          breakerConfig,
+		sessionTTL:       sessionTTL,
+		sessionKeyID:     os.Getenv("SESSION_KMS_KEY_ID"),
+		credentials:      newCachedCredentials(credentials, credentialsTTL),
+		ssmClient:        ssmClient,
+		sessionStore:     ssmClient,
+		dbClient:         dynamodb.NewFromConfig(cfg),
+		snsClient:        sns.NewFromConfig(cfg),
+		s3Client:         s3.NewFromConfig(cfg),
+		worker: &sqsPublisher{
+			api:      sqs.NewFromConfig(cfg),
+			queueURL: os.Getenv("WORKER_QUEUE_URL"),
+		},
+		logger: logger,
 	}
 
 	runtime.Start(h.HandleRequest)
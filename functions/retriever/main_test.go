@@ -2,29 +2,92 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"reflect"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-lambda-go/lambdacontext"
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/edevenport/shiftboard-sdk-go"
 
-	lambdatypes "github.com/aws/aws-sdk-go-v2/service/lambda/types"
+	dbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
 )
 
 type mockGetParametersByPathAPI func(ctx context.Context, params *ssm.GetParametersByPathInput, optFns ...func(*ssm.Options)) (*ssm.GetParametersByPathOutput, error)
 
-type mockInvokeAPI func(ctx context.Context, params *lambda.InvokeInput, optFns ...func(*lambda.Options)) (*lambda.InvokeOutput, error)
+type mockPutObjectAPI func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+
+type mockSendMessageAPI func(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error)
+
+type mockPublishAPI func(ctx context.Context, params *sns.PublishInput, optFns ...func(*sns.Options)) (*sns.PublishOutput, error)
+
+// mockBreakerAPI stores the breaker item in memory.
+type mockBreakerAPI struct {
+	item map[string]dbtypes.AttributeValue
+}
+
+func (m mockPublishAPI) Publish(ctx context.Context, params *sns.PublishInput, optFns ...func(*sns.Options)) (*sns.PublishOutput, error) {
+	return m(ctx, params, optFns...)
+}
+
+func (m *mockBreakerAPI) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{Item: m.item}, nil
+}
+
+func (m *mockBreakerAPI) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	m.item = params.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+// mockSessionAPI stores the session parameters in memory.
+type mockSessionAPI struct {
+	params map[string]*ssm.PutParameterInput
+}
+
+func (m *mockSessionAPI) GetParameter(ctx context.Context, params *ssm.GetParameterInput, optFns ...func(*ssm.Options)) (*ssm.GetParameterOutput, error) {
+	input, ok := m.params[aws.ToString(params.Name)]
+	if !ok {
+		return nil, &ssmtypes.ParameterNotFound{}
+	}
+
+	return &ssm.GetParameterOutput{Parameter: &ssmtypes.Parameter{Name: input.Name, Value: input.Value}}, nil
+}
+
+func (m *mockSessionAPI) PutParameter(ctx context.Context, params *ssm.PutParameterInput, optFns ...func(*ssm.Options)) (*ssm.PutParameterOutput, error) {
+	if m.params == nil {
+		m.params = map[string]*ssm.PutParameterInput{}
+	}
+	m.params[aws.ToString(params.Name)] = params
+
+	return &ssm.PutParameterOutput{}, nil
+}
 
 func (m mockGetParametersByPathAPI) GetParametersByPath(ctx context.Context, params *ssm.GetParametersByPathInput, optFns ...func(*ssm.Options)) (*ssm.GetParametersByPathOutput, error) {
 	return m(ctx, params, optFns...)
 }
 
-func (m mockInvokeAPI) Invoke(ctx context.Context, params *lambda.InvokeInput, optFns ...func(*lambda.Options)) (*lambda.InvokeOutput, error) {
+func (m mockSendMessageAPI) SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+	return m(ctx, params, optFns...)
+}
+
+func (m mockPutObjectAPI) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
 	return m(ctx, params, optFns...)
 }
 
@@ -79,104 +142,1225 @@ func TestGetParametersByPath(t *testing.T) {
 	}
 }
 
-func TestInvoke(t *testing.T) {
+func TestSendMessage(t *testing.T) {
+	client := mockSendMessageAPI(func(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+		t.Helper()
+		if params.QueueUrl == nil {
+			t.Fatal("expect queue URL to not be nil")
+		}
+		if e, a := "https://sqs.us-west-2.amazonaws.com/123456789012/testQueue", *params.QueueUrl; e != a {
+			t.Errorf("expect %v, got %v", e, a)
+		}
+		if e, a := `{"testkey":"testval"}`, aws.ToString(params.MessageBody); e != a {
+			t.Errorf("expect %v, got %v", e, a)
+		}
+
+		return &sqs.SendMessageOutput{MessageId: aws.String("testMessage")}, nil
+	})
+
+	publisher := &sqsPublisher{api: client, queueURL: "https://sqs.us-west-2.amazonaws.com/123456789012/testQueue"}
+	if err := publisher.Publish(context.TODO(), []byte(`{"testkey":"testval"}`)); err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+
+	failing := &sqsPublisher{
+		api: mockSendMessageAPI(func(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+			return nil, errors.New("throttled")
+		}),
+	}
+	if err := failing.Publish(context.TODO(), []byte(`{}`)); err == nil {
+		t.Error("expect error, got nil")
+	}
+}
+
+func TestParseParameters(t *testing.T) {
 	cases := []struct {
-		client         func(t *testing.T) LambdaInvokeAPI
-		functionName   string
-		invocationType lambdatypes.InvocationType
-		payload        []byte
-		expect         *lambda.InvokeOutput
+		description string
+		output      *ssm.GetParametersByPathOutput
+		path        string
+		expect      Credentials
+		expectErr   error
 	}{
 		{
-			client: func(t *testing.T) LambdaInvokeAPI {
-				return mockInvokeAPI(func(ctx context.Context, params *lambda.InvokeInput, optFns ...func(*lambda.Options)) (*lambda.InvokeOutput, error) {
-					t.Helper()
-					if params.FunctionName == nil {
-						t.Fatal("expect path to not be nil")
-					}
-					if e, a := "testFunction", *params.FunctionName; e != a {
-						t.Errorf("expect %v, got %v", e, a)
-					}
-					if params.InvocationType == "" {
-						t.Fatal("expect InvocationType to not be empty")
-					}
-					if e, a := lambdatypes.InvocationTypeEvent, params.InvocationType; e != a {
-						t.Errorf("expect %v, got %v", e, a)
-					}
-					if params.Payload == nil {
-						t.Fatal("expect payload not to be nil")
-					}
-					if e, a := []byte(`{"testkey":"testval"}`), params.Payload; bytes.Compare(e, a) != 0 {
-						t.Errorf("expect %v, got %v", e, a)
-					}
+			description: "checkParameters",
+			output:      mockParametersOutput(true),
+			path:        "/shiftboard/api",
+			expect:      Credentials{Email: "user@example.com", Password: "password123"},
+		},
+		{
+			description: "checkEmptyParameters",
+			output:      mockParametersOutput(false),
+			path:        "/shiftboard/api",
+			expectErr:   errors.New("no parameters returned from SSM parameter store"),
+		},
+		{
+			description: "checkNestedPath",
+			output: &ssm.GetParametersByPathOutput{Parameters: []ssmtypes.Parameter{
+				mockParameter("/prod/shiftboard/api/email", "user@example.com"),
+				mockParameter("/prod/shiftboard/api/password", "password123"),
+				mockParameter("/prod/shiftboard/api/legacy/email", "old@example.com"),
+			}},
+			path:   "/prod/shiftboard/api/",
+			expect: Credentials{Email: "user@example.com", Password: "password123"},
+		},
+		{
+			description: "checkShortNames",
+			output: &ssm.GetParametersByPathOutput{Parameters: []ssmtypes.Parameter{
+				mockParameter("email", "user@example.com"),
+			}},
+			path:      "/api",
+			expectErr: errors.New("missing email and password in parameters below '/api'"),
+		},
+		{
+			description: "checkMissingPassword",
+			output: &ssm.GetParametersByPathOutput{Parameters: []ssmtypes.Parameter{
+				mockParameter("/shiftboard/api/email", "user@example.com"),
+			}},
+			path:      "/shiftboard/api",
+			expectErr: errors.New("missing password in parameters below '/shiftboard/api'"),
+		},
+	}
 
-					return &lambda.InvokeOutput{
-						Payload:    []byte(`{"testkey":"testval"}`),
-						StatusCode: 200,
-					}, nil
-				})
+	for _, tt := range cases {
+		t.Run(tt.description, func(t *testing.T) {
+			creds, err := parseParameters(tt.output, tt.path)
+			if e, a := tt.expectErr, err; (e == nil) != (a == nil) || (a != nil && e.Error() != a.Error()) {
+				t.Errorf("expect %v, got %v", e, a)
+			}
+			if e, a := tt.expect, creds; e != a {
+				t.Errorf("expect %v, got %v", e, a)
+			}
+		})
+	}
+}
+
+func TestSecretCredentials(t *testing.T) {
+	cases := []struct {
+		description string
+		value       string
+		expect      Credentials
+		expectErr   bool
+	}{
+		{
+			description: "checkSecret",
+			value:       `{"email":"user@example.com","password":"password123"}`,
+			expect:      Credentials{Email: "user@example.com", Password: "password123"},
+		},
+		{
+			description: "checkMissingEmail",
+			value:       `{"password":"password123"}`,
+			expectErr:   true,
+		},
+		{
+			description: "checkPlainText",
+			value:       "password123",
+			expectErr:   true,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.description, func(t *testing.T) {
+			store := &mockSessionAPI{params: map[string]*ssm.PutParameterInput{
+				"/aws/reference/secretsmanager/shiftboard/api": {Name: aws.String("/aws/reference/secretsmanager/shiftboard/api"), Value: aws.String(tt.value)},
+			}}
+			ctx := withLogger(context.TODO(), newLogger(io.Discard, LevelInfo))
+
+			creds, err := secretCredentials{api: store, secretID: "shiftboard/api"}.Credentials(ctx)
+			if e, a := tt.expectErr, err != nil; e != a {
+				t.Fatalf("expect error %v, got %v", e, err)
+			}
+			if e, a := tt.expect, creds; e != a {
+				t.Errorf("expect %v, got %v", e, a)
+			}
+			if err != nil && strings.Contains(err.Error(), "password123") {
+				t.Errorf("expect no password in error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestValidateSecretID(t *testing.T) {
+	if err := validateSecretID("shiftboard/api"); err != nil {
+		t.Errorf("expect no error, got %v", err)
+	}
+	if err := validateSecretID("arn:aws:secretsmanager:us-west-2:123456789012:secret:shiftboard/api-AbCdEf"); err == nil {
+		t.Error("expect error for a secret ARN, got nil")
+	}
+}
+
+func TestCachedCredentials(t *testing.T) {
+	calls := 0
+	client := mockGetParametersByPathAPI(func(ctx context.Context, params *ssm.GetParametersByPathInput, optFns ...func(*ssm.Options)) (*ssm.GetParametersByPathOutput, error) {
+		calls++
+		return mockParametersOutput(true), nil
+	})
+	ctx := withLogger(context.TODO(), newLogger(io.Discard, LevelInfo))
+
+	creds := newCachedCredentials(ssmCredentials{api: client, path: paramPath}, time.Hour)
+	for i := 0; i < 2; i++ {
+		if _, err := creds.Credentials(ctx); err != nil {
+			t.Fatalf("expect no error, got %v", err)
+		}
+	}
+	if e, a := 1, calls; e != a {
+		t.Errorf("expect %v calls, got %v", e, a)
+	}
+
+	creds.invalidate()
+	if _, err := creds.Credentials(ctx); err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if e, a := 2, calls; e != a {
+		t.Errorf("expect %v calls, got %v", e, a)
+	}
+
+	expired := newCachedCredentials(ssmCredentials{api: client, path: paramPath}, 0)
+	for i := 0; i < 2; i++ {
+		if _, err := expired.Credentials(ctx); err != nil {
+			t.Fatalf("expect no error, got %v", err)
+		}
+	}
+	if e, a := 4, calls; e != a {
+		t.Errorf("expect %v calls, got %v", e, a)
+	}
+}
+
+func TestGetParametersByPathPages(t *testing.T) {
+	client := mockGetParametersByPathAPI(func(ctx context.Context, params *ssm.GetParametersByPathInput, optFns ...func(*ssm.Options)) (*ssm.GetParametersByPathOutput, error) {
+		if e, a := "/path/to/users", *params.Path; e != a {
+			t.Errorf("expect %v, got %v", e, a)
+		}
+		if !params.Recursive || !params.WithDecryption {
+			t.Errorf("expect recursive and decrypted parameters")
+		}
+
+		if params.NextToken == nil {
+			return &ssm.GetParametersByPathOutput{
+				Parameters: []ssmtypes.Parameter{{Value: aws.String("page1")}},
+				NextToken:  aws.String("token"),
+			}, nil
+		}
+
+		return &ssm.GetParametersByPathOutput{
+			Parameters: []ssmtypes.Parameter{{Value: aws.String("page2")}},
+		}, nil
+	})
+
+	params, err := getParametersByPathPages(context.TODO(), client, "/path/to/users")
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if e, a := 2, len(params); e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+}
+
+func TestParseUsers(t *testing.T) {
+	cases := []struct {
+		description string
+		params      []ssmtypes.Parameter
+		expect      []User
+	}{
+		{
+			description: "multipleUsers",
+			params: []ssmtypes.Parameter{
+				mockParameter("/shiftboard/users/alice/api/email", "alice@example.com"),
+				mockParameter("/shiftboard/users/alice/api/password", "password123"),
+				mockParameter("/shiftboard/users/alice/notifications/recipient", "alice@example.com"),
+				mockParameter("/shiftboard/users/bob/api/email", "bob@example.com"),
+				mockParameter("/shiftboard/users/bob/api/password", "password456"),
+			},
+			expect: []User{
+				{ID: "alice", Email: "alice@example.com", Password: "password123", Window: WindowConfig{LookaheadMonths: 6}},
+				{ID: "bob", Email: "bob@example.com", Password: "password456", Window: WindowConfig{LookaheadMonths: 6}},
+			},
+		},
+		{
+			description: "window",
+			params: []ssmtypes.Parameter{
+				mockParameter("/shiftboard/users/alice/api/email", "alice@example.com"),
+				mockParameter("/shiftboard/users/alice/api/password", "password123"),
+				mockParameter("/shiftboard/users/alice/window/lookback_days", "2"),
+				mockParameter("/shiftboard/users/alice/window/lookahead_months", "none"),
 			},
-			functionName:   "testFunction",
-			invocationType: lambdatypes.InvocationTypeEvent,
-			payload:        []byte(`{"testkey":"testval"}`),
-			expect: &lambda.InvokeOutput{
-				Payload:    []byte(`{"testkey":"testval"}`),
-				StatusCode: 200,
+			expect: []User{
+				{ID: "alice", Email: "alice@example.com", Password: "password123", Window: WindowConfig{LookbackDays: 2, LookaheadMonths: 6}},
 			},
 		},
+		{
+			description: "incompleteUser",
+			params: []ssmtypes.Parameter{
+				mockParameter("/shiftboard/users/alice/api/email", "alice@example.com"),
+			},
+			expect: []User{},
+		},
+		{
+			description: "noUsers",
+			params:      []ssmtypes.Parameter{},
+			expect:      []User{},
+		},
 	}
 
-	for i, tt := range cases {
-		t.Run(strconv.Itoa(i), func(t *testing.T) {
-			ctx := context.TODO()
-			content, err := Invoke(ctx, tt.client(t), tt.functionName, tt.payload)
-			if err != nil {
-				t.Fatalf("expect no error, got %v", err)
+	for _, tt := range cases {
+		t.Run(tt.description, func(t *testing.T) {
+			users := parseUsers(newLogger(io.Discard, LevelInfo), tt.params, WindowConfig{LookaheadMonths: 6})
+			if e, a := len(tt.expect), len(users); e != a {
+				t.Fatalf("expect %v, got %v", e, a)
+			}
+			for i := range tt.expect {
+				if e, a := tt.expect[i], users[i]; e != a {
+					t.Errorf("expect %v, got %v", e, a)
+				}
+			}
+		})
+	}
+}
+
+func TestSelectSites(t *testing.T) {
+	sites := []shiftboard.Site{
+		{Name: "Site A", OrgID: "1001"},
+		{Name: "Site B", OrgID: "1002"},
+		{Name: "Site C", OrgID: "1003"},
+	}
+
+	cases := []struct {
+		description string
+		orgIDs      []string
+		expect      []string
+	}{
+		{
+			description: "allSites",
+			orgIDs:      []string{},
+			expect:      []string{"1001", "1002", "1003"},
+		},
+		{
+			description: "allowList",
+			orgIDs:      []string{"1003", "1001"},
+			expect:      []string{"1001", "1003"},
+		},
+		{
+			description: "noMatch",
+			orgIDs:      []string{"9999"},
+			expect:      []string{},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.description, func(t *testing.T) {
+			selected := selectSites(sites, tt.orgIDs)
+			if e, a := len(tt.expect), len(selected); e != a {
+				t.Fatalf("expect %v, got %v", e, a)
+			}
+			for i, id := range tt.expect {
+				if e, a := id, selected[i].OrgID; e != a {
+					t.Errorf("expect %v, got %v", e, a)
+				}
+			}
+		})
+	}
+}
+
+func TestTagShifts(t *testing.T) {
+	shifts := []shiftboard.Shift{{ID: "123"}, {ID: "456"}}
+
+	empty := []shiftboard.Shift{}
+
+	cases := []struct {
+		description string
+		shifts      *[]shiftboard.Shift
+		expect      int
+		expectErr   bool
+	}{
+		{
+			description: "tagShifts",
+			shifts:      &shifts,
+			expect:      2,
+		},
+		{
+			description: "emptyShifts",
+			shifts:      &empty,
+			expect:      0,
+		},
+		{
+			description: "nilShifts",
+			shifts:      nil,
+			expectErr:   true,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.description, func(t *testing.T) {
+			tagged, err := tagShifts(tt.shifts, "1001")
+			if e, a := tt.expectErr, err != nil; e != a {
+				t.Fatalf("expect error %v, got %v", e, err)
+			}
+			if e, a := tt.expect, len(tagged); e != a {
+				t.Fatalf("expect %v, got %v", e, a)
 			}
-			if e, a := tt.expect.Payload, content.Payload; bytes.Compare(e, a) != 0 {
+			for _, shift := range tagged {
+				if e, a := "1001", shift.OrgID; e != a {
+					t.Errorf("expect %v, got %v", e, a)
+				}
+			}
+		})
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	cases := []struct {
+		description string
+		list        string
+		expect      []string
+	}{
+		{
+			description: "list",
+			list:        "1001, 1002,,1003 ",
+			expect:      []string{"1001", "1002", "1003"},
+		},
+		{
+			description: "emptyList",
+			list:        "",
+			expect:      []string{},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.description, func(t *testing.T) {
+			result := splitList(tt.list)
+			if e, a := fmt.Sprint(tt.expect), fmt.Sprint(result); e != a {
 				t.Errorf("expect %v, got %v", e, a)
 			}
-			if e, a := tt.expect.StatusCode, content.StatusCode; e != a {
+		})
+	}
+}
+
+func TestOffloadPayload(t *testing.T) {
+	now, _ := time.Parse(time.RFC3339, "2022-06-01T12:00:00Z")
+	data := []byte(`{"tenant":"alice","shifts":[{"id":"1"}]}`)
+
+	var stored []byte
+	client := mockPutObjectAPI(func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+		if e, a := "payloadBucket", *params.Bucket; e != a {
+			t.Errorf("expect %v, got %v", e, a)
+		}
+		if e, a := "gzip", *params.ContentEncoding; e != a {
+			t.Errorf("expect %v, got %v", e, a)
+		}
+
+		zr, err := gzip.NewReader(params.Body)
+		if err != nil {
+			t.Fatalf("expect no error, got %v", err)
+		}
+		stored, _ = io.ReadAll(zr)
+
+		return &s3.PutObjectOutput{}, nil
+	})
+
+	cases := []struct {
+		description string
+		bucket      string
+		threshold   int
+		data        []byte
+		expect      string
+		expectErr   bool
+	}{
+		{
+			description: "inline",
+			bucket:      "payloadBucket",
+			threshold:   len(data),
+			data:        data,
+			expect:      string(data),
+		},
+		{
+			description: "offloaded",
+			bucket:      "payloadBucket",
+			threshold:   10,
+			data:        data,
+			expect:      `{"tenant":"alice","runId":"run-1","shifts":null,"payloadRef":{"bucket":"payloadBucket","key":"payloads/alice/1654084800000.json.gz"}}`,
+		},
+		{
+			description: "noBucket",
+			threshold:   10,
+			data:        data,
+			expect:      string(data),
+		},
+		{
+			description: "noBucketOverLimit",
+			threshold:   10,
+			data:        bytes.Repeat([]byte("a"), maxMessagePayload),
+			expectErr:   true,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.description, func(t *testing.T) {
+			stored = nil
+			h := handler{payloadBucket: tt.bucket, payloadThreshold: tt.threshold, s3Client: client}
+
+			event, err := h.offloadPayload(context.TODO(), Payload{Tenant: "alice", RunID: "run-1", Shifts: []Shift{}}, tt.data, now)
+			if e, a := tt.expectErr, err != nil; e != a {
+				t.Fatalf("expect error %v, got %v", e, err)
+			}
+			if e, a := tt.expect, string(event); !tt.expectErr && e != a {
 				t.Errorf("expect %v, got %v", e, a)
 			}
+			if stored != nil && !bytes.Equal(tt.data, stored) {
+				t.Errorf("expect stored payload %s, got %s", tt.data, stored)
+			}
 		})
 	}
 }
 
-func TestParseParameters(t *testing.T) {
+func TestWindowConfig(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	cfg := WindowConfig{LookaheadMonths: 6}
+	if e, a := (Window{From: "2022-06-01", To: "2022-12-01"}), cfg.window(now); e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+
+	for _, tt := range []struct {
+		name      string
+		value     string
+		expectErr bool
+	}{
+		{name: "lookback_days", value: "3"},
+		{name: "lookahead_months", value: "2"},
+		{name: "lookahead_months", value: "0", expectErr: true},
+		{name: "lookback_days", value: "-1", expectErr: true},
+		{name: "lookback_days", value: "a week", expectErr: true},
+		{name: "lookahead_days", value: "1", expectErr: true},
+	} {
+		if e, a := tt.expectErr, cfg.setParam(tt.name, tt.value) != nil; e != a {
+			t.Errorf("expect error %v for %s=%s, got %v", e, tt.name, tt.value, a)
+		}
+	}
+
+	if e, a := (Window{From: "2022-05-29", To: "2022-08-01"}), cfg.window(now); e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+}
+
+func TestOverrideWindow(t *testing.T) {
+	window := Window{From: "2022-06-01", To: "2022-12-01"}
+
+	cases := []struct {
+		description string
+		from        string
+		to          string
+		expect      Window
+		expectErr   bool
+	}{
+		{description: "none", expect: window},
+		{description: "from", from: "2022-01-01", expect: Window{From: "2022-01-01", To: "2022-12-01"}},
+		{description: "both", from: "2022-01-01", to: "2022-01-31", expect: Window{From: "2022-01-01", To: "2022-01-31"}},
+		{description: "invalidDate", from: "01/01/2022", expectErr: true},
+		{description: "reversed", to: "2022-05-31", expectErr: true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.description, func(t *testing.T) {
+			w, err := overrideWindow(window, tt.from, tt.to)
+			if e, a := tt.expectErr, err != nil; e != a {
+				t.Fatalf("expect error %v, got %v", e, err)
+			}
+			if e, a := tt.expect, w; e != a {
+				t.Errorf("expect %v, got %v", e, a)
+			}
+		})
+	}
+}
+
+func TestNewRunID(t *testing.T) {
+	ctx := lambdacontext.NewContext(context.TODO(), &lambdacontext.LambdaContext{AwsRequestID: "c6af9ac6-7b61-11e6-9a41-93e8deadbeef"})
+	if e, a := "c6af9ac6-7b61-11e6-9a41-93e8deadbeef", newRunID(ctx); e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+
+	a, b := newRunID(context.TODO()), newRunID(context.TODO())
+	if len(a) != 32 || a == b {
+		t.Errorf("expect unique generated run IDs, got %v and %v", a, b)
+	}
+}
+
+func TestWithRun(t *testing.T) {
+	var buf bytes.Buffer
+	ctx := withLogger(context.TODO(), newLogger(&buf, LevelInfo).With(field("function", "test")))
+	ctx = withRun(ctx, "run-1", field("stage", "test"))
+
+	if e, a := "run-1", runIDFrom(ctx); e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+	if e, a := "", runIDFrom(context.TODO()); e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+
+	loggerFrom(ctx).Info("message")
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	for k, v := range map[string]string{"function": "test", "runId": "run-1", "stage": "test"} {
+		if e, a := v, entry[k]; e != a {
+			t.Errorf("expect %v %v, got %v", k, e, a)
+		}
+	}
+}
+
+func TestAPIClientCall(t *testing.T) {
 	cases := []struct {
-		description    string
-		output         *ssm.GetParametersByPathOutput
-		expectEmail    string
-		expectPassword string
-		expectErr      error
+		description string
+		statuses    []int
+		body        string
+		threshold   int
+		expectErr   bool
+		expectCalls int
+		expectOpen  bool
+	}{
+		{
+			description: "retried",
+			statuses:    []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK},
+			body:        `{"success":true,"data":{"sites":[{"org_id":"1001"}]}}`,
+			threshold:   1,
+			expectCalls: 3,
+		},
+		{
+			description: "permanent",
+			statuses:    []int{http.StatusOK},
+			body:        `{"success":false,"message":"invalid credentials"}`,
+			threshold:   1,
+			expectErr:   true,
+			expectCalls: 1,
+		},
+		{
+			description: "exhausted",
+			statuses:    []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway},
+			threshold:   1,
+			expectErr:   true,
+			expectCalls: 3,
+			expectOpen:  true,
+		},
+		{
+			description: "belowThreshold",
+			statuses:    []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway},
+			threshold:   2,
+			expectErr:   true,
+			expectCalls: 3,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.description, func(t *testing.T) {
+			calls := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				status := tt.statuses[len(tt.statuses)-1]
+				if calls < len(tt.statuses) {
+					status = tt.statuses[calls]
+				}
+				calls++
+
+				w.WriteHeader(status)
+				if status != http.StatusOK {
+					fmt.Fprint(w, `{"success":false}`)
+					return
+				}
+				fmt.Fprint(w, tt.body)
+			}))
+			defer server.Close()
+
+			b := newBreaker(BreakerConfig{Threshold: tt.threshold, Cooldown: time.Hour}, BreakerState{})
+			ctx := withLogger(context.TODO(), newLogger(io.Discard, LevelInfo))
+			client := newAPIClient(ctx, User{}, time.Second, retryPolicy{attempts: 3, base: time.Millisecond, max: time.Millisecond}, b)
+			client.client.BaseURL = server.URL
+
+			_, err := client.ListSites(ctx)
+			if e, a := tt.expectErr, err != nil; e != a {
+				t.Fatalf("expect error %v, got %v", e, err)
+			}
+			if e, a := tt.expectCalls, calls; e != a {
+				t.Errorf("expect %v calls, got %v", e, a)
+			}
+			if e, a := tt.expectOpen, b.isOpen(time.Now()); e != a {
+				t.Fatalf("expect open %v, got %v", e, a)
+			}
+
+			// No calls are made while the breaker is open
+			if tt.expectOpen {
+				var openErr *circuitOpenError
+				if _, err := client.ListSites(ctx); !errors.As(err, &openErr) {
+					t.Errorf("expect circuit open error, got %v", err)
+				}
+				if e, a := tt.expectCalls, calls; e != a {
+					t.Errorf("expect %v calls, got %v", e, a)
+				}
+			}
+		})
+	}
+}
+
+func TestReadFromAPI(t *testing.T) {
+	cases := []struct {
+		description string
+		body        string
+		expect      int
+		expectErr   bool
 	}{
 		{
-			description:    "checkParameters",
-			output:         mockParametersOutput(true),
-			expectEmail:    "user@example.com",
-			expectPassword: "password123",
-			expectErr:      nil,
+			description: "shifts",
+			body:        `{"success":true,"data":{"shifts":[{"id":"123"},{"id":"456"}]}}`,
+			expect:      2,
 		},
 		{
-			description:    "checkEmptyParameters",
-			output:         mockParametersOutput(false),
-			expectEmail:    "",
-			expectPassword: "",
-			expectErr:      errors.New("no parameters returned from SSM parameter store"),
+			description: "noShifts",
+			body:        `{"success":true,"data":{"shifts":[]}}`,
+			expect:      0,
+		},
+		{
+			description: "missingShifts",
+			body:        `{"success":true,"data":{}}`,
+			expectErr:   true,
 		},
 	}
 
 	for _, tt := range cases {
 		t.Run(tt.description, func(t *testing.T) {
-			email, password, err := parseParameters(tt.output)
-			if e, a := tt.expectErr, err; a != nil && e.Error() != a.Error() {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, tt.body)
+			}))
+			defer server.Close()
+
+			ctx := withLogger(context.TODO(), newLogger(io.Discard, LevelInfo))
+			b := newBreaker(BreakerConfig{Threshold: 1, Cooldown: time.Hour}, BreakerState{})
+			client := newAPIClient(ctx, User{}, time.Second, retryPolicy{attempts: 1}, b)
+			client.client.BaseURL = server.URL
+
+			shifts, err := readFromAPI(ctx, client, "1001", Window{From: "2022-06-01", To: "2022-06-30"})
+			if e, a := tt.expectErr, err != nil; e != a {
+				t.Fatalf("expect error %v, got %v", e, err)
+			}
+			if e, a := tt.expect, len(shifts); e != a {
 				t.Errorf("expect %v, got %v", e, a)
 			}
-			if e, a := tt.expectEmail, email; e != a {
+		})
+	}
+}
+
+func TestAPIClientCallDeadline(t *testing.T) {
+	// The API hangs until the run's deadline cuts the call short
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	b := newBreaker(BreakerConfig{Threshold: 1, Cooldown: time.Hour}, BreakerState{})
+	ctx, cancel := context.WithTimeout(withLogger(context.TODO(), newLogger(io.Discard, LevelInfo)), 50*time.Millisecond)
+	defer cancel()
+
+	client := newAPIClient(ctx, User{}, time.Second, retryPolicy{attempts: 3, base: time.Millisecond, max: time.Millisecond}, b)
+	client.client.BaseURL = server.URL
+
+	if _, err := client.ListSites(ctx); err == nil {
+		t.Fatal("expect error, got nil")
+	}
+	if !b.isOpen(time.Now()) {
+		t.Error("expect the interrupted call to count against the breaker")
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	policy := retryPolicy{attempts: 3, base: 500 * time.Millisecond, max: 5 * time.Second}
+	if e, a := 3*time.Second+1500*time.Millisecond, retryBudget(time.Second, policy); e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+
+	// The default timeout retried on every attempt fits the function timeout
+	if budget := retryBudget(defaultAPITimeout, apiRetryPolicy()); budget > time.Minute-deadlineMargin {
+		t.Errorf("expect retry budget within the function timeout, got %v", budget)
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	for status, expect := range map[int]bool{
+		0:                              true,
+		http.StatusOK:                  false,
+		http.StatusUnauthorized:        false,
+		http.StatusTooManyRequests:     true,
+		http.StatusInternalServerError: true,
+		http.StatusGatewayTimeout:      true,
+	} {
+		if e, a := expect, isTransient(status); e != a {
+			t.Errorf("expect %v for %v, got %v", e, status, a)
+		}
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	b := newBreaker(BreakerConfig{Threshold: 2, Cooldown: time.Hour}, BreakerState{})
+
+	b.failure(now)
+	if b.isOpen(now) {
+		t.Fatal("expect breaker to be closed below the threshold")
+	}
+
+	b.failure(now)
+	if !b.isOpen(now) {
+		t.Fatal("expect breaker to be open at the threshold")
+	}
+	if e, a := now.Unix(), b.state.OpenedAt; e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+
+	// After the cooldown a call is let through, which opens the breaker again
+	// if it fails
+	later := now.Add(time.Hour)
+	if b.isOpen(later) {
+		t.Fatal("expect breaker to let a call through after the cooldown")
+	}
+	b.failure(later)
+	if !b.isOpen(later) {
+		t.Fatal("expect breaker to open again after a failed call")
+	}
+	if e, a := now.Unix(), b.state.OpenedAt; e != a {
+		t.Errorf("expect outage start %v, got %v", e, a)
+	}
+
+	b.state.AlertedAt = later.Unix()
+	b.success()
+	if e, a := (BreakerState{Key: breakerKey, State: breakerClosed}), b.state; e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+	if !b.recovered {
+		t.Error("expect recovery of an alerted outage")
+	}
+}
+
+func TestSaveBreaker(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	db := &mockBreakerAPI{}
+	subjects := []string{}
+	client := mockPublishAPI(func(ctx context.Context, params *sns.PublishInput, optFns ...func(*sns.Options)) (*sns.PublishOutput, error) {
+		if e, a := "arn:aws:sns:us-east-1:123456789012:alerts", *params.TopicArn; e != a {
+			t.Errorf("expect %v, got %v", e, a)
+		}
+		subjects = append(subjects, *params.Subject)
+		return &sns.PublishOutput{}, nil
+	})
+
+	h := handler{
+		tableName:  "tableName",
+		alertTopic: "arn:aws:sns:us-east-1:123456789012:alerts",
+		breaker:    BreakerConfig{Threshold: 1, Cooldown: time.Hour, AlertAfter: 3 * time.Hour},
+		dbClient:   db,
+		snsClient:  client,
+	}
+	ctx := withLogger(context.TODO(), newLogger(io.Discard, LevelInfo))
+
+	// Every run loads the state saved by the previous one
+	run := func(at time.Time, fn func(b *breaker)) *breaker {
+		b, err := h.loadBreaker(ctx)
+		if err != nil {
+			t.Fatalf("expect no error, got %v", err)
+		}
+		fn(b)
+		if err := h.saveBreaker(ctx, b, at); err != nil {
+			t.Fatalf("expect no error, got %v", err)
+		}
+		return b
+	}
+
+	run(now, func(b *breaker) { b.failure(now) })
+	if b := run(now.Add(2*time.Hour), func(b *breaker) { b.failure(now.Add(2 * time.Hour)) }); !b.isOpen(now.Add(2 * time.Hour)) {
+		t.Fatal("expect the saved breaker to be open")
+	}
+	if e, a := 0, len(subjects); e != a {
+		t.Fatalf("expect %v alerts before the alert period, got %v", e, a)
+	}
+
+	// Open for the alert period, the admins are alerted once
+	run(now.Add(3*time.Hour), func(b *breaker) {})
+	run(now.Add(4*time.Hour), func(b *breaker) {})
+	run(now.Add(5*time.Hour), func(b *breaker) { b.success() })
+
+	if e, a := "[ShiftBoard API unavailable ShiftBoard API recovered]", fmt.Sprint(subjects); e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+	if b := run(now.Add(5*time.Hour), func(b *breaker) {}); b.state.State != breakerClosed {
+		t.Errorf("expect the saved breaker to be closed, got %v", b.state)
+	}
+}
+
+func TestSessionCache(t *testing.T) {
+	store := &mockSessionAPI{}
+	h := handler{orgIDs: []string{"1001"}, sessionTTL: time.Hour, sessionKeyID: "alias/sessions", sessionStore: store}
+	user := User{ID: "tenant-a", Email: "a@example.com"}
+	ctx := context.TODO()
+
+	cache, err := h.loadSession(ctx, user)
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if len(cache.Logins) != 0 {
+		t.Errorf("expect empty session, got %v", cache)
+	}
+
+	cache.Logins["1001"] = CachedLogin{AccessToken: "token", Cookies: []CachedCookie{{Name: "session", Value: "abc"}}, ExpiresAt: 100}
+	if err := h.saveSession(ctx, user, cache); err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+
+	input := store.params["/shiftboard/sessions/tenant-a"]
+	if input == nil {
+		t.Fatalf("expect session parameter, got %v", store.params)
+	}
+	if e, a := ssmtypes.ParameterTypeSecureString, input.Type; e != a {
+		t.Errorf("expect type %v, got %v", e, a)
+	}
+	if e, a := "alias/sessions", aws.ToString(input.KeyId); e != a {
+		t.Errorf("expect key %v, got %v", e, a)
+	}
+
+	loaded, err := h.loadSession(ctx, user)
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if !reflect.DeepEqual(cache, loaded) {
+		t.Errorf("expect %v, got %v", cache, loaded)
+	}
+
+	// A session of other credentials or organizations is discarded
+	for _, tt := range []struct {
+		user   User
+		orgIDs []string
+	}{
+		{user: User{ID: "tenant-a", Email: "b@example.com"}, orgIDs: h.orgIDs},
+		{user: user, orgIDs: []string{"1001", "1002"}},
+	} {
+		h.orgIDs = tt.orgIDs
+		loaded, err := h.loadSession(ctx, tt.user)
+		if err != nil {
+			t.Fatalf("expect no error, got %v", err)
+		}
+		if len(loaded.Logins) != 0 {
+			t.Errorf("expect empty session, got %v", loaded)
+		}
+	}
+}
+
+func TestSessionLogin(t *testing.T) {
+	calls := map[string]int{}
+	token := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls[r.URL.Path]++
+
+		switch r.URL.Path {
+		case "/sites":
+			fmt.Fprint(w, `{"success":true,"data":{"sites":[{"org_id":"1001","name":"Site"},{"org_id":"1002"}]}}`)
+		case "/login":
+			token = "valid"
+			fmt.Fprint(w, `{"success":true,"data":{"access_token":"valid"}}`)
+		case "/shifts":
+			if r.Header.Get("Authorization") != "Bearer "+token {
+				w.WriteHeader(http.StatusUnauthorized)
+				fmt.Fprint(w, `{"success":false}`)
+				return
+			}
+			fmt.Fprint(w, `{"success":true,"data":{"shifts":[{"id":"1"}]}}`)
+		}
+	}))
+	defer server.Close()
+
+	h := handler{orgIDs: []string{"1001"}, sessionTTL: time.Hour, sessionStore: &mockSessionAPI{}}
+	user := User{ID: "tenant-a", Email: "a@example.com", Password: "secret"}
+	window := Window{From: "2022-06-01", To: "2022-12-01"}
+	ctx := withLogger(context.TODO(), newLogger(io.Discard, LevelInfo))
+	now := time.Now()
+
+	run := func(now time.Time) {
+		t.Helper()
+		b := newBreaker(BreakerConfig{Threshold: 3, Cooldown: time.Hour}, BreakerState{})
+		client := newAPIClient(ctx, user, time.Second, retryPolicy{attempts: 1}, b)
+		client.client.BaseURL = server.URL
+
+		session := h.newSessionLogin(ctx, user, client)
+		defer session.save(ctx)
+
+		sites, err := session.sites(ctx, now)
+		if err != nil {
+			t.Fatalf("expect no error, got %v", err)
+		}
+		if e, a := 1, len(sites); e != a {
+			t.Fatalf("expect %v sites, got %v", e, a)
+		}
+
+		shifts, err := session.readShifts(ctx, sites[0].OrgID, window, now)
+		if err != nil {
+			t.Fatalf("expect no error, got %v", err)
+		}
+		if e, a := 1, len(shifts); e != a {
+			t.Errorf("expect %v shifts, got %v", e, a)
+		}
+	}
+
+	// The first run logs in and caches the session
+	run(now)
+	if e, a := map[string]int{"/sites": 1, "/login": 1, "/shifts": 1}, calls; !reflect.DeepEqual(e, a) {
+		t.Errorf("expect calls %v, got %v", e, a)
+	}
+
+	// The next run reuses it
+	calls = map[string]int{}
+	run(now)
+	if e, a := map[string]int{"/shifts": 1}, calls; !reflect.DeepEqual(e, a) {
+		t.Errorf("expect calls %v, got %v", e, a)
+	}
+
+	// A rejected login is replaced by a new one
+	token = "revoked"
+	calls = map[string]int{}
+	run(now)
+	if e, a := map[string]int{"/sites": 1, "/login": 1, "/shifts": 2}, calls; !reflect.DeepEqual(e, a) {
+		t.Errorf("expect calls %v, got %v", e, a)
+	}
+
+	// An expired session logs in again
+	calls = map[string]int{}
+	run(now.Add(2 * time.Hour))
+	if e, a := map[string]int{"/sites": 1, "/login": 1, "/shifts": 1}, calls; !reflect.DeepEqual(e, a) {
+		t.Errorf("expect calls %v, got %v", e, a)
+	}
+}
+
+func TestContextTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "{}")
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	client := &http.Client{Transport: &contextTransport{ctx: ctx, base: http.DefaultTransport}}
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	resp.Body.Close()
+
+	cancel()
+	if _, err := client.Get(server.URL); !errors.Is(err, context.Canceled) {
+		t.Errorf("expect %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestWithDeadlineMargin(t *testing.T) {
+	deadline := time.Now().Add(time.Minute)
+	parent, cancelParent := context.WithDeadline(context.Background(), deadline)
+	defer cancelParent()
+
+	ctx, cancel := withDeadlineMargin(parent, deadlineMargin)
+	defer cancel()
+
+	actual, ok := ctx.Deadline()
+	if !ok {
+		t.Fatal("expect deadline to be set")
+	}
+	if e, a := deadline.Add(-deadlineMargin), actual; !e.Equal(a) {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+
+	ctx, cancel = withDeadlineMargin(context.Background(), deadlineMargin)
+	if _, ok := ctx.Deadline(); ok {
+		t.Error("expect no deadline without a parent deadline")
+	}
+
+	cancel()
+	if ctx.Err() == nil {
+		t.Error("expect context to be cancelled")
+	}
+}
+
+func TestWithoutDeadline(t *testing.T) {
+	parent, cancelParent := context.WithCancel(withRun(context.TODO(), "run-1"))
+	cancelParent()
+
+	ctx, cancel := withoutDeadline(parent, time.Minute)
+	defer cancel()
+
+	if ctx.Err() != nil {
+		t.Fatalf("expect context not to be done, got %v", ctx.Err())
+	}
+	if e, a := "run-1", runIDFrom(ctx); e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+	if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > time.Minute {
+		t.Errorf("expect deadline within the timeout, got %v", deadline)
+	}
+}
+
+func TestHandleRequestEvent(t *testing.T) {
+	client := mockGetParametersByPathAPI(func(ctx context.Context, params *ssm.GetParametersByPathInput, optFns ...func(*ssm.Options)) (*ssm.GetParametersByPathOutput, error) {
+		if *params.Path == paramPath {
+			return mockParametersOutput(true), nil
+		}
+		return mockParametersOutput(false), nil
+	})
+
+	h := handler{
+		ssmClient:   client,
+		credentials: newCachedCredentials(ssmCredentials{api: client, path: paramPath}, time.Minute),
+		window:      WindowConfig{LookaheadMonths: 6},
+		logger:      newLogger(io.Discard, LevelInfo),
+	}
+
+	cases := []struct {
+		description string
+		event       Event
+		expect      string
+	}{
+		{
+			description: "invalidDate",
+			event:       Event{DateFrom: "2022-13-01"},
+			expect:      "error in invocation event: invalid dateFrom '2022-13-01', expected YYYY-MM-DD",
+		},
+		{
+			description: "unknownTenant",
+			event:       Event{Tenant: "alice", DryRun: true},
+			expect:      "no user 'alice' configured",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.description, func(t *testing.T) {
+			_, err := h.HandleRequest(context.TODO(), tt.event)
+			if err == nil {
+				t.Fatal("expect error, got nil")
+			}
+			if e, a := tt.expect, err.Error(); e != a {
 				t.Errorf("expect %v, got %v", e, a)
 			}
-			if e, a := tt.expectPassword, password; e != a {
+		})
+	}
+}
+
+func TestSelectUser(t *testing.T) {
+	users := []User{{ID: "alice"}, {ID: "bob"}}
+
+	selected := selectUser(users, "bob")
+	if e, a := 1, len(selected); e != a {
+		t.Fatalf("expect %v, got %v", e, a)
+	}
+	if e, a := "bob", selected[0].ID; e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+	if e, a := 0, len(selectUser(users, "carol")); e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+}
+
+func TestLoadUsersLogsNoSecrets(t *testing.T) {
+	client := mockGetParametersByPathAPI(func(ctx context.Context, params *ssm.GetParametersByPathInput, optFns ...func(*ssm.Options)) (*ssm.GetParametersByPathOutput, error) {
+		if *params.Path == paramPath {
+			return mockParametersOutput(true), nil
+		}
+		return mockParametersOutput(false), nil
+	})
+
+	var buf bytes.Buffer
+	ctx := withLogger(context.TODO(), newLogger(&buf, LevelDebug))
+
+	h := handler{ssmClient: client, credentials: newCachedCredentials(ssmCredentials{api: client, path: paramPath}, time.Minute)}
+	users, err := h.loadUsers(ctx)
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if e, a := "password123", users[0].Password; e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+
+	if buf.Len() == 0 {
+		t.Fatal("expect debug log entries")
+	}
+	for _, secret := range []string{"password123", "user@example.com"} {
+		if strings.Contains(buf.String(), secret) {
+			t.Errorf("expect %q not to be logged, got %s", secret, buf.String())
+		}
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := newLogger(&buf, LevelInfo).With(field("function", "test"))
+
+	logger.Debug("not logged")
+	logger.Info("Sent message to jane.doe@example.com",
+		field("password", "password123"),
+		field("accessToken", "eyJhbGciOi"),
+		field("recipients", []string{"john.doe@example.com"}),
+		field("phoneNumber", "+15555550100"),
+		field("webhookURL", "https://hooks.slack.com/services/T000/B000/XXXX"),
+		field("count", 2),
+		errField(errors.New(`Post "https://hooks.slack.com/services/T000/B000/XXXX": error sending to john.doe@example.com`)))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if e, a := 1, len(lines); e != a {
+		t.Fatalf("expect %v lines, got %v: %s", e, a, buf.String())
+	}
+
+	for _, secret := range []string{"password123", "eyJhbGciOi", "jane.doe", "john.doe", "5555550100", "T000", "not logged"} {
+		if strings.Contains(buf.String(), secret) {
+			t.Errorf("expect %q to be redacted, got %s", secret, buf.String())
+		}
+	}
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("expect JSON log entry, got %v", err)
+	}
+
+	expect := map[string]interface{}{
+		"level":       "info",
+		"msg":         "Sent message to j***@example.com",
+		"function":    "test",
+		"password":    redacted,
+		"phoneNumber": "***00",
+		"webhookURL":  "https://hooks.slack.com/" + redacted,
+		"count":       float64(2),
+		"error":       `Post "https://hooks.slack.com/` + redacted + `": error sending to j***@example.com`,
+	}
+	for k, e := range expect {
+		if a := entry[k]; e != a {
+			t.Errorf("expect %s %v, got %v", k, e, a)
+		}
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	cases := []struct {
+		value     string
+		expect    Level
+		expectErr bool
+	}{
+		{value: "", expect: LevelInfo},
+		{value: "DEBUG", expect: LevelDebug},
+		{value: "warn", expect: LevelWarn},
+		{value: "error", expect: LevelError},
+		{value: "verbose", expect: LevelInfo, expectErr: true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.value, func(t *testing.T) {
+			level, err := parseLevel(tt.value)
+			if e, a := tt.expectErr, err != nil; e != a {
+				t.Errorf("expect error %v, got %v", e, err)
+			}
+			if e, a := tt.expect, level; e != a {
 				t.Errorf("expect %v, got %v", e, a)
 			}
 		})
@@ -238,6 +1422,13 @@ func mockParametersOutput(params bool) *ssm.GetParametersByPathOutput {
 	}
 }
 
+func mockParameter(name string, value string) ssmtypes.Parameter {
+	return ssmtypes.Parameter{
+		Name:  aws.String(name),
+		Value: aws.String(value),
+	}
+}
+
 func mockEnv() {
 	err := os.Setenv("MOCK_ENV", "test")
 	if err != nil {
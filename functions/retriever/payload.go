@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const (
+	// SQS messages are limited to 256 KB, including message attributes
+	maxMessagePayload       = 256 * 1024
+	defaultPayloadThreshold = 200 * 1024
+	payloadPrefix           = "payloads"
+)
+
+// PayloadRef points to a payload stored in S3 as gzip compressed JSON.
+type PayloadRef struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+}
+
+type S3PutObjectAPI interface {
+	PutObject(ctx context.Context,
+		params *s3.PutObjectInput,
+		optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+}
+
+func PutObject(ctx context.Context, api S3PutObjectAPI, bucket string, key string, body []byte) (*s3.PutObjectOutput, error) {
+	return api.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:          aws.String(bucket),
+		Key:             aws.String(key),
+		Body:            bytes.NewReader(body),
+		ContentType:     aws.String("application/json"),
+		ContentEncoding: aws.String("gzip"),
+	})
+}
+
+// offloadPayload writes a payload above the threshold to S3 and returns the
+// event, without shifts, referencing it. Smaller payloads are returned as is.
+func (h handler) offloadPayload(ctx context.Context, event Payload, data []byte, now time.Time) ([]byte, error) {
+	if len(data) <= h.payloadThreshold {
+		return data, nil
+	}
+
+	if h.payloadBucket == "" {
+		if len(data) >= maxMessagePayload {
+			return nil, fmt.Errorf("payload of %d bytes exceeds the message size limit and no payload bucket is configured", len(data))
+		}
+		return data, nil
+	}
+
+	body, err := gzipPayload(data)
+	if err != nil {
+		return nil, fmt.Errorf("error compressing payload: %v", err)
+	}
+
+	ref := PayloadRef{Bucket: h.payloadBucket, Key: payloadKey(event.Tenant, now)}
+	if _, err := PutObject(ctx, h.s3Client, ref.Bucket, ref.Key, body); err != nil {
+		return nil, fmt.Errorf("error writing payload to S3: %v", err)
+	}
+
+	loggerFrom(ctx).Info("Offloaded payload to S3", field("stage", "offload"), field("bucket", ref.Bucket), field("key", ref.Key), field("bytes", len(body)))
+
+	event.Shifts = nil
+	event.PayloadRef = &ref
+
+	return json.Marshal(event)
+}
+
+// payloadKey returns a unique key per tenant and run, e.g.
+// "payloads/default/1654084800000.json.gz".
+func payloadKey(tenant string, now time.Time) string {
+	return path.Join(payloadPrefix, tenant, strconv.FormatInt(now.UnixMilli(), 10)+".json.gz")
+}
+
+func gzipPayload(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
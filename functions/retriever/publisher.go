@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+// Publisher sends a message to the next stage of the pipeline.
+type Publisher interface {
+	Publish(ctx context.Context, body []byte) error
+}
+
+type SQSSendMessageAPI interface {
+	SendMessage(ctx context.Context,
+		params *sqs.SendMessageInput,
+		optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error)
+}
+
+func SendMessage(ctx context.Context, api SQSSendMessageAPI, queueURL string, body string) (*sqs.SendMessageOutput, error) {
+	return api.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:    aws.String(queueURL),
+		MessageBody: aws.String(body),
+	})
+}
+
+// sqsPublisher publishes messages to an SQS queue. Messages which repeatedly
+// fail to be processed are moved to the queue's dead-letter queue.
+type sqsPublisher struct {
+	api      SQSSendMessageAPI
+	queueURL string
+}
+
+func (p *sqsPublisher) Publish(ctx context.Context, body []byte) error {
+	output, err := SendMessage(ctx, p.api, p.queueURL, string(body))
+	if err != nil {
+		return fmt.Errorf("error sending SQS message to '%s': %v", p.queueURL, err)
+	}
+
+	loggerFrom(ctx).Debug("Sent SQS message", field("messageId", aws.ToString(output.MessageId)))
+
+	return nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/edevenport/shiftboard-sdk-go"
+
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+const (
+	sessionsParamPath = "/shiftboard/sessions"
+	defaultSessionTTL = 12 * time.Hour
+)
+
+// SessionCache is the ShiftBoard session of a user kept between runs in a
+// SecureString parameter: the selected sites and the login of each
+// organization. It is discarded when the email or org IDs it was created
+// with change.
+type SessionCache struct {
+	Email         string                 `json:"email"`
+	OrgIDs        string                 `json:"orgIds"`
+	Sites         []shiftboard.Site      `json:"sites,omitempty"`
+	SitesExpireAt int64                  `json:"sitesExpireAt,omitempty"`
+	Logins        map[string]CachedLogin `json:"logins"`
+}
+
+// CachedLogin is the access token of an organization, with the cookies sent
+// along with it.
+type CachedLogin struct {
+	AccessToken string         `json:"accessToken"`
+	Cookies     []CachedCookie `json:"cookies,omitempty"`
+	ExpiresAt   int64          `json:"expiresAt"`
+}
+
+type CachedCookie struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type SSMGetParameterAPI interface {
+	GetParameter(ctx context.Context,
+		params *ssm.GetParameterInput,
+		optFns ...func(*ssm.Options)) (*ssm.GetParameterOutput, error)
+}
+
+type SSMPutParameterAPI interface {
+	PutParameter(ctx context.Context,
+		params *ssm.PutParameterInput,
+		optFns ...func(*ssm.Options)) (*ssm.PutParameterOutput, error)
+}
+
+type SSMSessionAPI interface {
+	SSMGetParameterAPI
+	SSMPutParameterAPI
+}
+
+// loadSession reads the cached session of a user, which is empty if there is
+// none or it is outdated.
+func (h handler) loadSession(ctx context.Context, user User) (*SessionCache, error) {
+	empty := &SessionCache{Email: user.Email, OrgIDs: strings.Join(h.orgIDs, ","), Logins: map[string]CachedLogin{}}
+	if h.sessionTTL <= 0 {
+		return empty, nil
+	}
+
+	output, err := h.sessionStore.GetParameter(ctx, &ssm.GetParameterInput{
+		Name:           aws.String(sessionParamName(user.ID)),
+		WithDecryption: true,
+	})
+
+	var notFound *ssmtypes.ParameterNotFound
+	if errors.As(err, &notFound) {
+		return empty, nil
+	}
+	if err != nil {
+		return empty, fmt.Errorf("error calling SSM GetParameter: %v", err)
+	}
+
+	cache := &SessionCache{}
+	if err := json.Unmarshal([]byte(aws.ToString(output.Parameter.Value)), cache); err != nil {
+		return empty, fmt.Errorf("error unmarshalling cached session: %v", err)
+	}
+
+	if cache.Email != empty.Email || cache.OrgIDs != empty.OrgIDs || cache.Logins == nil {
+		return empty, nil
+	}
+
+	return cache, nil
+}
+
+// saveSession writes the session of a user, encrypted with the configured KMS
+// key or the account's default SSM key.
+func (h handler) saveSession(ctx context.Context, user User, cache *SessionCache) error {
+	value, err := json.Marshal(cache)
+	if err != nil {
+		return fmt.Errorf("error marshalling session: %v", err)
+	}
+
+	input := &ssm.PutParameterInput{
+		Name:      aws.String(sessionParamName(user.ID)),
+		Value:     aws.String(string(value)),
+		Type:      ssmtypes.ParameterTypeSecureString,
+		Tier:      ssmtypes.ParameterTierIntelligentTiering,
+		Overwrite: true,
+	}
+	if h.sessionKeyID != "" {
+		input.KeyId = aws.String(h.sessionKeyID)
+	}
+
+	if _, err := h.sessionStore.PutParameter(ctx, input); err != nil {
+		return fmt.Errorf("error calling SSM PutParameter: %v", err)
+	}
+
+	return nil
+}
+
+func sessionParamName(userID string) string {
+	return path.Join(sessionsParamPath, userID)
+}
+
+// sessionLogin logs in to the organizations of a user. Cached sites and
+// logins are used while they are valid, so the sites are only listed and the
+// organizations only logged in to when they expired or were rejected.
+type sessionLogin struct {
+	h       handler
+	user    User
+	client  *apiClient
+	cache   *SessionCache
+	cookies []*http.Cookie
+	listed  bool
+	changed bool
+}
+
+func (h handler) newSessionLogin(ctx context.Context, user User, client *apiClient) *sessionLogin {
+	cache, err := h.loadSession(ctx, user)
+	if err != nil {
+		loggerFrom(ctx).Warn("error loading cached ShiftBoard session, logging in", errField(err))
+	}
+
+	return &sessionLogin{h: h, user: user, client: client, cache: cache}
+}
+
+// sites returns the selected sites of the user.
+func (s *sessionLogin) sites(ctx context.Context, now time.Time) ([]shiftboard.Site, error) {
+	if len(s.cache.Sites) != 0 && now.Unix() < s.cache.SitesExpireAt {
+		loggerFrom(ctx).Debug("Using cached ShiftBoard sites", field("count", len(s.cache.Sites)))
+		return s.cache.Sites, nil
+	}
+
+	return s.listSites(ctx, now)
+}
+
+func (s *sessionLogin) listSites(ctx context.Context, now time.Time) ([]shiftboard.Site, error) {
+	sites, err := listSites(ctx, s.client)
+	if err != nil {
+		return nil, err
+	}
+
+	sites = selectSites(sites, s.h.orgIDs)
+	if len(sites) == 0 {
+		return nil, fmt.Errorf("no ShiftBoard sites match the configured org IDs: %v", s.h.orgIDs)
+	}
+
+	// Cookies from the site listing are needed to log in to each organization
+	s.cookies = s.client.client.Cookies
+	s.listed = true
+
+	s.cache.Sites = sites
+	s.cache.SitesExpireAt = now.Add(s.h.sessionTTL).Unix()
+	s.changed = true
+
+	return sites, nil
+}
+
+// login selects the organization for the next calls. The cached login is used
+// unless it expired or fresh is set, and login reports whether it was used.
+func (s *sessionLogin) login(ctx context.Context, orgID string, now time.Time, fresh bool) (bool, error) {
+	if cached, ok := s.cache.Logins[orgID]; ok && !fresh && now.Unix() < cached.ExpiresAt {
+		loggerFrom(ctx).Debug("Using cached ShiftBoard login", field("org", orgID))
+		s.client.useLogin(cached)
+		return true, nil
+	}
+
+	if !s.listed {
+		if _, err := s.listSites(ctx, now); err != nil {
+			return false, err
+		}
+	}
+
+	s.client.client.Cookies = s.cookies
+	if err := apiLogin(ctx, s.client, orgID); err != nil {
+		delete(s.cache.Logins, orgID)
+		s.changed = true
+		return false, err
+	}
+
+	s.cache.Logins[orgID] = s.client.currentLogin(now.Add(s.h.sessionTTL))
+	s.changed = true
+
+	return false, nil
+}
+
+// readShifts logs in to the organization and retrieves its shifts. A cached
+// login may be revoked before it expires, it is replaced by a new login when
+// the API rejects it.
+func (s *sessionLogin) readShifts(ctx context.Context, orgID string, window Window, now time.Time) ([]Shift, error) {
+	cached, err := s.login(ctx, orgID, now, false)
+	if err != nil {
+		return nil, fmt.Errorf("error with ShiftBoard API login for org '%s': %v", orgID, err)
+	}
+
+	shifts, err := readFromAPI(ctx, s.client, orgID, window)
+	if err != nil && cached && s.client.authFailed() {
+		loggerFrom(ctx).Info("Cached ShiftBoard login rejected, logging in again", field("org", orgID), errField(err))
+
+		if _, err := s.login(ctx, orgID, now, true); err != nil {
+			return nil, fmt.Errorf("error with ShiftBoard API login for org '%s': %v", orgID, err)
+		}
+
+		shifts, err = readFromAPI(ctx, s.client, orgID, window)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving data from ShiftBoard API for org '%s': %v", orgID, err)
+	}
+
+	return shifts, nil
+}
+
+// save writes the session if it changed during the run. A failure only costs
+// a login in the next run, it is logged and ignored.
+func (s *sessionLogin) save(ctx context.Context) {
+	if !s.changed || s.h.sessionTTL <= 0 {
+		return
+	}
+
+	if err := s.h.saveSession(ctx, s.user, s.cache); err != nil {
+		loggerFrom(ctx).Warn("error saving ShiftBoard session", errField(err))
+	}
+}
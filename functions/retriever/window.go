@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	dateLayout             = "2006-01-02"
+	defaultLookaheadMonths = 6
+	defaultLookbackDays    = 0
+)
+
+// WindowConfig is the retrieval window relative to the day of the run. The
+// lookback includes shifts which started in the last days, e.g. to notify
+// changes to a shift which just finished.
+type WindowConfig struct {
+	LookbackDays    int
+	LookaheadMonths int
+}
+
+// Window is the range of shift start dates of a run, as "2006-01-02" dates
+// with both ends included. It is sent to the worker with the payload, which
+// compares the cache within the same window so shifts outside of it are never
+// reported as removed.
+type Window struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// window returns the window of a run at the time.
+func (c WindowConfig) window(now time.Time) Window {
+	return Window{
+		From: now.AddDate(0, 0, -c.LookbackDays).Format(dateLayout),
+		To:   now.AddDate(0, c.LookaheadMonths, 0).Format(dateLayout),
+	}
+}
+
+// setParam sets the setting of a window parameter, "lookback_days" or
+// "lookahead_months".
+func (c *WindowConfig) setParam(name string, value string) error {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid %s '%s', expected a non-negative number", name, value)
+	}
+
+	switch name {
+	case "lookback_days":
+		c.LookbackDays = n
+	case "lookahead_months":
+		if n == 0 {
+			return fmt.Errorf("invalid %s '%s', expected at least one month", name, value)
+		}
+		c.LookaheadMonths = n
+	default:
+		return fmt.Errorf("unknown window parameter '%s'", name)
+	}
+
+	return nil
+}
+
+// overrideWindow replaces either end of the window with the dates of the
+// invocation event, for ad-hoc backfills.
+func overrideWindow(w Window, from string, to string) (Window, error) {
+	if from != "" {
+		if _, err := time.Parse(dateLayout, from); err != nil {
+			return Window{}, fmt.Errorf("invalid dateFrom '%s', expected YYYY-MM-DD", from)
+		}
+		w.From = from
+	}
+
+	if to != "" {
+		if _, err := time.Parse(dateLayout, to); err != nil {
+			return Window{}, fmt.Errorf("invalid dateTo '%s', expected YYYY-MM-DD", to)
+		}
+		w.To = to
+	}
+
+	// Dates in this layout sort chronologically
+	if w.From > w.To {
+		return Window{}, errors.New("dateFrom is after dateTo")
+	}
+
+	return w, nil
+}
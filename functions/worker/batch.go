@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	dbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	batchRetryBase = 50 * time.Millisecond
+	batchRetryMax  = 5 * time.Second
+)
+
+// retryPolicy configures the exponential backoff of unprocessed batch items.
+type retryPolicy struct {
+	base time.Duration
+	max  time.Duration
+}
+
+// batchResult reports the retries of a batch write.
+type batchResult struct {
+	retries     int
+	unprocessed int
+}
+
+// batchWriteItems writes the batch and re-submits unprocessed items, which
+// DynamoDB returns when the table's write capacity is exceeded. Retries back
+// off exponentially with full jitter until the context deadline is reached.
+// The deadline already leaves a margin to report the failure.
+func batchWriteItems(ctx context.Context, api DynamoDBBatchWriteItemAPI, requestItems map[string][]dbtypes.WriteRequest, policy retryPolicy) (batchResult, error) {
+	result := batchResult{}
+
+	for attempt := 0; ; attempt++ {
+		output, err := BatchWriteItem(ctx, api, requestItems)
+		if err != nil {
+			return result, fmt.Errorf("error writing batch items to DynamoDB: %v", err)
+		}
+
+		if len(output.UnprocessedItems) == 0 {
+			return result, nil
+		}
+
+		requestItems = output.UnprocessedItems
+		count := countWriteRequests(requestItems)
+		result.unprocessed += count
+
+		delay := backoff(policy, attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return result, fmt.Errorf("deadline reached with %d unprocessed batch items after %d retries", count, result.retries)
+		}
+
+		loggerFrom(ctx).Warn("Retrying unprocessed batch items", field("count", count), field("delay", delay.String()))
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return result, fmt.Errorf("error retrying unprocessed batch items: %v", ctx.Err())
+		}
+		result.retries++
+	}
+}
+
+// backoff returns a random delay up to the exponentially growing cap of the
+// attempt ("full jitter"), so concurrent writers spread their retries.
+func backoff(policy retryPolicy, attempt int) time.Duration {
+	limit := policy.max
+	if attempt < 30 && policy.base<<attempt < policy.max {
+		limit = policy.base << attempt
+	}
+
+	if limit <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(limit))) + 1
+}
+
+func countWriteRequests(requestItems map[string][]dbtypes.WriteRequest) int {
+	count := 0
+	for _, requests := range requestItems {
+		count += len(requests)
+	}
+
+	return count
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"math/rand"
 	"os"
 	"time"
 
@@ -11,40 +12,74 @@ import (
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
 	"github.com/edevenport/shiftboard-sdk-go"
 
+	"github.com/aws/aws-lambda-go/events"
 	runtime "github.com/aws/aws-lambda-go/lambda"
 	dbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
-	lambdatypes "github.com/aws/aws-sdk-go-v2/service/lambda/types"
 )
 
 const (
-	dbPageCount  = 100
-	dbBatchCount = 25
+	dbPageCount   = 100
+	dbBatchCount  = 25
+	dbIndexName   = "TenantStartDate"
+	defaultTenant = "default"
+	// Time left to report progress and return before Lambda times out the
+	// function
+	deadlineMargin = 500 * time.Millisecond
 )
 
 type handler struct {
-	notificationFunction string
-	tableName            string
-	dbClient             *dynamodb.Client
-	lambdaClient         *lambda.Client
+	tableName     string
+	outboxTable   string
+	dbClient      DynamoDBAPI
+	s3Client      S3GetObjectAPI
+	notifications Publisher
+	logger        *Logger
 }
 
 type Diff struct {
-	State string
-	Shift shiftboard.Shift
+	Tenant   string
+	RunID    string `json:",omitempty"`
+	State    string
+	Shift    Shift
+	Changes  []Change `json:",omitempty"`
+	OutboxID string   `json:",omitempty"`
 }
 
-type ShiftExt struct {
+type Change struct {
+	Field string
+	Old   string
+	New   string
+}
+
+// Shift extends the ShiftBoard shift with the organization it belongs to.
+type Shift struct {
 	shiftboard.Shift
-	TTL int64
+	OrgID string `json:"org_id"`
+}
+
+type ShiftExt struct {
+	Shift
+	Tenant string
+	Key    string
+	TTL    int64
 }
 
-type DynamoDBPutItemAPI interface {
-	PutItem(ctx context.Context,
-		params *dynamodb.PutItemInput,
-		optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+// Payload is the event received from the retriever function for a single
+// tenant, with either the shifts or a reference to them in S3. ForceResync
+// rewrites the cache from the shifts without notifying changes, DryRun only
+// logs the changes.
+type Payload struct {
+	Tenant      string      `json:"tenant"`
+	RunID       string      `json:"runId,omitempty"`
+	Window      *Window     `json:"window,omitempty"`
+	ForceResync bool        `json:"forceResync,omitempty"`
+	DryRun      bool        `json:"dryRun,omitempty"`
+	Shifts      []Shift     `json:"shifts"`
+	PayloadRef  *PayloadRef `json:"payloadRef,omitempty"`
 }
 
 type DynamoDBBatchWriteItemAPI interface {
@@ -53,22 +88,19 @@ type DynamoDBBatchWriteItemAPI interface {
 		optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error)
 }
 
-type DynamoDBNewScanPaginatorAPI interface {
+type DynamoDBNewQueryPaginatorAPI interface {
 	HasMorePages() bool
-	NextPage(context.Context, ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error)
-}
-
-type LambdaInvokeAPI interface {
-	Invoke(ctx context.Context,
-		params *lambda.InvokeInput,
-		optFns ...func(*lambda.Options)) (*lambda.InvokeOutput, error)
+	NextPage(context.Context, ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error)
 }
 
-func PutItem(ctx context.Context, api DynamoDBPutItemAPI, tableName string, item map[string]dbtypes.AttributeValue) (*dynamodb.PutItemOutput, error) {
-	return api.PutItem(ctx, &dynamodb.PutItemInput{
-		Item:      item,
-		TableName: aws.String(tableName),
-	})
+// DynamoDBAPI is the part of the DynamoDB API the worker uses to read and
+// write the cache and the outbox.
+type DynamoDBAPI interface {
+	dynamodb.QueryAPIClient
+	DynamoDBBatchWriteItemAPI
+	DynamoDBGetItemAPI
+	DynamoDBRecordAPI
+	DynamoDBUpdateItemAPI
 }
 
 func BatchWriteItem(ctx context.Context, api DynamoDBBatchWriteItemAPI, requestItems map[string][]dbtypes.WriteRequest) (*dynamodb.BatchWriteItemOutput, error) {
@@ -77,73 +109,53 @@ func BatchWriteItem(ctx context.Context, api DynamoDBBatchWriteItemAPI, requestI
 	})
 }
 
-func Invoke(ctx context.Context, api LambdaInvokeAPI, functionName string, payload []byte) (*lambda.InvokeOutput, error) {
-	return api.Invoke(ctx, &lambda.InvokeInput{
-		FunctionName:   aws.String(functionName),
-		InvocationType: lambdatypes.InvocationTypeEvent,
-		Payload:        payload,
-	})
-}
-
-func (h *handler) writeItemToDB(tableName string, item shiftboard.Shift) error {
-	itemExt := addItemTTL(item)
+func (h *handler) writePayloadBatch(ctx context.Context, tenant string, writeRequestList []dbtypes.WriteRequest) error {
+	batchRequest := map[string][]dbtypes.WriteRequest{h.tableName: writeRequestList}
 
-	av, err := attributevalue.MarshalMap(itemExt)
-	if err != nil {
-		return fmt.Errorf("error marshalling DynamoDB attribute value map: %v", err)
-	}
+	result, err := batchWriteItems(ctx, h.dbClient, batchRequest, retryPolicy{base: batchRetryBase, max: batchRetryMax})
 
-	_, err = PutItem(context.TODO(), h.dbClient, tableName, av)
-	if err != nil {
-		return fmt.Errorf("error calling DynamoDB PutItem: %v", err)
+	if result.retries != 0 || err != nil {
+		putMetrics(tenant,
+			Metric{Name: "BatchWriteRetries", Unit: "Count", Value: float64(result.retries)},
+			Metric{Name: "BatchWriteUnprocessedItems", Unit: "Count", Value: float64(result.unprocessed)})
 	}
 
-	fmt.Printf("Successfully added '%s' to table %s\n", itemExt.Name, tableName)
-
-	return nil
+	return err
 }
 
-func (h *handler) writePayloadBatch(payload []shiftboard.Shift) error {
-	writeRequestList := []dbtypes.WriteRequest{}
+// writeAllToDB writes the shifts of the payload to the cache and deletes the
+// stale shifts from it.
+func (h *handler) writeAllToDB(ctx context.Context, tableName string, tenant string, payload []Shift, stale []Shift) error {
+	loggerFrom(ctx).Info("Writing shifts to the cache", field("count", len(payload)), field("stale", len(stale)))
+	batch := dbBatchCount
 
+	requests := []dbtypes.WriteRequest{}
 	for _, item := range payload {
-		writeRequest, err := constructWriteRequest(item)
+		writeRequest, err := constructWriteRequest(tenant, item)
 		if err != nil {
 			return fmt.Errorf("unable to construct batch write request: %v", err)
 		}
 
-		writeRequestList = append(writeRequestList, *writeRequest)
-	}
-
-	batchRequest := map[string][]dbtypes.WriteRequest{h.tableName: writeRequestList}
-
-	output, err := BatchWriteItem(context.TODO(), h.dbClient, batchRequest)
-	if err != nil {
-		return fmt.Errorf("error writing batch items to DynamoDB: %v", err)
+		requests = append(requests, *writeRequest)
 	}
 
-	fmt.Printf("BatchWriteItem Output: %+v\n", output)
-
-	if len(output.UnprocessedItems) != 0 {
-		return fmt.Errorf("identified unprocessed batch items")
+	for _, item := range stale {
+		requests = append(requests, constructDeleteRequest(tenant, item))
 	}
 
-	return nil
-}
-
-func (h *handler) writeAllToDB(tableName string, payload []shiftboard.Shift) error {
-	fmt.Printf("Total item count: %d\n", len(payload))
-	batch := dbBatchCount
+	for start := 0; start < len(requests); start += batch {
+		if ctx.Err() != nil {
+			return fmt.Errorf("deadline reached after writing %d of %d items", start, len(requests))
+		}
 
-	for start := 0; start < len(payload); start += batch {
 		end := start + batch
-		if end > len(payload) {
-			end = len(payload)
+		if end > len(requests) {
+			end = len(requests)
 		}
 
-		fmt.Printf("Batch item count: %d\n", len(payload[start:end]))
+		loggerFrom(ctx).Debug("Writing batch", field("count", end-start))
 
-		err := h.writePayloadBatch(payload[start:end])
+		err := h.writePayloadBatch(ctx, tenant, requests[start:end])
 		if err != nil {
 			return fmt.Errorf("error writing batch payload: %v", err)
 		}
@@ -152,78 +164,231 @@ func (h *handler) writeAllToDB(tableName string, payload []shiftboard.Shift) err
 	return nil
 }
 
-func (h *handler) invokeNotification(item Diff) error {
+func (h *handler) publishNotification(ctx context.Context, item Diff) error {
 	payload, err := json.Marshal(item)
 	if err != nil {
 		return fmt.Errorf("error marshalling notification payload: %v", err)
 	}
 
-	output, err := Invoke(context.TODO(), h.lambdaClient, h.notificationFunction, payload)
-	if err != nil {
-		return fmt.Errorf("error invoking Lambda function '%v': %v", h.notificationFunction, err)
+	if err := h.notifications.Publish(ctx, payload); err != nil {
+		return fmt.Errorf("error publishing to the notification queue: %v", err)
 	}
 
-	fmt.Printf("Invoke Lambda Output: %+v\n", *output)
+	return nil
+}
+
+// HandleRequest processes the payloads of a batch of SQS messages. Failed
+// messages are reported so that only they are received again, and moved to
+// the dead-letter queue once they exceed the queue's maximum receive count.
+func (h *handler) HandleRequest(ctx context.Context, event events.SQSEvent) (events.SQSEventResponse, error) {
+	ctx, cancel := withDeadlineMargin(ctx, deadlineMargin)
+	defer cancel()
+	ctx = withLogger(ctx, h.logger)
+
+	response := events.SQSEventResponse{BatchItemFailures: []events.SQSBatchItemFailure{}}
+
+	for _, record := range event.Records {
+		if err := h.handleMessage(ctx, record); err != nil {
+			response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: record.MessageId})
+		}
+	}
+
+	return response, nil
+}
+
+// handleMessage processes the payload of a message and logs its failure with
+// the run the payload belongs to.
+func (h *handler) handleMessage(ctx context.Context, record events.SQSMessage) error {
+	ctx = withLogger(ctx, loggerFrom(ctx).With(field("messageId", record.MessageId)))
+
+	var event Payload
+	if err := json.Unmarshal([]byte(record.Body), &event); err != nil {
+		loggerFrom(ctx).Error("error unmarshalling message", errField(err))
+		return err
+	}
+
+	// Messages sent without a run ID are traced by their message ID
+	runID := event.RunID
+	if runID == "" {
+		runID = record.MessageId
+	}
+	ctx = withRun(ctx, runID, field("tenant", event.Tenant))
+
+	if err := h.processPayload(ctx, event); err != nil {
+		loggerFrom(ctx).Error("error processing message", errField(err))
+		return err
+	}
 
 	return nil
 }
 
-func (h *handler) HandleRequest(ctx context.Context, payload []shiftboard.Shift) (string, error) {
-	currentTime := time.Now().Format("2006-01-02")
-	p := dynamodb.NewScanPaginator(h.dbClient, &dynamodb.ScanInput{
-		TableName:        aws.String(h.tableName),
-		Limit:            aws.Int32(dbPageCount),
-		FilterExpression: aws.String("StartDate > :startDate"),
-		ExpressionAttributeValues: map[string]dbtypes.AttributeValue{
-			":startDate": &dbtypes.AttributeValueMemberS{Value: currentTime},
-		},
+// processPayload compares the shifts of a tenant with the cache, records the
+// changes and dispatches the pending notifications.
+func (h *handler) processPayload(ctx context.Context, event Payload) error {
+	logger := loggerFrom(ctx)
+	tenant := event.Tenant
+	if tenant == "" {
+		tenant = defaultTenant
+	}
+
+	start := time.Now()
+	payload, err := resolvePayload(ctx, h.s3Client, event)
+	if err != nil {
+		return err
+	}
+
+	// Shifts and cache are compared within the same window, so shifts outside
+	// of it are neither created nor removed
+	received := len(payload)
+	payload = filterWindow(payload, event.Window)
+
+	logger.Info("Received shifts", field("stage", "receive"), field("count", received), field("inWindow", len(payload)), durationField(start))
+	start = time.Now()
+
+	// Only read the tenant's shifts within the window from the index, expired
+	// shifts waiting for their TTL are not read
+	condition, values := windowCondition(tenant, event.Window, time.Now())
+	p := dynamodb.NewQueryPaginator(h.dbClient, &dynamodb.QueryInput{
+		TableName:                 aws.String(h.tableName),
+		IndexName:                 aws.String(dbIndexName),
+		Limit:                     aws.Int32(dbPageCount),
+		KeyConditionExpression:    aws.String(condition),
+		ExpressionAttributeValues: values,
 	})
 
 	// Read existing cached data from DynamoDB table
-	cachedData, err := scanPages(context.TODO(), p)
+	cachedData, err := queryPages(ctx, p)
 	if err != nil {
-		return "", fmt.Errorf("error reading data from DynamoDB table: %v", err)
+		return fmt.Errorf("error reading data from DynamoDB table: %v", err)
 	}
 
-	// Write payload to DynamoDB table if no cache already exists and finish
-	if len(cachedData) == 0 {
-		if err := h.writeAllToDB(h.tableName, payload); err != nil {
-			return "", fmt.Errorf("error writing data to DynamoDB table: %v", err)
-		}
-		return "Success", nil
+	seeded, err := isSeeded(ctx, h.dbClient, h.tableName, tenant)
+	if err != nil {
+		return fmt.Errorf("error reading seed marker: %v", err)
 	}
+	seed := !seeded || event.ForceResync
 
-	// Compare payload with enteries cached in DynamoDB
-	for _, item := range compareData(&payload, &cachedData) {
-		if err := h.writeItemToDB(h.tableName, item.Shift); err != nil {
-			return "", fmt.Errorf("error writing shift to DynamoDB: %v", err)
+	if event.DryRun {
+		logDryRun(ctx, payload, cachedData, seed)
+		return nil
+	}
+
+	// Write payload to DynamoDB table if the seed of the cache has not
+	// completed yet, or rewrite the cache when a resync is forced. An empty
+	// cache of a seeded tenant is compared, so its new shifts are notified
+	if seed {
+		stale := staleShifts(payload, cachedData)
+		if err := h.writeAllToDB(ctx, h.tableName, tenant, payload, stale); err != nil {
+			return fmt.Errorf("error writing data to DynamoDB table: %v", err)
+		}
+
+		if err := markSeeded(ctx, h.dbClient, h.tableName, tenant, time.Now()); err != nil {
+			return fmt.Errorf("error writing seed marker: %v", err)
 		}
 
-		if err := h.invokeNotification(item); err != nil {
-			return "", fmt.Errorf("error invoking notification Lambda: %v", err)
+		logger.Info("Seeded the cache", field("stage", "seed"), field("count", len(payload)), field("stale", len(stale)), field("forceResync", event.ForceResync), durationField(start))
+	} else {
+		// Compare payload with enteries cached in DynamoDB and record the
+		// changes in the cache and outbox together
+		diffs := compareData(&payload, &cachedData)
+		for i, item := range diffs {
+			// Changes not recorded yet are found again by the next run
+			if ctx.Err() != nil {
+				return fmt.Errorf("deadline reached after recording %d of %d shift changes", i, len(diffs))
+			}
+
+			item.Tenant = tenant
+			item.RunID = runIDFrom(ctx)
+
+			if _, err := recordDiff(ctx, h.dbClient, h.tableName, h.outboxTable, tenant, item); err != nil {
+				return fmt.Errorf("error recording shift change: %v", err)
+			}
 		}
+
+		logger.Info("Compared shifts with the cache", field("stage", "compare"), field("count", len(payload)), field("changes", len(diffs)), durationField(start))
+	}
+
+	// Notify the recorded changes, and those a failed run did not notify
+	start = time.Now()
+	if err := h.dispatchOutbox(ctx, tenant); err != nil {
+		return fmt.Errorf("error dispatching notifications: %v", err)
 	}
 
-	return "Success", nil
+	logger.Info("Dispatched notifications", field("stage", "dispatch"), durationField(start))
+
+	return nil
 }
 
-func compareData(newData *[]shiftboard.Shift, cachedData *[]shiftboard.Shift) (changeLog []Diff) {
-	for i := 0; i < len(*newData); i++ {
-		shift := (*newData)[i]
-		diff := Diff{}
+// compareData returns the created, updated and removed shifts of the payload
+// compared with the cache. The cache is indexed once and both are walked a
+// single time, so large orgs are compared in linear time.
+func compareData(newData *[]Shift, cachedData *[]Shift) (changeLog []Diff) {
+	index := indexShifts(cachedData)
+	seen := make(map[string]bool, len(*newData))
+
+	for _, shift := range *newData {
+		key := shiftKey(shift)
+		seen[key] = true
+
+		if state := getState(shift, index); state != "" {
+			diff := Diff{State: state, Shift: shift}
+
+			if state == "updated" {
+				diff.Changes = getChanges(index[key], shift)
+			}
 
-		if state := getState(shift, cachedData); state != "" {
-			diff.State = state
-			diff.Shift = shift
 			changeLog = append(changeLog, diff)
 		}
 	}
 
+	// The cache is limited to the date window fetched by the retriever, so a
+	// missing shift has been cancelled or removed from ShiftBoard. A failed
+	// fetch is never sent by the retriever, so an empty payload means every
+	// cached shift was removed.
+	for _, shift := range *cachedData {
+		if !seen[shiftKey(shift)] {
+			changeLog = append(changeLog, Diff{State: "removed", Shift: shift})
+		}
+	}
+
 	return changeLog
 }
 
-func scanPages(ctx context.Context, pager DynamoDBNewScanPaginatorAPI) ([]shiftboard.Shift, error) {
-	var list []shiftboard.Shift
+// staleShifts returns the cached shifts missing from the payload, which a
+// resync deletes.
+func staleShifts(newData []Shift, cachedData []Shift) []Shift {
+	stale := []Shift{}
+	index := indexShifts(&newData)
+	for _, shift := range cachedData {
+		if _, found := index[shiftKey(shift)]; !found {
+			stale = append(stale, shift)
+		}
+	}
+
+	return stale
+}
+
+// logDryRun logs the changes a run would make without writing or notifying
+// them.
+func logDryRun(ctx context.Context, newData []Shift, cachedData []Shift, seed bool) {
+	logger := loggerFrom(ctx).With(field("stage", "dry_run"))
+
+	if seed {
+		logger.Info("Dry run, the cache would be rewritten without notifications",
+			field("count", len(newData)), field("stale", len(staleShifts(newData, cachedData))))
+		return
+	}
+
+	diffs := compareData(&newData, &cachedData)
+	for _, item := range diffs {
+		logger.Info("Dry run, shift change would be notified", field("state", item.State), field("shiftId", item.Shift.ID), field("changes", len(item.Changes)))
+	}
+
+	logger.Info("Dry run completed", field("count", len(newData)), field("changes", len(diffs)))
+}
+
+func queryPages(ctx context.Context, pager DynamoDBNewQueryPaginatorAPI) ([]Shift, error) {
+	var list []Shift
 	page := 1
 
 	for pager.HasMorePages() {
@@ -232,7 +397,7 @@ func scanPages(ctx context.Context, pager DynamoDBNewScanPaginatorAPI) ([]shiftb
 			return list, err
 		}
 
-		var pItems []shiftboard.Shift
+		var pItems []Shift
 		err = attributevalue.UnmarshalListOfMaps(output.Items, &pItems)
 		if err != nil {
 			return list, err
@@ -245,8 +410,8 @@ func scanPages(ctx context.Context, pager DynamoDBNewScanPaginatorAPI) ([]shiftb
 	return list, nil
 }
 
-func constructWriteRequest(item shiftboard.Shift) (*dbtypes.WriteRequest, error) {
-	itemExt := addItemTTL(item)
+func constructWriteRequest(tenant string, item Shift) (*dbtypes.WriteRequest, error) {
+	itemExt := extendItem(tenant, item)
 
 	av, err := attributevalue.MarshalMap(itemExt)
 	if err != nil {
@@ -260,44 +425,103 @@ func constructWriteRequest(item shiftboard.Shift) (*dbtypes.WriteRequest, error)
 	}, nil
 }
 
-func getState(shift shiftboard.Shift, cache *[]shiftboard.Shift) string {
-	found := false
-	updated := false
-
-	for _, c := range *cache {
-		if shift.ID == c.ID {
-			found = true
-			if c.Updated.Before(shift.Updated) {
-				updated = true
-			}
-			break
-		}
+func constructDeleteRequest(tenant string, item Shift) dbtypes.WriteRequest {
+	return dbtypes.WriteRequest{
+		DeleteRequest: &dbtypes.DeleteRequest{
+			Key: map[string]dbtypes.AttributeValue{
+				"Key": &dbtypes.AttributeValueMemberS{Value: cacheKey(tenant, item)},
+			},
+		},
 	}
+}
 
-	if updated {
-		return "updated"
+// indexShifts maps the shifts by shift key.
+func indexShifts(shifts *[]Shift) map[string]Shift {
+	index := make(map[string]Shift, len(*shifts))
+
+	for _, shift := range *shifts {
+		index[shiftKey(shift)] = shift
 	}
 
+	return index
+}
+
+func getState(shift Shift, index map[string]Shift) string {
+	cached, found := index[shiftKey(shift)]
 	if !found {
 		return "created"
 	}
 
+	if cached.Updated.Before(shift.Updated) {
+		return "updated"
+	}
+
 	return ""
 }
 
-func addItemTTL(item shiftboard.Shift) ShiftExt {
+// getChanges returns the list of fields that differ between the cached and the
+// updated version of a shift.
+func getChanges(cached Shift, shift Shift) (changes []Change) {
+	fields := []Change{
+		{Field: "Name", Old: cached.Name, New: shift.Name},
+		{Field: "DisplayDate", Old: cached.DisplayDate, New: shift.DisplayDate},
+		{Field: "DisplayTime", Old: cached.DisplayTime, New: shift.DisplayTime},
+		{Field: "StartDate", Old: cached.StartDate, New: shift.StartDate},
+		{Field: "EndDate", Old: cached.EndDate, New: shift.EndDate},
+	}
+
+	for _, f := range fields {
+		if f.Old != f.New {
+			changes = append(changes, f)
+		}
+	}
+
+	return changes
+}
+
+// extendItem extends a shift with the tenant, cache key and TTL attributes
+// stored in DynamoDB.
+func extendItem(tenant string, item Shift) ShiftExt {
+	var shift ShiftExt
+	shift.Shift = item
+	shift.Tenant = tenant
+	shift.Key = cacheKey(tenant, item)
+	shift.TTL = itemTTL(item)
+
+	return shift
+}
+
+func itemTTL(item Shift) int64 {
 	// Fix date string and convert to time.Time type
 	endDate, _ := time.Parse(time.RFC3339, item.EndDate+"Z")
 
 	// Set DynamoDB TTL one month after the shift end date
 	ttl := endDate.AddDate(0, 0, 7)
 
-	// Extend shift object with TTL field
-	var shift ShiftExt
-	shift.Shift = item
-	shift.TTL = ttl.Unix()
+	return ttl.Unix()
+}
 
-	return shift
+// cacheKey returns the DynamoDB key for a shift. The key is prefixed with the
+// tenant so cached shifts of different users are kept apart.
+func cacheKey(tenant string, item Shift) string {
+	return tenant + "#" + shiftKey(item)
+}
+
+// shiftKey identifies a shift within a tenant. The org ID is included so
+// shifts from different organizations never collide.
+func shiftKey(item Shift) string {
+	return item.OrgID + "#" + item.ID
+}
+
+// withDeadlineMargin returns a context which is done the margin before the
+// deadline of the invocation, so there is time left to return an error.
+func withDeadlineMargin(ctx context.Context, margin time.Duration) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithDeadline(ctx, deadline.Add(-margin))
 }
 
 func getEnv(key, fallback string) string {
@@ -320,17 +544,31 @@ func main() {
 		return aws.Endpoint{}, &aws.EndpointNotFoundError{}
 	})
 
+	level, err := parseLevel(os.Getenv("LOG_LEVEL"))
+	logger := newLogger(os.Stdout, level).With(field("function", "worker"))
+	if err != nil {
+		logger.Warn("error parsing LOG_LEVEL, logging at info level", errField(err))
+	}
+
 	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithEndpointResolverWithOptions(customResolver))
 	if err != nil {
-		fmt.Printf("error loading default AWS configuration: %v\n", err)
+		logger.Error("error loading default AWS configuration", errField(err))
 		os.Exit(1)
 	}
 
+	// Seed the jitter of retries differently in every execution environment
+	rand.Seed(time.Now().UnixNano())
+
 	h := handler{
-		notificationFunction: getEnv("NOTIFICATION_FUNCTION", "NotificationFunction"),
-		tableName:            os.Getenv("TABLE_NAME"),
-		dbClient:             dynamodb.NewFromConfig(cfg),
-		lambdaClient:         lambda.NewFromConfig(cfg),
+		tableName:   os.Getenv("TABLE_NAME"),
+		outboxTable: os.Getenv("OUTBOX_TABLE"),
+		dbClient:    dynamodb.NewFromConfig(cfg),
+		s3Client:    s3.NewFromConfig(cfg),
+		notifications: &sqsPublisher{
+			api:      sqs.NewFromConfig(cfg),
+			queueURL: os.Getenv("NOTIFICATION_QUEUE_URL"),
+		},
+		logger: logger,
 	}
 
 	runtime.Start(h.HandleRequest)
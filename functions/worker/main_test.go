@@ -2,43 +2,79 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	"github.com/aws/aws-sdk-go-v2/service/lambda"
-	"github.com/edevenport/shiftboard-sdk-go"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
 
 	dbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
-	lambdatypes "github.com/aws/aws-sdk-go-v2/service/lambda/types"
 )
 
 const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 
 type MockItem struct {
-	*shiftboard.Shift
+	*Shift
 }
 
-type mockInvokeAPI func(ctx context.Context, params *lambda.InvokeInput, optFns ...func(*lambda.Options)) (*lambda.InvokeOutput, error)
+type mockSendMessageAPI func(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error)
+
+type mockTransactWriteItemsAPI func(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optsFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error)
+
+type mockBatchWriteItemAPI func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optsFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error)
+
+type mockUpdateItemAPI func(ctx context.Context, params *dynamodb.UpdateItemInput, optsFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error)
+
+// mockRecordAPI keeps the cache and outbox tables in memory. Transactions are
+// cancelled as a whole when an outbox entry already exists.
+type mockRecordAPI struct {
+	cache  map[string]map[string]dbtypes.AttributeValue
+	outbox map[string]bool
+}
+
+type mockGetItemAPI func(ctx context.Context, params *dynamodb.GetItemInput, optsFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
 
 type mockPutItemAPI func(ctx context.Context, params *dynamodb.PutItemInput, optsFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
 
-type mockNewScanPaginatorAPI struct {
+// mockDynamoDBAPI extends the in-memory tables with the queries, batch writes
+// and reads of the worker. Outbox entries stay pending, so claims succeed.
+type mockDynamoDBAPI struct {
+	*mockRecordAPI
+	entries map[string]map[string]dbtypes.AttributeValue
+}
+
+// mockPublisher collects the published changes.
+type mockPublisher struct {
+	diffs []Diff
+}
+
+type mockGetObjectAPI func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+
+type mockNewQueryPaginatorAPI struct {
 	PageNum int
-	Pages   []*dynamodb.ScanOutput
+	Pages   []*dynamodb.QueryOutput
 }
 
-func (m *mockNewScanPaginatorAPI) HasMorePages() bool {
+func (m *mockNewQueryPaginatorAPI) HasMorePages() bool {
 	return m.PageNum < len(m.Pages)
 }
 
-func (m *mockNewScanPaginatorAPI) NextPage(ctx context.Context, f ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error) {
+func (m *mockNewQueryPaginatorAPI) NextPage(ctx context.Context, f ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
 	if m.PageNum >= len(m.Pages) {
 		return nil, fmt.Errorf("no more pages")
 	}
@@ -48,7 +84,125 @@ func (m *mockNewScanPaginatorAPI) NextPage(ctx context.Context, f ...func(*dynam
 	return output, nil
 }
 
-func (m mockInvokeAPI) Invoke(ctx context.Context, params *lambda.InvokeInput, optFns ...func(*lambda.Options)) (*lambda.InvokeOutput, error) {
+func (m *mockRecordAPI) TransactWriteItems(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error) {
+	outboxID := params.TransactItems[1].Put.Item["ID"].(*dbtypes.AttributeValueMemberS).Value
+	if m.outbox[outboxID] {
+		return nil, &dbtypes.TransactionCanceledException{
+			CancellationReasons: []dbtypes.CancellationReason{
+				{Code: aws.String("None")},
+				{Code: aws.String("ConditionalCheckFailed")},
+			},
+		}
+	}
+
+	m.outbox[outboxID] = true
+	write := params.TransactItems[0]
+	if write.Delete != nil {
+		_, err := m.DeleteItem(ctx, &dynamodb.DeleteItemInput{Key: write.Delete.Key})
+		return &dynamodb.TransactWriteItemsOutput{}, err
+	}
+
+	_, err := m.PutItem(ctx, &dynamodb.PutItemInput{Item: write.Put.Item})
+	return &dynamodb.TransactWriteItemsOutput{}, err
+}
+
+func (m *mockRecordAPI) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	m.cache[params.Item["Key"].(*dbtypes.AttributeValueMemberS).Value] = params.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (m *mockRecordAPI) DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error) {
+	delete(m.cache, params.Key["Key"].(*dbtypes.AttributeValueMemberS).Value)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+func (m *mockRecordAPI) cachedShifts(t *testing.T) []Shift {
+	shifts := []Shift{}
+	for _, item := range m.cache {
+		var shift Shift
+		if err := attributevalue.UnmarshalMap(item, &shift); err != nil {
+			t.Fatalf("expect no error, got %v", err)
+		}
+		shifts = append(shifts, shift)
+	}
+
+	return shifts
+}
+
+func (m *mockDynamoDBAPI) TransactWriteItems(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error) {
+	output, err := m.mockRecordAPI.TransactWriteItems(ctx, params, optFns...)
+	if err == nil {
+		entry := params.TransactItems[1].Put.Item
+		m.entries[entry["ID"].(*dbtypes.AttributeValueMemberS).Value] = entry
+	}
+
+	return output, err
+}
+
+func (m *mockDynamoDBAPI) Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	output := &dynamodb.QueryOutput{}
+	if aws.ToString(params.IndexName) == outboxIndexName {
+		for _, entry := range m.entries {
+			output.Items = append(output.Items, entry)
+		}
+		return output, nil
+	}
+
+	// The seed marker has no StartDate, so it is not in the cache index
+	for _, item := range m.cache {
+		if _, ok := item["StartDate"]; ok {
+			output.Items = append(output.Items, item)
+		}
+	}
+
+	return output, nil
+}
+
+func (m *mockDynamoDBAPI) BatchWriteItem(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+	for _, requests := range params.RequestItems {
+		for _, request := range requests {
+			if request.DeleteRequest != nil {
+				_, _ = m.DeleteItem(ctx, &dynamodb.DeleteItemInput{Key: request.DeleteRequest.Key})
+				continue
+			}
+			_, _ = m.PutItem(ctx, &dynamodb.PutItemInput{Item: request.PutRequest.Item})
+		}
+	}
+
+	return &dynamodb.BatchWriteItemOutput{}, nil
+}
+
+func (m *mockDynamoDBAPI) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{Item: m.cache[params.Key["Key"].(*dbtypes.AttributeValueMemberS).Value]}, nil
+}
+
+func (m *mockDynamoDBAPI) UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func (m *mockDynamoDBAPI) cachedIDs(t *testing.T) string {
+	ids := []string{}
+	for _, shift := range m.cachedShifts(t) {
+		if shift.ID != "" {
+			ids = append(ids, shift.ID)
+		}
+	}
+	sort.Strings(ids)
+
+	return fmt.Sprint(ids)
+}
+
+func (p *mockPublisher) Publish(ctx context.Context, body []byte) error {
+	var item Diff
+	if err := json.Unmarshal(body, &item); err != nil {
+		return err
+	}
+	p.diffs = append(p.diffs, item)
+
+	return nil
+}
+
+func (m mockGetItemAPI) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
 	return m(ctx, params, optFns...)
 }
 
@@ -56,132 +210,540 @@ func (m mockPutItemAPI) PutItem(ctx context.Context, params *dynamodb.PutItemInp
 	return m(ctx, params, optFns...)
 }
 
-func TestInvoke(t *testing.T) {
+func (m mockGetObjectAPI) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	return m(ctx, params, optFns...)
+}
+
+func (m mockSendMessageAPI) SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+	return m(ctx, params, optFns...)
+}
+
+func (m mockTransactWriteItemsAPI) TransactWriteItems(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error) {
+	return m(ctx, params, optFns...)
+}
+
+func (m mockBatchWriteItemAPI) BatchWriteItem(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+	return m(ctx, params, optFns...)
+}
+
+func (m mockUpdateItemAPI) UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	return m(ctx, params, optFns...)
+}
+
+func TestSendMessage(t *testing.T) {
+	client := mockSendMessageAPI(func(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+		t.Helper()
+		if params.QueueUrl == nil {
+			t.Fatal("expect queue URL to not be nil")
+		}
+		if e, a := "https://sqs.us-west-2.amazonaws.com/123456789012/testQueue", *params.QueueUrl; e != a {
+			t.Errorf("expect %v, got %v", e, a)
+		}
+		if e, a := `{"testkey":"testval"}`, aws.ToString(params.MessageBody); e != a {
+			t.Errorf("expect %v, got %v", e, a)
+		}
+
+		return &sqs.SendMessageOutput{MessageId: aws.String("testMessage")}, nil
+	})
+
+	publisher := &sqsPublisher{api: client, queueURL: "https://sqs.us-west-2.amazonaws.com/123456789012/testQueue"}
+	if err := publisher.Publish(context.TODO(), []byte(`{"testkey":"testval"}`)); err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+
+	failing := &sqsPublisher{
+		api: mockSendMessageAPI(func(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+			return nil, errors.New("throttled")
+		}),
+	}
+	if err := failing.Publish(context.TODO(), []byte(`{}`)); err == nil {
+		t.Error("expect error, got nil")
+	}
+}
+
+func TestTransactWriteItems(t *testing.T) {
+	items := []dbtypes.TransactWriteItem{
+		{Put: &dbtypes.Put{TableName: aws.String("testTable")}},
+		{Put: &dbtypes.Put{TableName: aws.String("outboxTable")}},
+	}
+
+	client := mockTransactWriteItemsAPI(func(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error) {
+		if e, a := len(items), len(params.TransactItems); e != a {
+			t.Fatalf("expect %v items, got %v", e, a)
+		}
+		if e, a := "outboxTable", *params.TransactItems[1].Put.TableName; e != a {
+			t.Errorf("expect %v, got %v", e, a)
+		}
+
+		return &dynamodb.TransactWriteItemsOutput{}, nil
+	})
+
+	if _, err := TransactWriteItems(context.TODO(), client, items); err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+}
+
+func TestConstructCacheWrite(t *testing.T) {
+	shift := mockShift()
+
 	cases := []struct {
-		client         func(t *testing.T) LambdaInvokeAPI
-		functionName   string
-		invocationType lambdatypes.InvocationType
-		payload        []byte
-		expect         *lambda.InvokeOutput
+		description  string
+		state        string
+		expectPut    bool
+		expectDelete bool
 	}{
-		{
-			client: func(t *testing.T) LambdaInvokeAPI {
-				return mockInvokeAPI(func(ctx context.Context, params *lambda.InvokeInput, optFns ...func(*lambda.Options)) (*lambda.InvokeOutput, error) {
-					t.Helper()
-					if params.FunctionName == nil {
-						t.Fatal("expect path to not be nil")
-					}
-					if e, a := "testFunction", *params.FunctionName; e != a {
-						t.Errorf("expect %v, got %v", e, a)
-					}
-					if params.InvocationType == "" {
-						t.Fatal("expect InvocationType to not be empty")
-					}
-					if e, a := lambdatypes.InvocationTypeEvent, params.InvocationType; e != a {
-						t.Errorf("expect %v, got %v", e, a)
-					}
-					if params.Payload == nil {
-						t.Fatal("expect payload not to be nil")
-					}
-					if e, a := []byte(`{"testkey":"testval"}`), params.Payload; bytes.Compare(e, a) != 0 {
-						t.Errorf("expect %v, got %v", e, a)
-					}
-
-					return &lambda.InvokeOutput{
-						Payload:    []byte(`{"testkey":"testval"}`),
-						StatusCode: 200,
-					}, nil
-				})
-			},
-			functionName:   "testFunction",
-			invocationType: lambdatypes.InvocationTypeEvent,
-			payload:        []byte(`{"testkey":"testval"}`),
-			expect: &lambda.InvokeOutput{
-				Payload:    []byte(`{"testkey":"testval"}`),
-				StatusCode: 200,
-			},
-		},
+		{description: "created", state: "created", expectPut: true},
+		{description: "updated", state: "updated", expectPut: true},
+		{description: "removed", state: "removed", expectDelete: true},
 	}
 
-	for i, tt := range cases {
-		t.Run(strconv.Itoa(i), func(t *testing.T) {
-			content, err := Invoke(context.TODO(), tt.client(t), tt.functionName, tt.payload)
+	for _, tt := range cases {
+		t.Run(tt.description, func(t *testing.T) {
+			write, err := constructCacheWrite("testTable", "default", Diff{State: tt.state, Shift: shift})
 			if err != nil {
 				t.Fatalf("expect no error, got %v", err)
 			}
-			if e, a := tt.expect.Payload, content.Payload; bytes.Compare(e, a) != 0 {
-				t.Errorf("expect %v, got %v", e, a)
+			if e, a := tt.expectPut, write.Put != nil; e != a {
+				t.Errorf("expect put %v, got %v", e, a)
+			}
+			if e, a := tt.expectDelete, write.Delete != nil; e != a {
+				t.Errorf("expect delete %v, got %v", e, a)
+			}
+
+			key := "default#" + shift.OrgID + "#" + shift.ID
+			if write.Delete != nil {
+				if e, a := key, write.Delete.Key["Key"].(*dbtypes.AttributeValueMemberS).Value; e != a {
+					t.Errorf("expect %v, got %v", e, a)
+				}
+			}
+			if write.Put != nil {
+				if e, a := key, write.Put.Item["Key"].(*dbtypes.AttributeValueMemberS).Value; e != a {
+					t.Errorf("expect %v, got %v", e, a)
+				}
+			}
+		})
+	}
+}
+
+func TestNewOutboxEntry(t *testing.T) {
+	now, _ := time.Parse(time.RFC3339, "2022-06-01T12:00:00Z")
+	item := Diff{Tenant: "default", State: "updated", Shift: mockShift()}
+
+	entry, err := newOutboxEntry("default", item, now)
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+
+	if e, a := fmt.Sprintf("1001#%s#%d#updated", item.Shift.ID, item.Shift.Updated.Unix()), entry.ID; e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+	if e, a := outboxPending, entry.Status; e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+	if e, a := now.Unix(), entry.PendingAt; e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+	if e, a := now.Add(outboxTTL).Unix(), entry.TTL; e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+
+	var diff Diff
+	if err := json.Unmarshal([]byte(entry.Diff), &diff); err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if e, a := item.Shift.ID, diff.Shift.ID; e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+
+	// The same change of a later run has the same ID, another version does not
+	if e, a := outboxID(item), outboxID(diff); e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+	diff.Shift.Updated = diff.Shift.Updated.Add(time.Hour)
+	if outboxID(item) == outboxID(diff) {
+		t.Error("expect a new ID for a new version of the shift")
+	}
+}
+
+func TestRecordDiff(t *testing.T) {
+	shift := mockShift()
+	api := &mockRecordAPI{cache: map[string]map[string]dbtypes.AttributeValue{}, outbox: map[string]bool{}}
+
+	// The shift is removed and later restored with the same version
+	steps := []struct {
+		description string
+		payload     []Shift
+		expectState string
+		expectNew   bool
+		expectCache int
+	}{
+		{description: "created", payload: []Shift{shift}, expectState: "created", expectNew: true, expectCache: 1},
+		{description: "removed", payload: []Shift{}, expectState: "removed", expectNew: true, expectCache: 0},
+		{description: "restored", payload: []Shift{shift}, expectState: "created", expectNew: false, expectCache: 1},
+	}
+
+	for _, tt := range steps {
+		cache := api.cachedShifts(t)
+		diffs := compareData(&tt.payload, &cache)
+		if e, a := 1, len(diffs); e != a {
+			t.Fatalf("%s: expect %v changes, got %v", tt.description, e, a)
+		}
+		if e, a := tt.expectState, diffs[0].State; e != a {
+			t.Errorf("%s: expect %v, got %v", tt.description, e, a)
+		}
+
+		recorded, err := recordDiff(context.TODO(), api, "testTable", "outboxTable", "default", diffs[0])
+		if err != nil {
+			t.Fatalf("%s: expect no error, got %v", tt.description, err)
+		}
+		if e, a := tt.expectNew, recorded; e != a {
+			t.Errorf("%s: expect recorded %v, got %v", tt.description, e, a)
+		}
+		if e, a := tt.expectCache, len(api.cache); e != a {
+			t.Errorf("%s: expect %v cached shifts, got %v", tt.description, e, a)
+		}
+	}
+
+	// The restored shift is cached again, so it is no longer found as created
+	cache := api.cachedShifts(t)
+	if diffs := compareData(&[]Shift{shift}, &cache); len(diffs) != 0 {
+		t.Errorf("expect no changes, got %v", diffs)
+	}
+}
+
+func TestClaimEntry(t *testing.T) {
+	now, _ := time.Parse(time.RFC3339, "2022-06-01T12:00:00Z")
+	entry := OutboxEntry{Tenant: "default", ID: "1001#123456789#1652270400#updated"}
+
+	cases := []struct {
+		description string
+		err         error
+		expect      bool
+		expectErr   bool
+	}{
+		{description: "claimed", expect: true},
+		{description: "alreadyClaimed", err: &dbtypes.ConditionalCheckFailedException{}, expect: false},
+		{description: "requestError", err: errors.New("throttled"), expectErr: true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.description, func(t *testing.T) {
+			client := mockUpdateItemAPI(func(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+				if e, a := "outboxTable", *params.TableName; e != a {
+					t.Errorf("expect %v, got %v", e, a)
+				}
+				if e, a := entry.ID, params.Key["ID"].(*dbtypes.AttributeValueMemberS).Value; e != a {
+					t.Errorf("expect %v, got %v", e, a)
+				}
+				if e, a := strconv.FormatInt(now.Add(-outboxDispatchTimeout).Unix(), 10), params.ExpressionAttributeValues[":stale"].(*dbtypes.AttributeValueMemberN).Value; e != a {
+					t.Errorf("expect %v, got %v", e, a)
+				}
+
+				return &dynamodb.UpdateItemOutput{}, tt.err
+			})
+
+			claimed, err := claimEntry(context.TODO(), client, "outboxTable", entry, now)
+			if e, a := tt.expectErr, err != nil; e != a {
+				t.Errorf("expect error %v, got %v", e, err)
 			}
-			if e, a := tt.expect.StatusCode, content.StatusCode; e != a {
+			if e, a := tt.expect, claimed; e != a {
 				t.Errorf("expect %v, got %v", e, a)
 			}
 		})
 	}
 }
 
-func TestPutItem(t *testing.T) {
-	item := &MockItem{&shiftboard.Shift{}}
-	avItem := item.AttributeValue()
+func TestIsConditionFailed(t *testing.T) {
+	cancelled := &dbtypes.TransactionCanceledException{
+		CancellationReasons: []dbtypes.CancellationReason{
+			{Code: aws.String("None")},
+			{Code: aws.String("ConditionalCheckFailed")},
+		},
+	}
+
+	if !isConditionFailed(fmt.Errorf("operation error: %w", cancelled), 1) {
+		t.Error("expect condition of the outbox entry to have failed")
+	}
+	if isConditionFailed(cancelled, 0) {
+		t.Error("expect condition of the cache write not to have failed")
+	}
+	if isConditionFailed(errors.New("throttled"), 1) {
+		t.Error("expect other errors not to be condition failures")
+	}
+	if isConditionFailed(nil, 1) {
+		t.Error("expect no error not to be a condition failure")
+	}
+}
+
+func TestHandleRequest(t *testing.T) {
+	client := mockGetObjectAPI(func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+		return nil, errors.New("access denied")
+	})
+
+	var buf bytes.Buffer
+	h := handler{s3Client: client, logger: newLogger(&buf, LevelInfo)}
+	event := events.SQSEvent{
+		Records: []events.SQSMessage{
+			{MessageId: "invalid", Body: `{"tenant":`},
+			{MessageId: "unreadable", Body: `{"tenant":"alice","runId":"run-1","payloadRef":{"bucket":"payloadBucket","key":"payloads/alice/1.json.gz"}}`},
+		},
+	}
+
+	response, err := h.HandleRequest(context.TODO(), event)
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+
+	ids := []string{}
+	for _, failure := range response.BatchItemFailures {
+		ids = append(ids, failure.ItemIdentifier)
+	}
+	if e, a := "[invalid unreadable]", fmt.Sprint(ids); e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+
+	// The failure of a payload is logged with its run ID
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &entry); err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	for k, v := range map[string]string{"messageId": "unreadable", "runId": "run-1", "tenant": "alice"} {
+		if e, a := v, entry[k]; e != a {
+			t.Errorf("expect %v %v, got %v", k, e, a)
+		}
+	}
+}
+
+func TestProcessPayload(t *testing.T) {
+	shift := mockShift()
+	updated := shift
+	updated.Name = "Updated " + shift.Name
+	updated.Updated = shift.Updated.AddDate(0, 0, 1)
+	created := mockShift()
+	stale := mockShift()
 
 	cases := []struct {
-		client    func(t *testing.T) DynamoDBPutItemAPI
-		tableName string
-		item      map[string]dbtypes.AttributeValue
-		expect    *dynamodb.PutItemOutput
+		description    string
+		seeded         bool
+		cache          []Shift
+		event          Payload
+		expectNotified []string
+		expectCache    []Shift
+		expectSeeded   bool
 	}{
 		{
-			client: func(t *testing.T) DynamoDBPutItemAPI {
-				return mockPutItemAPI(func(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
-					t.Helper()
-					if params.TableName == nil {
-						t.Fatal("expect path to not be nil")
-					}
-					if e, a := "testTable", *params.TableName; e != a {
-						t.Errorf("expect %v, got %v", e, a)
-					}
-					if params.Item == nil {
-						t.Fatal("expect item not to be nil")
-					}
-					if e, a := fmt.Sprint(avItem), fmt.Sprint(params.Item); e != a {
-						t.Errorf("expect %v, got %v", e, a)
-					}
-					return &dynamodb.PutItemOutput{
-						Attributes:            map[string]dbtypes.AttributeValue{},
-						ConsumedCapacity:      nil,
-						ItemCollectionMetrics: nil,
-					}, nil
-				})
-			},
-			tableName: "testTable",
-			item:      avItem,
-			expect: &dynamodb.PutItemOutput{
-				Attributes:            map[string]dbtypes.AttributeValue{},
-				ConsumedCapacity:      nil,
-				ItemCollectionMetrics: nil,
-			},
+			description:  "seed",
+			event:        Payload{Shifts: []Shift{shift, created}},
+			expectCache:  []Shift{shift, created},
+			expectSeeded: true,
+		},
+		{
+			description:  "resumeSeed",
+			cache:        []Shift{shift, stale},
+			event:        Payload{Shifts: []Shift{shift, created}},
+			expectCache:  []Shift{shift, created},
+			expectSeeded: true,
+		},
+		{
+			description:    "seededEmptyCache",
+			seeded:         true,
+			event:          Payload{Shifts: []Shift{created}},
+			expectNotified: []string{"created"},
+			expectCache:    []Shift{created},
+			expectSeeded:   true,
+		},
+		{
+			description:  "forceResync",
+			seeded:       true,
+			cache:        []Shift{shift, stale},
+			event:        Payload{ForceResync: true, Shifts: []Shift{updated, created}},
+			expectCache:  []Shift{updated, created},
+			expectSeeded: true,
+		},
+		{
+			description:    "compare",
+			seeded:         true,
+			cache:          []Shift{shift, stale},
+			event:          Payload{Shifts: []Shift{updated, created}},
+			expectNotified: []string{"created", "removed", "updated"},
+			expectCache:    []Shift{updated, created},
+			expectSeeded:   true,
+		},
+		{
+			description: "dryRun",
+			cache:       []Shift{shift, stale},
+			event:       Payload{DryRun: true, Shifts: []Shift{updated, created}},
+			expectCache: []Shift{shift, stale},
 		},
 	}
 
-	for i, tt := range cases {
-		t.Run(strconv.Itoa(i), func(t *testing.T) {
-			content, err := PutItem(context.TODO(), tt.client(t), tt.tableName, tt.item)
+	for _, tt := range cases {
+		t.Run(tt.description, func(t *testing.T) {
+			ctx := withLogger(context.TODO(), newLogger(io.Discard, LevelInfo))
+			api := &mockDynamoDBAPI{
+				mockRecordAPI: &mockRecordAPI{cache: map[string]map[string]dbtypes.AttributeValue{}, outbox: map[string]bool{}},
+				entries:       map[string]map[string]dbtypes.AttributeValue{},
+			}
+			for _, item := range tt.cache {
+				av, err := attributevalue.MarshalMap(extendItem(defaultTenant, item))
+				if err != nil {
+					t.Fatalf("expect no error, got %v", err)
+				}
+				api.cache[cacheKey(defaultTenant, item)] = av
+			}
+			if tt.seeded {
+				if err := markSeeded(ctx, api, "testTable", defaultTenant, time.Now()); err != nil {
+					t.Fatalf("expect no error, got %v", err)
+				}
+			}
+
+			publisher := &mockPublisher{}
+			h := handler{tableName: "testTable", outboxTable: "outboxTable", dbClient: api, notifications: publisher}
+			if err := h.processPayload(ctx, tt.event); err != nil {
+				t.Fatalf("expect no error, got %v", err)
+			}
+
+			states := []string{}
+			for _, item := range publisher.diffs {
+				states = append(states, item.State)
+			}
+			sort.Strings(states)
+			if e, a := fmt.Sprint(tt.expectNotified), fmt.Sprint(states); e != a {
+				t.Errorf("expect notified %v, got %v", e, a)
+			}
+
+			expectIDs := []string{}
+			for _, item := range tt.expectCache {
+				expectIDs = append(expectIDs, item.ID)
+			}
+			sort.Strings(expectIDs)
+			if e, a := fmt.Sprint(expectIDs), api.cachedIDs(t); e != a {
+				t.Errorf("expect cached %v, got %v", e, a)
+			}
+
+			// Shifts are cached with the version of the payload
+			for _, cached := range api.cachedShifts(t) {
+				for _, item := range tt.expectCache {
+					if cached.ID == item.ID && !cached.Updated.Equal(item.Updated) {
+						t.Errorf("expect shift %v updated at %v, got %v", item.ID, item.Updated, cached.Updated)
+					}
+				}
+			}
+
+			seeded, err := isSeeded(ctx, api, "testTable", defaultTenant)
 			if err != nil {
 				t.Fatalf("expect no error, got %v", err)
 			}
-			if e, a := len(tt.expect.Attributes), len(content.Attributes); e != a {
+			if e, a := tt.expectSeeded, seeded; e != a {
+				t.Errorf("expect seeded %v, got %v", e, a)
+			}
+		})
+	}
+}
+
+func TestResolvePayload(t *testing.T) {
+	shifts := []Shift{mockShift()}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(Payload{Tenant: "alice", Shifts: shifts}); err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	zw.Close()
+
+	client := mockGetObjectAPI(func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+		if e, a := "payloads/alice/1654084800000.json.gz", *params.Key; e != a {
+			t.Errorf("expect %v, got %v", e, a)
+		}
+
+		return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(buf.Bytes()))}, nil
+	})
+
+	ref := &PayloadRef{Bucket: "payloadBucket", Key: "payloads/alice/1654084800000.json.gz"}
+
+	cases := []struct {
+		description string
+		event       Payload
+		expectErr   bool
+	}{
+		{description: "inline", event: Payload{Tenant: "alice", Shifts: shifts}},
+		{description: "reference", event: Payload{Tenant: "alice", PayloadRef: ref}},
+		{description: "otherTenant", event: Payload{Tenant: "bob", PayloadRef: ref}, expectErr: true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.description, func(t *testing.T) {
+			result, err := resolvePayload(context.TODO(), client, tt.event)
+			if e, a := tt.expectErr, err != nil; e != a {
+				t.Fatalf("expect error %v, got %v", e, err)
+			}
+			if tt.expectErr {
+				return
+			}
+
+			if e, a := 1, len(result); e != a {
+				t.Fatalf("expect %v shifts, got %v", e, a)
+			}
+			if e, a := shifts[0].ID, result[0].ID; e != a {
 				t.Errorf("expect %v, got %v", e, a)
 			}
 		})
 	}
 }
 
-func TestScanPages(t *testing.T) {
-	item := MockItem{&shiftboard.Shift{}}
+func TestFilterWindow(t *testing.T) {
+	shifts := []Shift{}
+	for _, start := range []string{"2022-05-31T22:00:00", "2022-06-01T00:00:00", "2022-06-15T12:00:00", "2022-06-30T23:30:00", "2022-07-01T00:00:00"} {
+		shift := mockShift()
+		shift.StartDate = start
+		shifts = append(shifts, shift)
+	}
+
+	window := &Window{From: "2022-06-01", To: "2022-06-30"}
+	starts := []string{}
+	for _, shift := range filterWindow(shifts, window) {
+		starts = append(starts, shift.StartDate)
+	}
+	if e, a := "[2022-06-01T00:00:00 2022-06-15T12:00:00 2022-06-30T23:30:00]", fmt.Sprint(starts); e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+
+	if e, a := len(shifts), len(filterWindow(shifts, nil)); e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+}
+
+func TestWindowCondition(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	condition, values := windowCondition("alice", &Window{From: "2022-05-30", To: "2022-12-01"}, now)
+	if e, a := "Tenant = :tenant AND StartDate BETWEEN :from AND :end", condition; e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+	for k, v := range map[string]string{":tenant": "alice", ":from": "2022-05-30", ":end": "2022-12-02"} {
+		if e, a := v, values[k].(*dbtypes.AttributeValueMemberS).Value; e != a {
+			t.Errorf("expect %v %v, got %v", k, e, a)
+		}
+	}
+
+	// Payloads without a window are compared with the upcoming shifts
+	condition, values = windowCondition("alice", nil, now)
+	if e, a := "Tenant = :tenant AND StartDate > :startDate", condition; e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+	if e, a := "2022-06-01", values[":startDate"].(*dbtypes.AttributeValueMemberS).Value; e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+}
+
+func TestQueryPages(t *testing.T) {
+	item := MockItem{&Shift{}}
 
 	itemList := []map[string]dbtypes.AttributeValue{}
 
-	pager := &mockNewScanPaginatorAPI{
-		Pages: []*dynamodb.ScanOutput{
+	pager := &mockNewQueryPaginatorAPI{
+		Pages: []*dynamodb.QueryOutput{
 			{
 				Items: append(itemList, item.New().AttributeValue()),
 				Count: 1,
@@ -196,7 +758,7 @@ func TestScanPages(t *testing.T) {
 			},
 		},
 	}
-	objects, err := scanPages(context.TODO(), pager)
+	objects, err := queryPages(context.TODO(), pager)
 	if err != nil {
 		t.Fatalf("expect no error, got %v", err)
 	}
@@ -205,28 +767,165 @@ func TestScanPages(t *testing.T) {
 	}
 }
 
+func TestBatchWriteItems(t *testing.T) {
+	policy := retryPolicy{base: time.Millisecond, max: 4 * time.Millisecond}
+
+	cases := []struct {
+		description   string
+		unprocessed   []int
+		err           error
+		timeout       time.Duration
+		expectErr     bool
+		expectCalls   int
+		expectRetries int
+	}{
+		{
+			description: "allProcessed",
+			unprocessed: []int{0},
+			expectCalls: 1,
+		},
+		{
+			description:   "retryUnprocessed",
+			unprocessed:   []int{10, 3, 0},
+			expectCalls:   3,
+			expectRetries: 2,
+		},
+		{
+			description:   "retryBeforeDeadline",
+			unprocessed:   []int{10, 0},
+			timeout:       10 * policy.max,
+			expectCalls:   2,
+			expectRetries: 1,
+		},
+		{
+			description: "deadlineReached",
+			unprocessed: []int{10, 10, 10},
+			timeout:     time.Nanosecond,
+			expectErr:   true,
+			expectCalls: 1,
+		},
+		{
+			description: "requestError",
+			err:         errors.New("throttled"),
+			expectErr:   true,
+			expectCalls: 1,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.description, func(t *testing.T) {
+			calls := 0
+			client := mockBatchWriteItemAPI(func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+				if tt.err != nil {
+					calls++
+					return nil, tt.err
+				}
+
+				// Unprocessed items are re-submitted as returned
+				if calls > 0 {
+					if e, a := tt.unprocessed[calls-1], countWriteRequests(params.RequestItems); e != a {
+						t.Errorf("expect %v re-submitted items, got %v", e, a)
+					}
+				}
+
+				output := &dynamodb.BatchWriteItemOutput{}
+				if n := tt.unprocessed[calls]; n != 0 {
+					output.UnprocessedItems = map[string][]dbtypes.WriteRequest{"table": make([]dbtypes.WriteRequest, n)}
+				}
+				calls++
+
+				return output, nil
+			})
+
+			ctx := context.Background()
+			if tt.timeout != 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+
+			requestItems := map[string][]dbtypes.WriteRequest{"table": make([]dbtypes.WriteRequest, 25)}
+			result, err := batchWriteItems(ctx, client, requestItems, policy)
+			if e, a := tt.expectErr, err != nil; e != a {
+				t.Errorf("expect error %v, got %v", e, err)
+			}
+			if e, a := tt.expectCalls, calls; e != a {
+				t.Errorf("expect %v calls, got %v", e, a)
+			}
+			if e, a := tt.expectRetries, result.retries; e != a {
+				t.Errorf("expect %v retries, got %v", e, a)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	policy := retryPolicy{base: 50 * time.Millisecond, max: 5 * time.Second}
+
+	for attempt, limit := range []time.Duration{50 * time.Millisecond, 100 * time.Millisecond, 200 * time.Millisecond} {
+		for i := 0; i < 100; i++ {
+			if d := backoff(policy, attempt); d <= 0 || d > limit {
+				t.Fatalf("expect backoff of attempt %d in (0, %v], got %v", attempt, limit, d)
+			}
+		}
+	}
+
+	// The cap also holds for attempts that would overflow the shift
+	if d := backoff(policy, 100); d <= 0 || d > policy.max {
+		t.Errorf("expect backoff in (0, %v], got %v", policy.max, d)
+	}
+}
+
+func TestConstructMetrics(t *testing.T) {
+	now, _ := time.Parse(time.RFC3339, "2022-06-15T12:00:00Z")
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal(constructMetrics(now, "default", Metric{Name: "BatchWriteRetries", Unit: "Count", Value: 2}), &doc); err != nil {
+		t.Fatalf("expect valid JSON, got %v", err)
+	}
+
+	if e, a := float64(2), doc["BatchWriteRetries"]; e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+	if e, a := "default", doc["Tenant"]; e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+
+	meta := doc["_aws"].(map[string]interface{})
+	if e, a := float64(now.UnixMilli()), meta["Timestamp"]; e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+
+	directive := meta["CloudWatchMetrics"].([]interface{})[0].(map[string]interface{})
+	if e, a := metricsNamespace, directive["Namespace"]; e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+}
+
 func TestCompareData(t *testing.T) {
 	// Mock new data
-	newData := []shiftboard.Shift{mockShift()}
+	newData := []Shift{mockShift()}
 
 	// Mock cache data
-	cacheData := make([]shiftboard.Shift, len(newData))
+	cacheData := make([]Shift, len(newData))
 	copy(cacheData, newData)
 
 	// Change "Updated" date to one month prior for cache item
 	priorMonth := cacheData[0].Updated.AddDate(0, -1, 0).Format(time.RFC3339)
 	cacheData[0].Updated, _ = time.Parse(time.RFC3339, priorMonth)
+	cacheData[0].DisplayTime = "9:00am - 1:00pm"
 
 	cases := []struct {
 		description string
-		newData     []shiftboard.Shift
-		cachedData  []shiftboard.Shift
+		newData     []Shift
+		cachedData  []Shift
 		expect      string
+		changes     int
 	}{
 		{
 			description: "compareCreate",
 			newData:     newData,
-			cachedData:  []shiftboard.Shift{},
+			cachedData:  []Shift{},
 			expect:      "created",
 		},
 		{
@@ -234,6 +933,13 @@ func TestCompareData(t *testing.T) {
 			newData:     newData,
 			cachedData:  cacheData,
 			expect:      "updated",
+			changes:     1,
+		},
+		{
+			description: "compareRemove",
+			newData:     newData,
+			cachedData:  []Shift{newData[0], mockShift()},
+			expect:      "removed",
 		},
 	}
 
@@ -243,6 +949,9 @@ func TestCompareData(t *testing.T) {
 			if e, a := tt.expect, changeLog[0].State; e != a {
 				t.Errorf("expect %v, got %v", e, a)
 			}
+			if e, a := tt.changes, len(changeLog[0].Changes); e != a {
+				t.Errorf("expect %v changes, got %v", e, a)
+			}
 		})
 	}
 
@@ -250,21 +959,24 @@ func TestCompareData(t *testing.T) {
 
 func TestGetState(t *testing.T) {
 	shift := mockShift()
-	cache := []shiftboard.Shift{shift}
+	cache := []Shift{shift}
 
 	priorMonth := shift.Updated.AddDate(0, 1, 0).Format(time.RFC3339)
 	shift.Updated, _ = time.Parse(time.RFC3339, priorMonth)
 
+	otherOrgShift := shift
+	otherOrgShift.OrgID = "2002"
+
 	cases := []struct {
 		description string
-		shift       shiftboard.Shift
-		cache       []shiftboard.Shift
+		shift       Shift
+		cache       []Shift
 		expect      string
 	}{
 		{
 			description: "itemCreated",
 			shift:       shift,
-			cache:       []shiftboard.Shift{},
+			cache:       []Shift{},
 			expect:      "created",
 		},
 		{
@@ -273,17 +985,23 @@ func TestGetState(t *testing.T) {
 			cache:       cache,
 			expect:      "updated",
 		},
+		{
+			description: "itemOtherOrg",
+			shift:       otherOrgShift,
+			cache:       []Shift{shift},
+			expect:      "created",
+		},
 		{
 			description: "itemUnknown",
 			shift:       shift,
-			cache:       []shiftboard.Shift{shift},
+			cache:       []Shift{shift},
 			expect:      "",
 		},
 	}
 
 	for _, tt := range cases {
 		t.Run(tt.description, func(t *testing.T) {
-			state := getState(tt.shift, &tt.cache)
+			state := getState(tt.shift, indexShifts(&tt.cache))
 			if e, a := tt.expect, state; e != a {
 				t.Errorf("expect %v, got %v", e, a)
 			}
@@ -291,6 +1009,355 @@ func TestGetState(t *testing.T) {
 	}
 }
 
+func TestGetChanges(t *testing.T) {
+	cached := mockShift()
+
+	shift := cached
+	shift.DisplayTime = "10:00am - 2:00pm"
+	shift.StartDate = "2022-06-15T10:00:00"
+
+	cases := []struct {
+		description string
+		cached      Shift
+		shift       Shift
+		expect      []Change
+	}{
+		{
+			description: "fieldsChanged",
+			cached:      cached,
+			shift:       shift,
+			expect: []Change{
+				{Field: "DisplayTime", Old: cached.DisplayTime, New: "10:00am - 2:00pm"},
+				{Field: "StartDate", Old: "2022-06-15T12:00:00", New: "2022-06-15T10:00:00"},
+			},
+		},
+		{
+			description: "noChanges",
+			cached:      cached,
+			shift:       cached,
+			expect:      nil,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.description, func(t *testing.T) {
+			changes := getChanges(tt.cached, tt.shift)
+			if e, a := len(tt.expect), len(changes); e != a {
+				t.Fatalf("expect %v, got %v", e, a)
+			}
+			for i := range tt.expect {
+				if e, a := tt.expect[i], changes[i]; e != a {
+					t.Errorf("expect %v, got %v", e, a)
+				}
+			}
+		})
+	}
+}
+
+func TestCompareDataRemoved(t *testing.T) {
+	shift := mockShift()
+	removedShift := mockShift()
+
+	cases := []struct {
+		description string
+		newData     []Shift
+		cache       []Shift
+		expect      []string
+	}{
+		{
+			description: "itemRemoved",
+			newData:     []Shift{shift},
+			cache:       []Shift{shift, removedShift},
+			expect:      []string{removedShift.ID},
+		},
+		{
+			description: "nothingRemoved",
+			newData:     []Shift{shift},
+			cache:       []Shift{shift},
+			expect:      []string{},
+		},
+		{
+			description: "lastShiftRemoved",
+			newData:     []Shift{},
+			cache:       []Shift{removedShift},
+			expect:      []string{removedShift.ID},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.description, func(t *testing.T) {
+			removed := []Shift{}
+			for _, diff := range compareData(&tt.newData, &tt.cache) {
+				if diff.State == "removed" {
+					removed = append(removed, diff.Shift)
+				}
+			}
+			if e, a := len(tt.expect), len(removed); e != a {
+				t.Fatalf("expect %v, got %v", e, a)
+			}
+			for i, id := range tt.expect {
+				if e, a := id, removed[i].ID; e != a {
+					t.Errorf("expect %v, got %v", e, a)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkCompareData(b *testing.B) {
+	for _, n := range []int{1000, 5000, 20000} {
+		newData, cachedData := mockDataset(n)
+
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				compareData(&newData, &cachedData)
+			}
+		})
+	}
+}
+
+func BenchmarkIndexShifts(b *testing.B) {
+	_, cachedData := mockDataset(20000)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		indexShifts(&cachedData)
+	}
+}
+
+func TestStaleShifts(t *testing.T) {
+	shift := mockShift()
+	staleShift := mockShift()
+
+	stale := staleShifts([]Shift{shift}, []Shift{shift, staleShift})
+	if e, a := 1, len(stale); e != a {
+		t.Fatalf("expect %v, got %v", e, a)
+	}
+	if e, a := staleShift.ID, stale[0].ID; e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+
+	// Every cached shift is stale when the payload is empty
+	if e, a := 2, len(staleShifts([]Shift{}, []Shift{shift, staleShift})); e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+
+	request := constructDeleteRequest("alice", staleShift)
+	if e, a := cacheKey("alice", staleShift), request.DeleteRequest.Key["Key"].(*dbtypes.AttributeValueMemberS).Value; e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+}
+
+func TestSeedMarker(t *testing.T) {
+	now, _ := time.Parse(time.RFC3339, "2022-06-01T12:00:00Z")
+	table := map[string]map[string]dbtypes.AttributeValue{}
+
+	getClient := mockGetItemAPI(func(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+		if !aws.ToBool(params.ConsistentRead) {
+			t.Error("expect a consistent read")
+		}
+		return &dynamodb.GetItemOutput{Item: table[params.Key["Key"].(*dbtypes.AttributeValueMemberS).Value]}, nil
+	})
+	putClient := mockPutItemAPI(func(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+		if _, ok := params.Item["StartDate"]; ok {
+			t.Error("expect the marker not to be part of the cache index")
+		}
+		table[params.Item["Key"].(*dbtypes.AttributeValueMemberS).Value] = params.Item
+		return &dynamodb.PutItemOutput{}, nil
+	})
+
+	// A seed interrupted before the marker is written is seeded again
+	seeded, err := isSeeded(context.TODO(), getClient, "testTable", "alice")
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if seeded {
+		t.Error("expect cache not to be seeded")
+	}
+
+	if err := markSeeded(context.TODO(), putClient, "testTable", "alice", now); err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+
+	seeded, err = isSeeded(context.TODO(), getClient, "testTable", "alice")
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if !seeded {
+		t.Error("expect cache to be seeded")
+	}
+
+	// Other tenants are seeded on their own
+	if seeded, _ := isSeeded(context.TODO(), getClient, "testTable", "bob"); seeded {
+		t.Error("expect cache of another tenant not to be seeded")
+	}
+}
+
+func TestLogDryRun(t *testing.T) {
+	shift := mockShift()
+	removedShift := mockShift()
+	createdShift := mockShift()
+
+	cases := []struct {
+		description string
+		cache       []Shift
+		seed        bool
+		expect      []string
+	}{
+		{
+			description: "changes",
+			cache:       []Shift{shift, removedShift},
+			expect:      []string{"Dry run, shift change would be notified", "Dry run, shift change would be notified", "Dry run completed"},
+		},
+		{
+			description: "seed",
+			cache:       []Shift{shift, removedShift},
+			seed:        true,
+			expect:      []string{"Dry run, the cache would be rewritten without notifications"},
+		},
+		{
+			description: "emptyCache",
+			cache:       []Shift{},
+			seed:        true,
+			expect:      []string{"Dry run, the cache would be rewritten without notifications"},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.description, func(t *testing.T) {
+			var buf bytes.Buffer
+			ctx := withLogger(context.TODO(), newLogger(&buf, LevelInfo))
+
+			logDryRun(ctx, []Shift{shift, createdShift}, tt.cache, tt.seed)
+
+			msgs := []string{}
+			for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+				var entry map[string]interface{}
+				if err := json.Unmarshal([]byte(line), &entry); err != nil {
+					t.Fatalf("expect no error, got %v", err)
+				}
+				msgs = append(msgs, entry["msg"].(string))
+			}
+			if e, a := fmt.Sprint(tt.expect), fmt.Sprint(msgs); e != a {
+				t.Errorf("expect %v, got %v", e, a)
+			}
+		})
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	shift := mockShift()
+
+	if e, a := shift.OrgID+"#"+shift.ID, shiftKey(shift); e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+
+	if e, a := "alice#"+shift.OrgID+"#"+shift.ID, cacheKey("alice", shift); e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+}
+
+func TestWithDeadlineMargin(t *testing.T) {
+	deadline := time.Now().Add(time.Minute)
+	parent, cancelParent := context.WithDeadline(context.Background(), deadline)
+	defer cancelParent()
+
+	ctx, cancel := withDeadlineMargin(parent, deadlineMargin)
+	defer cancel()
+
+	actual, ok := ctx.Deadline()
+	if !ok {
+		t.Fatal("expect deadline to be set")
+	}
+	if e, a := deadline.Add(-deadlineMargin), actual; !e.Equal(a) {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+
+	ctx, cancel = withDeadlineMargin(context.Background(), deadlineMargin)
+	if _, ok := ctx.Deadline(); ok {
+		t.Error("expect no deadline without a parent deadline")
+	}
+
+	cancel()
+	if ctx.Err() == nil {
+		t.Error("expect context to be cancelled")
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := newLogger(&buf, LevelInfo).With(field("function", "test"))
+
+	logger.Debug("not logged")
+	logger.Info("Sent message to jane.doe@example.com",
+		field("password", "password123"),
+		field("accessToken", "eyJhbGciOi"),
+		field("recipients", []string{"john.doe@example.com"}),
+		field("phoneNumber", "+15555550100"),
+		field("webhookURL", "https://hooks.slack.com/services/T000/B000/XXXX"),
+		field("count", 2),
+		errField(errors.New(`Post "https://hooks.slack.com/services/T000/B000/XXXX": error sending to john.doe@example.com`)))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if e, a := 1, len(lines); e != a {
+		t.Fatalf("expect %v lines, got %v: %s", e, a, buf.String())
+	}
+
+	for _, secret := range []string{"password123", "eyJhbGciOi", "jane.doe", "john.doe", "5555550100", "T000", "not logged"} {
+		if strings.Contains(buf.String(), secret) {
+			t.Errorf("expect %q to be redacted, got %s", secret, buf.String())
+		}
+	}
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("expect JSON log entry, got %v", err)
+	}
+
+	expect := map[string]interface{}{
+		"level":       "info",
+		"msg":         "Sent message to j***@example.com",
+		"function":    "test",
+		"password":    redacted,
+		"phoneNumber": "***00",
+		"webhookURL":  "https://hooks.slack.com/" + redacted,
+		"count":       float64(2),
+		"error":       `Post "https://hooks.slack.com/` + redacted + `": error sending to j***@example.com`,
+	}
+	for k, e := range expect {
+		if a := entry[k]; e != a {
+			t.Errorf("expect %s %v, got %v", k, e, a)
+		}
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	cases := []struct {
+		value     string
+		expect    Level
+		expectErr bool
+	}{
+		{value: "", expect: LevelInfo},
+		{value: "DEBUG", expect: LevelDebug},
+		{value: "warn", expect: LevelWarn},
+		{value: "error", expect: LevelError},
+		{value: "verbose", expect: LevelInfo, expectErr: true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.value, func(t *testing.T) {
+			level, err := parseLevel(tt.value)
+			if e, a := tt.expectErr, err != nil; e != a {
+				t.Errorf("expect error %v, got %v", e, err)
+			}
+			if e, a := tt.expect, level; e != a {
+				t.Errorf("expect %v, got %v", e, a)
+			}
+		})
+	}
+}
+
 func TestGetEnv(t *testing.T) {
 	mockEnv()
 
@@ -324,9 +1391,10 @@ func TestGetEnv(t *testing.T) {
 	}
 }
 
-func TestAddItemTTL(t *testing.T) {
+func TestExtendItem(t *testing.T) {
 	expect := int64(1655899200)
-	result := addItemTTL(mockShift())
+	shift := mockShift()
+	result := extendItem("alice", shift)
 
 	if (ShiftExt{} == result) {
 		t.Errorf("expect struct not to be empty")
@@ -335,6 +1403,14 @@ func TestAddItemTTL(t *testing.T) {
 	if e, a := expect, result.TTL; e != a {
 		t.Errorf("expect %v, got %v", e, a)
 	}
+
+	if e, a := "alice", result.Tenant; e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+
+	if e, a := cacheKey("alice", shift), result.Key; e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
 }
 
 func mockEnv() {
@@ -358,6 +1434,7 @@ func (m *MockItem) New() *MockItem {
 	updateTime, _ := time.Parse(time.RFC3339, "2022-05-11T12:00:00Z")
 
 	m.ID = randomID()
+	m.OrgID = "1001"
 	m.Name = randomString()
 	m.StartDate = "2022-06-15T12:00:00"
 	m.EndDate = "2022-06-15T12:00:00"
@@ -367,13 +1444,38 @@ func (m *MockItem) New() *MockItem {
 	return m
 }
 
-func mockShift() shiftboard.Shift {
-	item := &MockItem{&shiftboard.Shift{}}
+func mockShift() Shift {
+	item := &MockItem{&Shift{}}
 	item.New()
 
 	return *item.Shift
 }
 
+// mockDataset returns a payload of n shifts and a cache of the same size, in
+// which every tenth shift is outdated and one percent of the shifts were
+// created or removed since the last run.
+func mockDataset(n int) (newData []Shift, cachedData []Shift) {
+	base := mockShift()
+
+	for i := 0; i < n; i++ {
+		shift := base
+		shift.ID = strconv.Itoa(100000000 + i)
+		newData = append(newData, shift)
+
+		cached := shift
+		if i%10 == 0 {
+			cached.Updated = shift.Updated.AddDate(0, -1, 0)
+			cached.DisplayTime = "9:00am - 1:00pm"
+		}
+		if i%100 == 0 {
+			cached.ID = strconv.Itoa(200000000 + i)
+		}
+		cachedData = append(cachedData, cached)
+	}
+
+	return newData, cachedData
+}
+
 func randomID() string {
 	rand.Seed(time.Now().UnixNano())
 
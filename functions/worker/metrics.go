@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const metricsNamespace = "ShiftBoardBot"
+
+// Metric is a CloudWatch metric value.
+type Metric struct {
+	Name  string
+	Unit  string
+	Value float64
+}
+
+// putMetrics prints the metrics in the CloudWatch embedded metric format, which
+// CloudWatch Logs extracts from the function logs without API calls.
+func putMetrics(tenant string, metrics ...Metric) {
+	fmt.Println(string(constructMetrics(time.Now(), tenant, metrics...)))
+}
+
+func constructMetrics(now time.Time, tenant string, metrics ...Metric) []byte {
+	definitions := []map[string]string{}
+	doc := map[string]interface{}{
+		"Function": "worker",
+		"Tenant":   tenant,
+	}
+
+	for _, m := range metrics {
+		definitions = append(definitions, map[string]string{"Name": m.Name, "Unit": m.Unit})
+		doc[m.Name] = m.Value
+	}
+
+	doc["_aws"] = map[string]interface{}{
+		"Timestamp": now.UnixMilli(),
+		"CloudWatchMetrics": []map[string]interface{}{{
+			"Namespace":  metricsNamespace,
+			"Dimensions": [][]string{{"Function"}},
+			"Metrics":    definitions,
+		}},
+	}
+
+	// Marshalling maps of basic types cannot fail
+	b, _ := json.Marshal(doc)
+
+	return b
+}
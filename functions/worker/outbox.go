@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+
+	dbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	outboxPending = "pending"
+	// Sparse index of the pending entries by tenant
+	outboxIndexName = "TenantPending"
+	// Outbox entries are kept to suppress duplicates of recent changes
+	outboxTTL = 30 * 24 * time.Hour
+	// Dispatched entries still pending after this time are dispatched again
+	outboxDispatchTimeout = 15 * time.Minute
+)
+
+// OutboxEntry is a shift change waiting to be, or already, notified. Entries
+// are keyed by tenant and by the shift and version of the change, so the same
+// change is only recorded once. PendingAt is removed once the change is sent,
+// so only pending entries are found in the pending index.
+type OutboxEntry struct {
+	Tenant       string
+	ID           string
+	Status       string
+	Diff         string
+	CreatedAt    int64
+	PendingAt    int64 `dynamodbav:",omitempty"`
+	DispatchedAt int64 `dynamodbav:",omitempty"`
+	TTL          int64
+}
+
+type DynamoDBTransactWriteItemsAPI interface {
+	TransactWriteItems(ctx context.Context,
+		params *dynamodb.TransactWriteItemsInput,
+		optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error)
+}
+
+type DynamoDBPutItemAPI interface {
+	PutItem(ctx context.Context,
+		params *dynamodb.PutItemInput,
+		optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+}
+
+type DynamoDBDeleteItemAPI interface {
+	DeleteItem(ctx context.Context,
+		params *dynamodb.DeleteItemInput,
+		optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error)
+}
+
+type DynamoDBRecordAPI interface {
+	DynamoDBTransactWriteItemsAPI
+	DynamoDBPutItemAPI
+	DynamoDBDeleteItemAPI
+}
+
+type DynamoDBUpdateItemAPI interface {
+	UpdateItem(ctx context.Context,
+		params *dynamodb.UpdateItemInput,
+		optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error)
+}
+
+func TransactWriteItems(ctx context.Context, api DynamoDBTransactWriteItemsAPI, items []dbtypes.TransactWriteItem) (*dynamodb.TransactWriteItemsOutput, error) {
+	return api.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: items,
+	})
+}
+
+// recordDiff applies the change to the cache and records it in the outbox in
+// a single transaction. It returns false if the change was already recorded by
+// an earlier run, in which case only the cache is written.
+func recordDiff(ctx context.Context, api DynamoDBRecordAPI, tableName string, outboxTable string, tenant string, item Diff) (bool, error) {
+	cacheWrite, err := constructCacheWrite(tableName, tenant, item)
+	if err != nil {
+		return false, err
+	}
+
+	entry, err := newOutboxEntry(tenant, item, time.Now())
+	if err != nil {
+		return false, err
+	}
+
+	av, err := attributevalue.MarshalMap(entry)
+	if err != nil {
+		return false, fmt.Errorf("error marshalling outbox entry: %v", err)
+	}
+
+	_, err = TransactWriteItems(ctx, api, []dbtypes.TransactWriteItem{
+		cacheWrite,
+		{
+			Put: &dbtypes.Put{
+				TableName:           aws.String(outboxTable),
+				Item:                av,
+				ConditionExpression: aws.String("attribute_not_exists(ID)"),
+			},
+		},
+	})
+	if isConditionFailed(err, 1) {
+		// The cancelled transaction did not write the cache either. A shift
+		// restored with the version it was removed with is only cached again,
+		// otherwise it is found as created by every run.
+		if err := applyCacheWrite(ctx, api, cacheWrite); err != nil {
+			return false, err
+		}
+
+		loggerFrom(ctx).Info("Skipping already recorded change", field("shiftId", item.Shift.ID), field("outboxId", entry.ID))
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error calling DynamoDB TransactWriteItems: %v", err)
+	}
+
+	loggerFrom(ctx).Info("Recorded shift change", field("stage", "record"), field("state", item.State), field("shiftId", item.Shift.ID), field("outboxId", entry.ID))
+
+	return true, nil
+}
+
+// dispatchOutbox publishes the pending entries of a tenant to the notification
+// queue, including entries left over by failed runs. Entries are claimed with
+// a conditional update first, so concurrent runs do not dispatch the same
+// entry. The notification function marks them sent.
+func (h *handler) dispatchOutbox(ctx context.Context, tenant string) error {
+	// Sent entries are not in the pending index, so they are not read again
+	// until they expire
+	p := dynamodb.NewQueryPaginator(h.dbClient, &dynamodb.QueryInput{
+		TableName:              aws.String(h.outboxTable),
+		IndexName:              aws.String(outboxIndexName),
+		KeyConditionExpression: aws.String("Tenant = :tenant"),
+		ExpressionAttributeValues: map[string]dbtypes.AttributeValue{
+			":tenant": &dbtypes.AttributeValueMemberS{Value: tenant},
+		},
+	})
+
+	entries, err := queryOutboxPages(ctx, p)
+	if err != nil {
+		return fmt.Errorf("error reading outbox: %v", err)
+	}
+
+	failed := 0
+	for i, entry := range entries {
+		// Entries not dispatched yet are still pending for the next run
+		if ctx.Err() != nil {
+			return fmt.Errorf("deadline reached after dispatching %d of %d outbox entries", i, len(entries))
+		}
+
+		if err := h.dispatchEntry(ctx, entry, time.Now()); err != nil {
+			loggerFrom(ctx).Error("error dispatching outbox entry", field("outboxId", entry.ID), errField(err))
+			failed++
+		}
+	}
+
+	if failed != 0 {
+		return fmt.Errorf("error dispatching %d of %d outbox entries", failed, len(entries))
+	}
+
+	return nil
+}
+
+func (h *handler) dispatchEntry(ctx context.Context, entry OutboxEntry, now time.Time) error {
+	claimed, err := claimEntry(ctx, h.dbClient, h.outboxTable, entry, now)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		return nil
+	}
+
+	var item Diff
+	if err := json.Unmarshal([]byte(entry.Diff), &item); err != nil {
+		return fmt.Errorf("error unmarshalling outbox entry: %v", err)
+	}
+	item.OutboxID = entry.ID
+
+	// Entries left over by a failed run are notified as part of this run
+	if runID := runIDFrom(ctx); runID != "" && item.RunID != runID {
+		loggerFrom(ctx).Info("Dispatching change of an earlier run", field("shiftId", item.Shift.ID), field("outboxId", entry.ID), field("originRunId", item.RunID))
+		item.RunID = runID
+	}
+
+	if err := h.publishNotification(ctx, item); err != nil {
+		// Release the claim so the next run dispatches the entry right away
+		if rerr := releaseEntry(ctx, h.dbClient, h.outboxTable, entry); rerr != nil {
+			loggerFrom(ctx).Error("error releasing outbox entry", field("outboxId", entry.ID), errField(rerr))
+		}
+		return err
+	}
+
+	return nil
+}
+
+// claimEntry marks a pending entry as dispatched. It returns false if the
+// entry was sent or dispatched by another run in the meantime.
+func claimEntry(ctx context.Context, api DynamoDBUpdateItemAPI, tableName string, entry OutboxEntry, now time.Time) (bool, error) {
+	_, err := api.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(tableName),
+		Key:                 outboxKey(entry.Tenant, entry.ID),
+		UpdateExpression:    aws.String("SET DispatchedAt = :now"),
+		ConditionExpression: aws.String("#status = :pending AND (attribute_not_exists(DispatchedAt) OR DispatchedAt < :stale)"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "Status",
+		},
+		ExpressionAttributeValues: map[string]dbtypes.AttributeValue{
+			":now":     &dbtypes.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+			":stale":   &dbtypes.AttributeValueMemberN{Value: strconv.FormatInt(now.Add(-outboxDispatchTimeout).Unix(), 10)},
+			":pending": &dbtypes.AttributeValueMemberS{Value: outboxPending},
+		},
+	})
+
+	var conditionFailed *dbtypes.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error claiming outbox entry: %v", err)
+	}
+
+	return true, nil
+}
+
+func releaseEntry(ctx context.Context, api DynamoDBUpdateItemAPI, tableName string, entry OutboxEntry) error {
+	_, err := api.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(tableName),
+		Key:              outboxKey(entry.Tenant, entry.ID),
+		UpdateExpression: aws.String("REMOVE DispatchedAt"),
+	})
+
+	return err
+}
+
+func queryOutboxPages(ctx context.Context, pager DynamoDBNewQueryPaginatorAPI) ([]OutboxEntry, error) {
+	var list []OutboxEntry
+
+	for pager.HasMorePages() {
+		output, err := pager.NextPage(ctx)
+		if err != nil {
+			return list, err
+		}
+
+		var pItems []OutboxEntry
+		if err := attributevalue.UnmarshalListOfMaps(output.Items, &pItems); err != nil {
+			return list, err
+		}
+
+		list = append(list, pItems...)
+	}
+
+	return list, nil
+}
+
+// constructCacheWrite returns the cache update of a change, a delete for
+// removed shifts and a put otherwise.
+func constructCacheWrite(tableName string, tenant string, item Diff) (dbtypes.TransactWriteItem, error) {
+	if item.State == "removed" {
+		return dbtypes.TransactWriteItem{
+			Delete: &dbtypes.Delete{
+				TableName: aws.String(tableName),
+				Key: map[string]dbtypes.AttributeValue{
+					"Key": &dbtypes.AttributeValueMemberS{Value: cacheKey(tenant, item.Shift)},
+				},
+			},
+		}, nil
+	}
+
+	av, err := attributevalue.MarshalMap(extendItem(tenant, item.Shift))
+	if err != nil {
+		return dbtypes.TransactWriteItem{}, fmt.Errorf("error marshalling DynamoDB attribute value map: %v", err)
+	}
+
+	return dbtypes.TransactWriteItem{
+		Put: &dbtypes.Put{
+			TableName: aws.String(tableName),
+			Item:      av,
+		},
+	}, nil
+}
+
+// applyCacheWrite applies the cache update of a change on its own, outside of
+// a transaction.
+func applyCacheWrite(ctx context.Context, api DynamoDBRecordAPI, write dbtypes.TransactWriteItem) error {
+	if write.Delete != nil {
+		if _, err := api.DeleteItem(ctx, &dynamodb.DeleteItemInput{TableName: write.Delete.TableName, Key: write.Delete.Key}); err != nil {
+			return fmt.Errorf("error calling DynamoDB DeleteItem: %v", err)
+		}
+		return nil
+	}
+
+	if _, err := api.PutItem(ctx, &dynamodb.PutItemInput{TableName: write.Put.TableName, Item: write.Put.Item}); err != nil {
+		return fmt.Errorf("error calling DynamoDB PutItem: %v", err)
+	}
+
+	return nil
+}
+
+func newOutboxEntry(tenant string, item Diff, now time.Time) (OutboxEntry, error) {
+	diff, err := json.Marshal(item)
+	if err != nil {
+		return OutboxEntry{}, fmt.Errorf("error marshalling outbox entry: %v", err)
+	}
+
+	return OutboxEntry{
+		Tenant:    tenant,
+		ID:        outboxID(item),
+		Status:    outboxPending,
+		Diff:      string(diff),
+		CreatedAt: now.Unix(),
+		PendingAt: now.Unix(),
+		TTL:       now.Add(outboxTTL).Unix(),
+	}, nil
+}
+
+// outboxID identifies a change by the shift, its last update in ShiftBoard
+// and the state, e.g. "1001#123456789#1652270400#updated".
+func outboxID(item Diff) string {
+	return shiftKey(item.Shift) + "#" + strconv.FormatInt(item.Shift.Updated.Unix(), 10) + "#" + item.State
+}
+
+func outboxKey(tenant string, id string) map[string]dbtypes.AttributeValue {
+	return map[string]dbtypes.AttributeValue{
+		"Tenant": &dbtypes.AttributeValueMemberS{Value: tenant},
+		"ID":     &dbtypes.AttributeValueMemberS{Value: id},
+	}
+}
+
+// isConditionFailed reports whether a transaction was cancelled because the
+// condition of the item at the index failed.
+func isConditionFailed(err error, index int) bool {
+	var cancelled *dbtypes.TransactionCanceledException
+	if !errors.As(err, &cancelled) || index >= len(cancelled.CancellationReasons) {
+		return false
+	}
+
+	code := cancelled.CancellationReasons[index].Code
+	return code != nil && *code == "ConditionalCheckFailed"
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// PayloadRef points to a payload the retriever stored in S3 as gzip
+// compressed JSON, because it exceeded the invocation limit.
+type PayloadRef struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+}
+
+type S3GetObjectAPI interface {
+	GetObject(ctx context.Context,
+		params *s3.GetObjectInput,
+		optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
+func GetObject(ctx context.Context, api S3GetObjectAPI, bucket string, key string) (*s3.GetObjectOutput, error) {
+	return api.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+}
+
+// resolvePayload returns the shifts of the event, reading them from S3 if the
+// event references an offloaded payload.
+func resolvePayload(ctx context.Context, api S3GetObjectAPI, event Payload) ([]Shift, error) {
+	if event.PayloadRef == nil {
+		return event.Shifts, nil
+	}
+
+	output, err := GetObject(ctx, api, event.PayloadRef.Bucket, event.PayloadRef.Key)
+	if err != nil {
+		return nil, fmt.Errorf("error reading payload from S3: %v", err)
+	}
+	defer output.Body.Close()
+
+	payload, err := readPayload(output.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading payload s3://%s/%s: %v", event.PayloadRef.Bucket, event.PayloadRef.Key, err)
+	}
+
+	if payload.Tenant != event.Tenant {
+		return nil, fmt.Errorf("payload of tenant '%s' referenced for tenant '%s'", payload.Tenant, event.Tenant)
+	}
+
+	loggerFrom(ctx).Info("Read payload from S3", field("bucket", event.PayloadRef.Bucket), field("key", event.PayloadRef.Key), field("count", len(payload.Shifts)))
+
+	return payload.Shifts, nil
+}
+
+func readPayload(r io.Reader) (Payload, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return Payload{}, err
+	}
+	defer zr.Close()
+
+	var payload Payload
+	if err := json.NewDecoder(zr).Decode(&payload); err != nil {
+		return Payload{}, err
+	}
+
+	return payload, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+
+	dbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+type DynamoDBGetItemAPI interface {
+	GetItem(ctx context.Context,
+		params *dynamodb.GetItemInput,
+		optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+}
+
+// seedKey returns the DynamoDB key of the marker written once the cache of a
+// tenant has been seeded. The marker has no StartDate, so it is not part of
+// the cache index.
+func seedKey(tenant string) map[string]dbtypes.AttributeValue {
+	return map[string]dbtypes.AttributeValue{
+		"Key": &dbtypes.AttributeValueMemberS{Value: tenant + "#seeded"},
+	}
+}
+
+// isSeeded reports whether the cache of a tenant has been seeded completely.
+// A seed interrupted by the deadline is resumed by the retried message rather
+// than notifying the shifts not written yet.
+func isSeeded(ctx context.Context, api DynamoDBGetItemAPI, tableName string, tenant string) (bool, error) {
+	output, err := api.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(tableName),
+		Key:            seedKey(tenant),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return false, fmt.Errorf("error calling DynamoDB GetItem: %v", err)
+	}
+
+	return output.Item != nil, nil
+}
+
+// markSeeded writes the seed marker of a tenant once every shift of the seed
+// has been written.
+func markSeeded(ctx context.Context, api DynamoDBPutItemAPI, tableName string, tenant string, now time.Time) error {
+	item := seedKey(tenant)
+	item["Tenant"] = &dbtypes.AttributeValueMemberS{Value: tenant}
+	item["SeededAt"] = &dbtypes.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)}
+
+	_, err := api.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(tableName),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("error calling DynamoDB PutItem: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"time"
+
+	dbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const dateLayout = "2006-01-02"
+
+// Window is the range of shift start dates retrieved by the retriever, as
+// "2006-01-02" dates with both ends included.
+type Window struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// end returns the day after the window as the upper bound of start dates,
+// e.g. "2022-06-16T09:00:00" sorts before "2022-06-17" but not "2022-06-16".
+func (w Window) end() string {
+	to, err := time.Parse(dateLayout, w.To)
+	if err != nil {
+		return w.To
+	}
+
+	return to.AddDate(0, 0, 1).Format(dateLayout)
+}
+
+// contains reports whether the shift starts within the window, with the same
+// bounds as the cache query.
+func (w Window) contains(shift Shift) bool {
+	return shift.StartDate >= w.From && shift.StartDate <= w.end()
+}
+
+// windowCondition returns the key condition and values which select the
+// tenant's cached shifts within the window. Payloads sent without a window
+// are compared with the upcoming shifts.
+func windowCondition(tenant string, window *Window, now time.Time) (string, map[string]dbtypes.AttributeValue) {
+	values := map[string]dbtypes.AttributeValue{
+		":tenant": &dbtypes.AttributeValueMemberS{Value: tenant},
+	}
+
+	if window == nil {
+		values[":startDate"] = &dbtypes.AttributeValueMemberS{Value: now.Format(dateLayout)}
+		return "Tenant = :tenant AND StartDate > :startDate", values
+	}
+
+	values[":from"] = &dbtypes.AttributeValueMemberS{Value: window.From}
+	values[":end"] = &dbtypes.AttributeValueMemberS{Value: window.end()}
+	return "Tenant = :tenant AND StartDate BETWEEN :from AND :end", values
+}
+
+// filterWindow returns the shifts of the payload starting within the window.
+// ShiftBoard also returns shifts which started before the window but have not
+// ended yet, they are not compared since the cache query does not read them.
+func filterWindow(shifts []Shift, window *Window) []Shift {
+	if window == nil {
+		return shifts
+	}
+
+	filtered := []Shift{}
+	for _, shift := range shifts {
+		if window.contains(shift) {
+			filtered = append(filtered, shift)
+		}
+	}
+
+	return filtered
+}
@@ -0,0 +1,101 @@
+#!/bin/bash
+set -euo pipefail
+
+# Move the messages of a dead-letter queue back to its source queue, e.g.
+# after fixing the cause of the failures. Pass "worker" or "notification" as
+# the queue and optionally the endpoint URL of a local test environment.
+
+STACK_NAME="shiftboard-bot"
+BATCH_SIZE=10
+
+#######################################
+# Read a stack output value.
+# Globals:
+#   STACK_NAME
+# Arguments:
+#   Output key, AWS CLI endpoint arguments
+#######################################
+function stack_output() {
+    local key="$1"
+    shift
+
+    aws cloudformation describe-stacks \
+        --stack-name "$STACK_NAME" \
+        "$@" | \
+        jq -r --arg key "$key" '.Stacks[0].Outputs[] | select(.OutputKey==$key) | .OutputValue'
+}
+
+#######################################
+# Move messages from the dead-letter queue to the source queue until the
+# dead-letter queue is empty.
+# Arguments:
+#   Dead-letter queue URL, source queue URL, AWS CLI endpoint arguments
+#######################################
+function redrive() {
+    local dlq_url="$1"
+    local queue_url="$2"
+    shift 2
+
+    local messages count body receipt_handle moved=0
+
+    while true; do
+        messages=$(aws sqs receive-message \
+            --queue-url "$dlq_url" \
+            --max-number-of-messages "$BATCH_SIZE" \
+            --wait-time-seconds 1 \
+            "$@")
+
+        count=$(jq '.Messages // [] | length' <<< "${messages:-null}")
+        if [ "$count" -eq 0 ]; then
+            break
+        fi
+
+        for i in $(seq 0 $(( count - 1 ))); do
+            body=$(jq -r ".Messages[$i].Body" <<< "$messages")
+            receipt_handle=$(jq -r ".Messages[$i].ReceiptHandle" <<< "$messages")
+
+            # Only delete the message once it is back in the source queue
+            aws sqs send-message \
+                --queue-url "$queue_url" \
+                --message-body "$body" \
+                "$@" > /dev/null
+
+            aws sqs delete-message \
+                --queue-url "$dlq_url" \
+                --receipt-handle "$receipt_handle" \
+                "$@"
+
+            moved=$(( moved + 1 ))
+        done
+    done
+
+    echo "Moved $moved messages to $queue_url"
+}
+
+function main() {
+    local queue endpoint_args=()
+
+    case "${1-}" in
+        worker)
+            queue="Worker"
+            ;;
+        notification)
+            queue="Notification"
+            ;;
+        *)
+            echo "Usage: $0 worker|notification [endpoint-url]"
+            exit 1
+            ;;
+    esac
+
+    if [ -n "${2-}" ]; then
+        endpoint_args=(--endpoint-url "$2")
+    fi
+
+    redrive \
+        "$(stack_output "${queue}DeadLetterQueueUrl" "${endpoint_args[@]}")" \
+        "$(stack_output "${queue}QueueUrl" "${endpoint_args[@]}")" \
+        "${endpoint_args[@]}"
+}
+
+main "$@"
@@ -16,7 +16,7 @@ AWS_LOCAL="true"
 
 # Exported Localstack environment variables
 export EAGER_SERVICE_LOADING=1
-export SERVICES="ssm,dynamodb,lambda,iam,kms,cloudformation"
+export SERVICES="ssm,dynamodb,lambda,iam,kms,cloudformation,s3,sqs,sns"
 export DEBUG=1
 export DEFAULT_REGION="$AWS_REGION"
 export LAMBDA_DOCKER_FLAGS="-e AWS_SAM_LOCAL=$AWS_LOCAL"
@@ -119,6 +119,9 @@ function add_parameter() {
 #   SHIFTBOARD_PASSWORD
 #   SMTP_SENDER
 #   SMTP_RECIPIENT
+#   SLACK_WEBHOOK
+#   SMS_PHONE
+#   CALENDAR_TOKEN
 # Arguments:
 #   Path to override file
 #######################################
@@ -127,6 +130,9 @@ function load_seed_vars {
     SHIFTBOARD_PASSWORD="${SHIFTBOARD_PASSWORD:-testpassword}"
     SMTP_SENDER="${SMTP_SENDER:-no-reply@example.com}"
     SMTP_RECIPIENT="${SMTP_RECIPIENT:-john.doe@example.com,jane.doe@example.com}"
+    SLACK_WEBHOOK="${SLACK_WEBHOOK:-}"
+    SMS_PHONE="${SMS_PHONE:-}"
+    CALENDAR_TOKEN="${CALENDAR_TOKEN:-}"
 
     if [ -f "${1-}" ]; then
         # shellcheck disable=SC1090
@@ -160,6 +166,18 @@ function main() {
     add_parameter "/shiftboard/notifications/sender" "$SMTP_SENDER"
     add_parameter "/shiftboard/notifications/recipient" "$SMTP_RECIPIENT"
 
+    if [ -n "$SLACK_WEBHOOK" ]; then
+        add_parameter "/shiftboard/notifications/slack_webhook" "$SLACK_WEBHOOK" "secure"
+    fi
+
+    if [ -n "$SMS_PHONE" ]; then
+        add_parameter "/shiftboard/notifications/phone" "$SMS_PHONE"
+    fi
+
+    if [ -n "$CALENDAR_TOKEN" ]; then
+        add_parameter "/shiftboard/calendar/token" "$CALENDAR_TOKEN" "secure"
+    fi
+
     echo "Verify email identity: $SMTP_SENDER"
     aws ses verify-email-identity \
         --email-address "$SMTP_SENDER" \
@@ -4,6 +4,7 @@ set -euo pipefail
 ENDPOINT_URL="http://localhost:4566"
 OUT_FILE="output.txt"
 TABLE_NAME="shiftboard-bot"
+OUTBOX_TABLE_NAME="shiftboard-bot-outbox"
 
 RED=$(tput setaf 1)
 GREEN=$(tput setaf 2)
@@ -11,19 +12,23 @@ YELLOW=$(tput setaf 3)
 RED=$(tput setaf 1)
 NOCOLOR=$(tput sgr0)
 
-function random_item_id() {
+function random_item_key() {
     local item_list item_count rand
 
-    item_list=$(aws dynamodb scan --table-name "$TABLE_NAME" --endpoint-url "$ENDPOINT_URL")
+    # Only shifts have a start date, the seed markers and circuit breaker do not
+    item_list=$(aws dynamodb scan \
+        --table-name "$TABLE_NAME" \
+        --filter-expression "attribute_exists(StartDate)" \
+        --endpoint-url "$ENDPOINT_URL")
     item_count=$(jq '.Items | length' <<< "$item_list")
 
     if [ "$item_count" -eq 0 ]; then
         exit 1
     fi
 
-    rand="$((RANDOM % item_count + 1 ))"
+    rand="$((RANDOM % item_count))"
 
-    jq -r ".Items[$rand] | .ID.S" <<< "$item_list"
+    jq -r ".Items[$rand] | .Key.S" <<< "$item_list"
 }
 
 function get_function_name() {
@@ -80,12 +85,12 @@ function wait_for_messages() {
 
 # Delete random item from DynamoDB
 function simulate_new_shift() {
-    local item_id item_name
+    local item_key item_name
 
-    item_id=$(random_item_id)
+    item_key=$(random_item_key)
     item_name=$(aws dynamodb delete-item \
         --table-name "$TABLE_NAME" \
-        --key "{\"ID\": {\"S\": \"$item_id\"}}" \
+        --key "{\"Key\": {\"S\": \"$item_key\"}}" \
         --return-values ALL_OLD \
         --endpoint-url "$ENDPOINT_URL" | \
         jq -r '.Attributes.Name.S')
@@ -95,12 +100,12 @@ function simulate_new_shift() {
 
 # Update random item in DynamoDB
 function simulate_update_shift() {
-    local item_id item_name
+    local item_key item_name
 
-    item_id=$(random_item_id)
+    item_key=$(random_item_key)
     item_name=$(aws dynamodb update-item \
         --table-name "$TABLE_NAME" \
-        --key "{\"ID\": {\"S\": \"$item_id\"}}" \
+        --key "{\"Key\": {\"S\": \"$item_key\"}}" \
         --update-expression "SET Updated = :u" \
         --expression-attribute-values '{":u": { "S": "2022-01-01T00:00:00Z"}}' \
         --return-values ALL_NEW \
@@ -110,6 +115,26 @@ function simulate_update_shift() {
     echo "$item_name"
 }
 
+# Add item to DynamoDB that does not exist in ShiftBoard
+function simulate_removed_shift() {
+    local item_key item_id item_name tenant org_id start_date end_date
+
+    item_id="000000000"
+    item_key="$(random_item_key)"
+    tenant="$(cut -d '#' -f 1 <<< "$item_key")"
+    org_id="$(cut -d '#' -f 2 <<< "$item_key")"
+    item_name="Removed Shift Test"
+    start_date="$(date -u -d '+1 day' '+%Y-%m-%dT12:00:00')"
+    end_date="$(date -u -d '+1 day' '+%Y-%m-%dT16:00:00')"
+
+    aws dynamodb put-item \
+        --table-name "$TABLE_NAME" \
+        --item "{\"Key\": {\"S\": \"$tenant#$org_id#$item_id\"}, \"Tenant\": {\"S\": \"$tenant\"}, \"ID\": {\"S\": \"$item_id\"}, \"OrgID\": {\"S\": \"$org_id\"}, \"Name\": {\"S\": \"$item_name\"}, \"StartDate\": {\"S\": \"$start_date\"}, \"EndDate\": {\"S\": \"$end_date\"}}" \
+        --endpoint-url "$ENDPOINT_URL" > /dev/null
+
+    echo "$item_name"
+}
+
 function check_message() {
     local shift_name="$1"
     local rc=0
@@ -117,7 +142,7 @@ function check_message() {
     curl -s "${ENDPOINT_URL}/_localstack/ses" | \
         jq -e \
         --arg shift_name "$shift_name" \
-        '.messages[] | select(.Subject | contains($shift_name))' > /dev/null 2>&1 || rc="$?"
+        '.messages[] | select((.Subject // .RawData // "") | contains($shift_name))' > /dev/null 2>&1 || rc="$?"
 
     if [ "$rc" -eq 0 ]; then
         printf "Message delivery: %sSUCCESS%s\n" "$GREEN" "$NOCOLOR"
@@ -159,7 +184,7 @@ function run_test() {
     # Wait for specified message count
     wait_for_messages "$msg_count"
 
-    # Check SES messages for shift by subject
+    # Check SES messages for shift by subject, raw messages carry it in RawData
     check_message "$shift_name"
 }
 
@@ -181,6 +206,9 @@ function main() {
     echo "Retrieve Lambda function name"
     function_name=$(get_function_name)
 
+    # Changes are only notified once, so clear the changes of earlier runs
+    "$(dirname "$0")/purge_table.sh" "$OUTBOX_TABLE_NAME" > /dev/null
+
     print_header "Invoke Lambda: $function_name"
     invoke_function "$function_name"
 
@@ -190,6 +218,9 @@ function main() {
     print_header "Test update shift"
     run_test "simulate_update_shift" 2
 
+    print_header "Test removed shift"
+    run_test "simulate_removed_shift" 3
+
     print_header "SES messages"
     curl -s "$ENDPOINT_URL/_localstack/ses" | jq '.messages[] | {Id, Subject}'
 }